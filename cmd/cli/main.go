@@ -1,15 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/datacite/keeshond/internal/app"
 	"github.com/datacite/keeshond/internal/app/db"
 	"github.com/datacite/keeshond/internal/app/event"
+	"github.com/datacite/keeshond/internal/app/registry"
 	"github.com/datacite/keeshond/internal/app/reports"
 	"github.com/datacite/keeshond/internal/app/session"
 	"github.com/datacite/keeshond/internal/app/stats"
@@ -42,20 +48,271 @@ func main() {
 					sessionRepository := session.NewSessionRepository(conn, config)
 					sessionService := session.NewSessionService(sessionRepository, config)
 
-					eventRepository := event.NewEventRepository(conn, config)
+					eventRepositoryDB := event.NewEventRepository(conn, config)
+
+					var eventRepository event.EventRepositoryReader = eventRepositoryDB
+					if config.EventBuffer.Enabled {
+						eventBuffer := event.NewBufferedEventRepository(eventRepositoryDB, config)
+						// Make sure the queued event is written before exiting
+						defer eventBuffer.Close(context.Background())
+						eventRepository = eventBuffer
+					}
+
 					eventService := event.NewEventService(eventRepository, sessionService, config)
 
 					// Send the request to the service for storing
-					eventService.CreateEvent(&eventRequest)
+					_, err := eventService.CreateEvent(&eventRequest)
+
+					return err
+				},
+			},
+			{
+				Name:  "normalise",
+				Usage: "Normalise the pids of stored events and their daily rollups",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "dry-run", Usage: "Only log the pids that would be renamed"},
+					&cli.IntFlag{Name: "batch-size", Value: 1000, Usage: "Number of distinct pids renamed at a time"},
+				},
+				Action: func(cCtx *cli.Context) error {
+					// go run cmd/cli/main.go normalise --dry-run
+
+					// Get configuration from environment variables.
+					var config = app.GetConfigFromEnv()
+
+					// Setup database connection
+					conn := createDB(config)
+
+					eventRepository := event.NewEventRepository(conn, config)
+
+					result, err := event.NormaliseStoredPids(eventRepository, cCtx.Int("batch-size"), cCtx.Bool("dry-run"))
+					log.Printf("Scanned %d pids, renamed %d and skipped %d invalid DOIs", result.Scanned, result.Renamed, result.Invalid)
 
-					return nil
+					return err
+				},
+			},
+			{
+				Name:  "migrate",
+				Usage: "Manage database schema migrations",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "up",
+						Usage: "Apply all pending migrations",
+						Action: func(cCtx *cli.Context) error {
+							migrator, err := createMigrator()
+							if err != nil {
+								return err
+							}
+
+							applied, err := migrator.Up()
+							for _, migration := range applied {
+								log.Printf("Applied migration %d_%s", migration.Version, migration.Name)
+							}
+							if err != nil {
+								return err
+							}
+
+							if len(applied) == 0 {
+								log.Println("No pending migrations.")
+							}
+
+							return nil
+						},
+					},
+					{
+						Name:  "down",
+						Usage: "Roll back the latest migrations, one unless a number is given",
+						Action: func(cCtx *cli.Context) error {
+							// go run cmd/cli/main.go migrate down 2
+
+							// Parse number of steps from first cli argument if present or default to 1
+							steps := 1
+							if cCtx.Args().First() != "" {
+								var err error
+								steps, err = strconv.Atoi(cCtx.Args().First())
+								if err != nil {
+									return err
+								}
+							}
+
+							migrator, err := createMigrator()
+							if err != nil {
+								return err
+							}
+
+							rolledBack, err := migrator.Down(steps)
+							for _, migration := range rolledBack {
+								log.Printf("Rolled back migration %d_%s", migration.Version, migration.Name)
+							}
+
+							return err
+						},
+					},
+					{
+						Name:  "status",
+						Usage: "List migrations and whether they are applied",
+						Action: func(cCtx *cli.Context) error {
+							migrator, err := createMigrator()
+							if err != nil {
+								return err
+							}
+
+							statuses, err := migrator.Status()
+							if err != nil {
+								return err
+							}
+
+							for _, status := range statuses {
+								state := "pending"
+								if status.Applied {
+									state = "applied " + status.AppliedAt.Format(time.RFC3339)
+								}
+								fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, state)
+							}
+
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "repository",
+				Usage: "Manage registered repositories",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "list",
+						Usage: "List registered repositories",
+						Action: func(cCtx *cli.Context) error {
+							registryService := createRegistryService()
+
+							repositories, err := registryService.List()
+							if err != nil {
+								return err
+							}
+
+							for _, repository := range repositories {
+								fmt.Printf("%s\t%s\t%s\t%s\treporting=%t\n", repository.RepoId, repository.ClientId, repository.Publisher, repository.Platform, repository.ReportingEnabled)
+							}
+
+							return nil
+						},
+					},
+					{
+						Name:  "get",
+						Usage: "Show a registered repository",
+						Action: func(cCtx *cli.Context) error {
+							// go run cmd/cli/main.go repository get datacite.demo
+
+							registryService := createRegistryService()
+
+							repository, err := registryService.Get(cCtx.Args().First())
+							if err != nil {
+								return err
+							}
+
+							repositoryJson, err := json.MarshalIndent(repository, "", "  ")
+							if err != nil {
+								return err
+							}
+							fmt.Println(string(repositoryJson))
+
+							return nil
+						},
+					},
+					{
+						Name:  "add",
+						Usage: "Register a repository",
+						Flags: repositoryFlags(true),
+						Action: func(cCtx *cli.Context) error {
+							// go run cmd/cli/main.go repository add --client-id datacite.demo --publisher "Demo Repository" --platform datacite --allowed-domain example.org datacite.demo
+
+							repository := registry.Repository{RepoId: cCtx.Args().First()}
+							if err := applyRepositoryFlags(cCtx, &repository); err != nil {
+								return err
+							}
+
+							repository, err := createRegistryService().Create(repository)
+							if err != nil {
+								return err
+							}
+
+							log.Printf("Registered repository %s", repository.RepoId)
+							return nil
+						},
+					},
+					{
+						Name:  "update",
+						Usage: "Change a registered repository, only the flags given are changed",
+						Flags: repositoryFlags(false),
+						Action: func(cCtx *cli.Context) error {
+							// go run cmd/cli/main.go repository update --validate-doi-url true datacite.demo
+
+							registryService := createRegistryService()
+
+							repository, err := registryService.Get(cCtx.Args().First())
+							if err != nil {
+								return err
+							}
+
+							if err := applyRepositoryFlags(cCtx, &repository); err != nil {
+								return err
+							}
+
+							if _, err := registryService.Update(repository); err != nil {
+								return err
+							}
+
+							log.Printf("Updated repository %s", repository.RepoId)
+							return nil
+						},
+					},
+					{
+						Name:  "delete",
+						Usage: "Remove a registered repository, its usage is kept",
+						Action: func(cCtx *cli.Context) error {
+							repoId := cCtx.Args().First()
+
+							if err := createRegistryService().Delete(repoId); err != nil {
+								return err
+							}
+
+							log.Printf("Deleted repository %s", repoId)
+							return nil
+						},
+					},
 				},
 			},
 			{
 				Name:  "report",
 				Usage: "Generate a report",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "validate",
+						Usage: "Check a report file against the COUNTER schema, gzipped files are read too",
+						Action: func(cCtx *cli.Context) error {
+							// go run cmd/cli/main.go report validate example.com-2022-01-01-2022-12-31-1.json
+
+							filename := cCtx.Args().First()
+
+							reportJson, err := readReportFile(filename)
+							if err != nil {
+								return err
+							}
+
+							if err := reports.ValidateReportJSON(reportJson); err != nil {
+								return err
+							}
+
+							fmt.Printf("%s is valid\n", filename)
+							return nil
+						},
+					},
+				},
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "format", Value: reports.FormatRD1, Usage: "Report format, rd1 or r5.1"},
+					&cli.StringFlag{Name: "granularity", Value: reports.GranularityTotals, Usage: "Performance granularity, totals, month, or for rd1 also day or year"},
+				},
 				Action: func(cCtx *cli.Context) error {
-					// go run cmd/cli/main.go report example.com 2022-01-01 2022-12-31
+					// go run cmd/cli/main.go report --format r5.1 --granularity month example.com 2022-01-01 2022-12-31
 
 					// Parse repoId from first cli argument
 					repoId := cCtx.Args().First()
@@ -95,51 +352,54 @@ func main() {
 						publisherId = cCtx.Args().Get(6)
 					}
 
-					// Create shared data used for all datasets
-					sharedData := reports.SharedData{
-						Platform:    platform,
-						Publisher:   publisher,
-						PublisherId: publisherId,
-					}
-
 					// Get configuration from environment variables.
 					var config = app.GetConfigFromEnv()
 
 					// Setup database connection
 					conn := createDB(config)
 
+					// Look up the shared data used for all datasets from the
+					// registered repository, any given as arguments are used instead
+					registryService := registry.NewRegistryService(registry.NewRegistryRepository(conn), config)
+					sharedData, err := registryService.SharedData(repoId, reports.SharedData{
+						Platform:    platform,
+						Publisher:   publisher,
+						PublisherId: publisherId,
+					})
+					if err != nil {
+						return err
+					}
+
 					statsRepository := stats.NewStatsRepository(conn)
 					statsService := stats.NewStatsService(statsRepository)
 
 					reportsService := reports.NewReportsService(statsService)
 
 					// Generate report
-					generateReport, err := reportsService.GenerateDatasetUsageReport(repoId, beginDate, endDate, sharedData, addCompressedHeader)
+					iterator, err := reportsService.GenerateReport(cCtx.String("format"), repoId, beginDate, endDate, sharedData, addCompressedHeader, cCtx.String("granularity"))
 
 					if err != nil {
 						return err
 					}
 
-					// Keep calling the generateReport function until it returns nil
-					index := 0
+					// Write each part of the report to its own file
 					for {
-						index++
-						report, err := generateReport()
+						part, ok, err := iterator.Next()
 
 						if err != nil {
 							return err
 						}
-						if report == nil {
+						if !ok {
 							break
 						}
 
 						// Serialize report to json
-						reportJson, err := json.MarshalIndent(report, "", "  ")
+						reportJson, err := json.MarshalIndent(part.Report, "", "  ")
 						if err != nil {
 							return err
 						}
 
-						filename := fmt.Sprintf("%s-%s-%s-%d.json", repoId, beginDate.Format("2006-01-02"), endDate.Format("2006-01-02"), index)
+						filename := fmt.Sprintf("%s-%s-%s-%d.json", repoId, beginDate.Format("2006-01-02"), endDate.Format("2006-01-02"), part.Number)
 						f, err := os.Create(filename)
 						if err != nil {
 							return err
@@ -193,10 +453,101 @@ func createDB(config *app.Config) *gorm.DB {
 	return conn
 }
 
-// Function used to do database migrations
-func migrateDB(conn *gorm.DB) {
-	// Migrations.
-	if err := db.AutoMigrate(conn); err != nil {
-		log.Println(err)
+// Function to create a migrator for the embedded migrations
+func createMigrator() (*db.Migrator, error) {
+	// Get configuration from environment variables.
+	var config = app.GetConfigFromEnv()
+
+	// Setup database connection
+	conn := createDB(config)
+
+	return db.NewMigrator(conn)
+}
+
+// Function to create a registry service for the registered repositories
+func createRegistryService() *registry.RegistryService {
+	// Get configuration from environment variables.
+	var config = app.GetConfigFromEnv()
+
+	// Setup database connection
+	conn := createDB(config)
+
+	return registry.NewRegistryService(registry.NewRegistryRepository(conn), config)
+}
+
+// Flags setting the details and settings of a repository, reporting is
+// enabled by default when registering
+func repositoryFlags(reporting bool) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{Name: "client-id", Usage: "DataCite client-id of the repository, reported as the publisher id"},
+		&cli.StringFlag{Name: "publisher", Usage: "Name of the repository in reports"},
+		&cli.StringFlag{Name: "platform", Usage: "Platform in reports"},
+		&cli.StringSliceFlag{Name: "allowed-domain", Usage: "Domain events may be recorded at, can be repeated, any domain when none"},
+		&cli.StringFlag{Name: "validate-doi-existence", Usage: "Check DOIs exist, true, false or default"},
+		&cli.StringFlag{Name: "validate-doi-url", Usage: "Check DOIs are registered with the url, true, false or default"},
+		&cli.BoolFlag{Name: "reporting", Value: reporting, Usage: "Send usage reports for the repository"},
+	}
+}
+
+// Function to set the repository fields of the flags that were given
+func applyRepositoryFlags(cCtx *cli.Context, repository *registry.Repository) error {
+	if cCtx.IsSet("client-id") {
+		repository.ClientId = cCtx.String("client-id")
 	}
+	if cCtx.IsSet("publisher") {
+		repository.Publisher = cCtx.String("publisher")
+	}
+	if cCtx.IsSet("platform") {
+		repository.Platform = cCtx.String("platform")
+	}
+	if cCtx.IsSet("allowed-domain") {
+		repository.AllowedDomains = cCtx.StringSlice("allowed-domain")
+	}
+	if cCtx.IsSet("reporting") || repository.Updated.IsZero() {
+		repository.ReportingEnabled = cCtx.Bool("reporting")
+	}
+
+	for flag, setting := range map[string]**bool{
+		"validate-doi-existence": &repository.ValidateDoiExistence,
+		"validate-doi-url":       &repository.ValidateDoiUrl,
+	} {
+		if !cCtx.IsSet(flag) {
+			continue
+		}
+
+		// Default leaves it to the configuration
+		if cCtx.String(flag) == "default" {
+			*setting = nil
+			continue
+		}
+
+		value, err := strconv.ParseBool(cCtx.String(flag))
+		if err != nil {
+			return fmt.Errorf("--%s should be true, false or default: %w", flag, err)
+		}
+		*setting = &value
+	}
+
+	return nil
+}
+
+// Function to read a report file, gzipped reports are uncompressed
+func readReportFile(filename string) ([]byte, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// Gzip files start with the magic number 1f 8b
+	if !bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		return data, nil
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
 }
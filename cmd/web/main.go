@@ -42,12 +42,15 @@ func run(config *app.Config) error {
 		log.Println("Database connection successful.")
 	}
 
-	// Migrations.
-	if err := db.AutoMigrate(conn); err != nil {
-		log.Println(err)
+	// Refuse to start against a schema that is not fully migrated.
+	if err := db.CheckMigrations(conn); err != nil {
+		return err
 	}
 
-	server := net.NewHttpServer(config, conn)
+	server, err := net.NewHttpServer(config, conn)
+	if err != nil {
+		return err
+	}
 
 	// Open the server.
 	if err := server.Open(); err != nil {
@@ -3,84 +3,253 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/datacite/keeshond/internal/app"
 	"github.com/datacite/keeshond/internal/app/db"
+	"github.com/datacite/keeshond/internal/app/jobs"
+	"github.com/datacite/keeshond/internal/app/registry"
 	"github.com/datacite/keeshond/internal/app/reports"
 	"github.com/datacite/keeshond/internal/app/stats"
 	"gorm.io/gorm"
 )
 
-func report_job(repoId string, beginDate time.Time, endDate time.Time, platform string, publisher string, publisherId string) error {
-	addCompressedHeader := true
-
-	// Get keeshond configuration from environment variables.
-	var config = app.GetConfigFromEnv()
-
-	// config contains the datacite URL, construct reports API URL
-	reportsAPIEndpoint := config.DataCite.Url + "/reports"
-
-	// Setup database connection
-	conn := createDB(config)
+// Generates reports and submits them to the Reports API
+type reporter struct {
+	config            *app.Config
+	reportsService    *reports.ReportsService
+	submissionService *reports.SubmissionService
+	registryService   *registry.RegistryService
+	reportsClient     *reports.ReportsClient
+
+	// Write the gzipped parts to outputDir instead of sending them
+	dryRun    bool
+	outputDir string
+	// Send every part again, updating the parts already in the Reports API
+	resubmit bool
+}
 
+func newReporter(config *app.Config, conn *gorm.DB) *reporter {
 	statsRepository := stats.NewStatsRepository(conn)
 	statsService := stats.NewStatsService(statsRepository)
 
-	reportsService := reports.NewReportsService(statsService)
+	return &reporter{
+		config:            config,
+		reportsService:    reports.NewReportsService(statsService),
+		submissionService: reports.NewSubmissionService(reports.NewReportsRepository(conn)),
+		registryService:   registry.NewRegistryService(registry.NewRegistryRepository(conn), config),
+		reportsClient:     reports.NewReportsClient(config),
+	}
+}
+
+// report_job generates a report and sends each part to the Reports API, it
+// returns the number of parts sent
+func (reporter *reporter) report_job(repoId string, beginDate time.Time, endDate time.Time, platform string, publisher string, publisherId string, format string, granularity string) (int, error) {
+	addCompressedHeader := true
 
-	// Create shared data used for all datasets
-	sharedData := reports.SharedData{
+	// Look up the shared data used for all datasets from the registered
+	// repository, any given here are used instead
+	sharedData, err := reporter.registryService.SharedData(repoId, reports.SharedData{
 		Platform:    platform,
 		Publisher:   publisher,
 		PublisherId: publisherId,
+	})
+	if err != nil {
+		return 0, err
 	}
 
+	log.Printf("Reporting %s as platform: %s, publisher: %s, publisherId: %s", repoId, sharedData.Platform, sharedData.Publisher, sharedData.PublisherId)
+
 	// Generate report
-	generateReport, err := reportsService.GenerateDatasetUsageReport(repoId, beginDate, endDate, sharedData, addCompressedHeader)
+	iterator, err := reporter.reportsService.GenerateReport(format, repoId, beginDate, endDate, sharedData, addCompressedHeader, granularity)
 
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	// Parts acknowledged by an earlier run are not sent again unless
+	// resubmitting, parts sent again update the report they were given
+	submission := reports.ReportSubmission{
+		RepoId:      repoId,
+		BeginDate:   beginDate,
+		EndDate:     endDate,
+		Format:      format,
+		Granularity: granularity,
 	}
 
-	// Keep calling the generateReport function until it returns nil
-	index := 0
+	acknowledged := 0
+	reportIds := map[int]string{}
+	if !reporter.dryRun {
+		reportIds, err = reporter.submissionService.ReportIds(submission)
+		if err != nil {
+			return 0, err
+		}
+
+		if !reporter.resubmit {
+			acknowledged, err = reporter.submissionService.LastAcknowledgedPart(submission)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	if acknowledged > 0 {
+		log.Printf("Resuming %s after part %d, already sent to the Reports API", repoId, acknowledged)
+	}
+
+	sent := 0
+	invalid := 0
+
+	// Keep generating parts until the end of the report
 	for {
-		index++
-		report, err := generateReport()
+		part, ok, err := iterator.Next()
 
 		if err != nil {
-			return err
+			return sent, err
 		}
-		if report == nil {
+		if !ok {
 			// This is the end of report generation
 			break
 		}
 
+		if part.Number <= acknowledged {
+			continue
+		}
+
 		// Serialize report to json
-		reportJson, err := json.MarshalIndent(report, "", "  ")
+		reportJson, err := json.MarshalIndent(part.Report, "", "  ")
 		if err != nil {
-			return err
+			return sent, err
 		}
 
 		// Gzip json
-		compressedJson, _ := gzipData(reportJson)
+		compressedJson, err := gzipData(reportJson)
+		if err != nil {
+			return sent, err
+		}
+
+		// Check the part against the COUNTER schema before the Reports API does
+		validationErr := reports.ValidateReportJSON(reportJson)
+
+		if reporter.dryRun {
+			filename := filepath.Join(reporter.outputDir, fmt.Sprintf("%s-%s-%s-%d.json.gz", repoId, beginDate.Format("2006-01-02"), endDate.Format("2006-01-02"), part.Number))
+			if err := os.WriteFile(filename, compressedJson, 0644); err != nil {
+				return sent, err
+			}
+
+			if validationErr != nil {
+				invalid++
+				fmt.Printf("Part %d written to %s is not valid: %v\n", part.Number, filename, validationErr)
+			} else {
+				fmt.Printf("Part %d written to %s is valid\n", part.Number, filename)
+			}
+			continue
+		}
+
+		if validationErr != nil {
+			return sent, fmt.Errorf("part %d: %w", part.Number, validationErr)
+		}
+
+		// A part an earlier run may have created is not created again
+		if reportIds[part.Number] == "" {
+			if err := reporter.submissionService.CheckUncertain(submission, part.Number); err != nil {
+				return sent, err
+			}
+		}
 
 		// Send to Reports API
-		err = reports.SendReportToAPI(reportsAPIEndpoint, compressedJson, config.DataCite.JWT)
+		reportId, err := reporter.reportsClient.Submit(compressedJson, reportIds[part.Number])
+
+		if errors.Is(err, reports.ErrMaybeCreated) {
+			if err := reporter.submissionService.MarkUncertain(submission, part.Number); err != nil {
+				return sent, err
+			}
+			return sent, fmt.Errorf("sending part %d: %w, check the Reports API and resolve it", part.Number, err)
+		}
 
 		if err != nil {
-			return err
+			return sent, fmt.Errorf("sending part %d: %w", part.Number, err)
 		}
+
+		if err := reporter.submissionService.Acknowledge(submission, part.Number, reportId); err != nil {
+			return sent, err
+		}
+		sent++
+
+		log.Printf("Sent part %d of %s as report %s", part.Number, repoId, reportId)
 	}
 
-	return nil
+	if invalid > 0 {
+		return sent, fmt.Errorf("%d parts of the report are not valid", invalid)
+	}
+
+	return sent, nil
 }
 
 func main() {
+	// go run cmd/worker/main.go --dry-run --output reports
+	dryRun := flag.Bool("dry-run", false, "Validate the report and write each gzipped part to disk without sending it")
+	outputDir := flag.String("output", ".", "Directory the parts of a dry run are written to")
+	resubmit := flag.Bool("resubmit", false, "Send every part again, updating the reports already in the Reports API")
+	resolvePart := flag.Int("resolve-part", 0, "Part that may have been created by an earlier run, resolved before sending the report")
+	reportId := flag.String("report-id", "", "Id of the report the resolved part was created as, empty when it was not created")
+	flag.Parse()
+
+	// Get keeshond configuration from environment variables.
+	var config = app.GetConfigFromEnv()
+
+	// Get report format from environment variable or default to rd1
+	format, ok := os.LookupEnv("REPORT_FORMAT")
+	if !ok {
+		format = reports.FormatRD1
+	}
+
+	// Get performance granularity from environment variable or default to totals
+	granularity, ok := os.LookupEnv("REPORT_GRANULARITY")
+	if !ok {
+		granularity = reports.GranularityTotals
+	}
+
+	// Get mode from environment variable or default to a single report
+	mode, ok := os.LookupEnv("REPORT_MODE")
+	if !ok {
+		mode = "single"
+	}
+
+	if *dryRun && mode != "single" {
+		log.Fatal("--dry-run is only supported for a single report")
+	}
+
+	if *resolvePart > 0 && (mode != "single" || *dryRun) {
+		log.Fatal("--resolve-part is only supported when sending a single report")
+	}
+
+	if *resolvePart <= 0 && *reportId != "" {
+		log.Fatal("--report-id is only used with --resolve-part")
+	}
+
+	switch mode {
+	case "single":
+		single_report(config, format, granularity, *dryRun, *outputDir, *resubmit, *resolvePart, *reportId)
+	case "batch", "daemon":
+		scheduled_reports(config, format, granularity, mode == "daemon", *resubmit)
+	default:
+		log.Fatalf("Unknown REPORT_MODE %q, expected single, batch or daemon", mode)
+	}
+}
+
+// Generate the report of one repository and date range
+func single_report(config *app.Config, format string, granularity string, dryRun bool, outputDir string, resubmit bool, resolvePart int, reportId string) {
 	// Get repoId from environment variable
 	repoId, ok := os.LookupEnv("REPO_ID")
 	if !ok {
@@ -116,36 +285,101 @@ func main() {
 		return
 	}
 
-	// Get platform from environment variable
-	platform, ok := os.LookupEnv("PLATFORM")
-	if !ok {
-		log.Fatal("PLATFORM environment variable not set")
-		return
+	// Get platform, publisher and publisherId from environment variables if
+	// set, otherwise they are those of the registered repository
+	platform := os.Getenv("PLATFORM")
+	publisher := os.Getenv("PUBLISHER")
+	publisherId := os.Getenv("PUBLISHER_ID")
+
+	// Output details of report we're generating
+	log.Printf("Starting generation of %s report for repoId: %s, beginDate: %s, endDate: %s, granularity: %s", format, repoId, beginDate, endDate, granularity)
+
+	reporter := newReporter(config, createDB(config))
+	reporter.dryRun = dryRun
+	reporter.outputDir = outputDir
+	reporter.resubmit = resubmit
+
+	// Record what the operator found in the Reports API for an uncertain part
+	if resolvePart > 0 {
+		submission := reports.ReportSubmission{
+			RepoId:      repoId,
+			BeginDate:   beginDate,
+			EndDate:     endDate,
+			Format:      format,
+			Granularity: granularity,
+		}
+		if err := reporter.submissionService.Resolve(submission, resolvePart, reportId); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Resolved part %d of %s", resolvePart, repoId)
 	}
 
-	// Get publisher from environment variable
-	publisher, ok := os.LookupEnv("PUBLISHER")
-	if !ok {
-		log.Fatal("PUBLISHER environment variable not set")
-		return
+	if _, err := reporter.report_job(repoId, beginDate, endDate, platform, publisher, publisherId, format, granularity); err != nil {
+		log.Fatal(err)
 	}
 
-	// Get publisherId from environment variable
-	publisherId, ok := os.LookupEnv("PUBLISHER_ID")
-	if !ok {
-		log.Fatal("PUBLISHER_ID environment variable not set")
-		return
+	// Success message
+	log.Println("Report generation completed successfully")
+}
+
+// Report the previous month of every repository with events, once or at the
+// start of every month
+func scheduled_reports(config *app.Config, format string, granularity string, daemon bool, resubmit bool) {
+	options := jobs.Options{
+		Format:      format,
+		Granularity: granularity,
+		Resubmit:    resubmit,
 	}
 
-	// Output details of report we're generating
-	log.Printf("Starting generation of report for repoId: %s, beginDate: %s, endDate: %s, platform: %s, publisher: %s, publisherId: %s", repoId, beginDate, endDate, platform, publisher, publisherId)
+	// Optionally report every month since the last successful report
+	options.CatchUp, _ = strconv.ParseBool(os.Getenv("REPORT_CATCH_UP"))
 
-	if err := report_job(repoId, beginDate, endDate, platform, publisher, publisherId); err != nil {
+	// Number of reports generated at a time
+	workers, err := strconv.Atoi(getEnv("REPORT_WORKERS", "4"))
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	// Success message
-	log.Println("Report generation completed successfully")
+	// Time after the start of the month to wait for late events to be validated
+	delay, err := time.ParseDuration(getEnv("REPORT_SCHEDULE_DELAY", "24h"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	conn := createDB(config)
+	reporter := newReporter(config, conn)
+	reporter.resubmit = resubmit
+
+	jobsService := jobs.NewJobsService(jobs.NewJobsRepository(conn), func(job jobs.ReportJob) (int, error) {
+		return reporter.report_job(job.RepoId, job.BeginDate, job.EndDate, "", "", "", job.Format, job.Granularity)
+	}, workers)
+
+	if daemon {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+		defer stop()
+
+		log.Printf("Reporting every month %s after it starts", delay)
+		jobsService.Run(ctx, options, delay)
+		return
+	}
+
+	summary, err := jobsService.RunMonthly(options)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Report generation finished, %d succeeded, %d failed and %d skipped", summary.Succeeded, summary.Failed, summary.Skipped)
+
+	if summary.Failed > 0 {
+		log.Fatalf("%d reports failed, see the report_jobs table", summary.Failed)
+	}
+}
+
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
 }
 
 // Function to gzip data
@@ -4,6 +4,7 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
+	"net/http"
 
 	"github.com/datacite/keeshond/internal/app"
 	"github.com/go-chi/jwtauth/v5"
@@ -25,3 +26,20 @@ func GetAuthToken(config *app.Config) *jwtauth.JWTAuth {
 	// Private key is nil because we are only using the public key to verify the token.
 	return jwtauth.New("RS256", nil, publicKey)
 }
+
+// AdminRole is the role_id claim a token needs to use the admin API
+const AdminRole = "staff_admin"
+
+// RequireAdmin only lets through requests whose token has the admin role, it
+// must come after jwtauth.Verifier and jwtauth.Authenticator.
+func RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, claims, err := jwtauth.FromContext(r.Context())
+		if err != nil || claims["role_id"] != AdminRole {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
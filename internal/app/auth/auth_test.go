@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/jwtauth/v5"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	tokenAuth := jwtauth.New("HS256", []byte("secret"), nil)
+
+	handler := jwtauth.Verifier(tokenAuth)(jwtauth.Authenticator(tokenAuth)(RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))))
+
+	token := func(claims map[string]interface{}) string {
+		_, tokenString, err := tokenAuth.Encode(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokenString
+	}
+
+	tests := map[string]struct {
+		token  string
+		status int
+	}{
+		"no token":       {"", http.StatusUnauthorized},
+		"not admin":      {token(map[string]interface{}{"role_id": "client_admin"}), http.StatusForbidden},
+		"without a role": {token(map[string]interface{}{"uid": "someone"}), http.StatusForbidden},
+		"admin":          {token(map[string]interface{}{"role_id": AdminRole}), http.StatusOK},
+	}
+
+	for name, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/api/admin/repositories", nil)
+		if test.token != "" {
+			request.Header.Set("Authorization", "Bearer "+test.token)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.status {
+			t.Errorf("%s: expected status %d but got %d", name, test.status, recorder.Code)
+		}
+	}
+}
@@ -4,11 +4,18 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Config struct {
 	HTTP struct {
-		Addr string
+		Addr              string
+		ReadTimeout       time.Duration
+		ReadHeaderTimeout time.Duration
+		WriteTimeout      time.Duration
+		IdleTimeout       time.Duration
+		ShutdownTimeout   time.Duration
+		MaxBodyBytes      int64
 	}
 
 	AnalyticsDatabase struct {
@@ -31,8 +38,58 @@ type Config struct {
 	}
 
 	Validate struct {
-		DoiExistence bool
-		DoiUrl       bool
+		DoiExistence     bool
+		DoiUrl           bool
+		Timeout          time.Duration
+		Retries          int
+		CacheSize        int
+		CacheTTL         time.Duration
+		NegativeCacheTTL time.Duration
+		BreakerThreshold int
+		BreakerCooldown  time.Duration
+		FailOpen         bool
+		Async            bool
+		AsyncInterval    time.Duration
+		AsyncBatchSize   int
+		PendingMaxAge    time.Duration
+	}
+
+	Health struct {
+		Timeout       time.Duration
+		CheckDataCite bool
+	}
+
+	Robots struct {
+		Path           string
+		MachinePath    string
+		ReloadInterval time.Duration
+	}
+
+	GeoIP struct {
+		Path string
+	}
+
+	Registry struct {
+		ReloadInterval time.Duration
+	}
+
+	ReportsAPI struct {
+		Timeout    time.Duration
+		Retries    int
+		Backoff    time.Duration
+		MaxBackoff time.Duration
+	}
+
+	Salt struct {
+		RetentionDays int
+	}
+
+	EventBuffer struct {
+		Enabled        bool
+		Size           int
+		BatchSize      int
+		FlushInterval  time.Duration
+		EnqueueTimeout time.Duration
 	}
 }
 
@@ -47,6 +104,12 @@ func GetConfigFromEnv() *Config {
 	// Get configuration from environment variables.
 	config := Config{}
 	config.HTTP.Addr = getEnv("HTTP_ADDR", ":8081")
+	config.HTTP.ReadTimeout, _ = time.ParseDuration(getEnv("HTTP_READ_TIMEOUT", "10s"))
+	config.HTTP.ReadHeaderTimeout, _ = time.ParseDuration(getEnv("HTTP_READ_HEADER_TIMEOUT", "5s"))
+	config.HTTP.WriteTimeout, _ = time.ParseDuration(getEnv("HTTP_WRITE_TIMEOUT", "30s"))
+	config.HTTP.IdleTimeout, _ = time.ParseDuration(getEnv("HTTP_IDLE_TIMEOUT", "60s"))
+	config.HTTP.ShutdownTimeout, _ = time.ParseDuration(getEnv("HTTP_SHUTDOWN_TIMEOUT", "30s"))
+	config.HTTP.MaxBodyBytes, _ = strconv.ParseInt(getEnv("HTTP_MAX_BODY_BYTES", "65536"), 10, 64)
 	config.Plausible.Url = getEnv("PLAUSIBLE_URL", "https://analytics.stage.datacite.org")
 	config.DataCite.Url = getEnv("DATACITE_API_URL", "https://api.stage.datacite.org")
 	config.DataCite.JWT = getEnv("DATACITE_JWT", "")
@@ -62,6 +125,50 @@ func GetConfigFromEnv() *Config {
 	// Validate DOI
 	config.Validate.DoiExistence, _ = strconv.ParseBool(getEnv("VALIDATE_DOI_EXISTENCE", "true"))
 	config.Validate.DoiUrl, _ = strconv.ParseBool(getEnv("VALIDATE_DOI_URL", "false"))
+	config.Validate.Timeout, _ = time.ParseDuration(getEnv("VALIDATE_TIMEOUT", "2s"))
+	config.Validate.Retries, _ = strconv.Atoi(getEnv("VALIDATE_RETRIES", "2"))
+	config.Validate.CacheSize, _ = strconv.Atoi(getEnv("VALIDATE_CACHE_SIZE", "100000"))
+	config.Validate.CacheTTL, _ = time.ParseDuration(getEnv("VALIDATE_CACHE_TTL", "24h"))
+	config.Validate.NegativeCacheTTL, _ = time.ParseDuration(getEnv("VALIDATE_NEGATIVE_CACHE_TTL", "5m"))
+	config.Validate.BreakerThreshold, _ = strconv.Atoi(getEnv("VALIDATE_BREAKER_THRESHOLD", "5"))
+	config.Validate.BreakerCooldown, _ = time.ParseDuration(getEnv("VALIDATE_BREAKER_COOLDOWN", "30s"))
+	config.Validate.FailOpen, _ = strconv.ParseBool(getEnv("VALIDATE_FAIL_OPEN", "false"))
+	config.Validate.Async, _ = strconv.ParseBool(getEnv("VALIDATE_ASYNC", "false"))
+	config.Validate.AsyncInterval, _ = time.ParseDuration(getEnv("VALIDATE_ASYNC_INTERVAL", "1m"))
+	config.Validate.AsyncBatchSize, _ = strconv.Atoi(getEnv("VALIDATE_ASYNC_BATCH_SIZE", "1000"))
+	config.Validate.PendingMaxAge, _ = time.ParseDuration(getEnv("VALIDATE_PENDING_MAX_AGE", "48h"))
+
+	// Readiness checks
+	config.Health.Timeout, _ = time.ParseDuration(getEnv("HEALTH_CHECK_TIMEOUT", "2s"))
+	config.Health.CheckDataCite, _ = strconv.ParseBool(getEnv("HEALTH_CHECK_DATACITE", "false"))
+
+	// COUNTER robots list
+	config.Robots.Path = getEnv("ROBOTS_LIST_PATH", "data/COUNTER_Robots_list.json")
+	config.Robots.MachinePath = getEnv("MACHINE_AGENTS_PATH", "data/machine_agents.json")
+	config.Robots.ReloadInterval, _ = time.ParseDuration(getEnv("ROBOTS_RELOAD_INTERVAL", "1m"))
+
+	// GeoIP country database, countries are not looked up without one
+	config.GeoIP.Path = getEnv("GEOIP_DATABASE_PATH", "")
+
+	// Repository registry, settings are reloaded so changes reach every replica
+	config.Registry.ReloadInterval, _ = time.ParseDuration(getEnv("REGISTRY_RELOAD_INTERVAL", "1m"))
+
+	// Reports API submissions, failures that may pass are retried with a
+	// backoff doubling from REPORTS_API_BACKOFF up to REPORTS_API_MAX_BACKOFF
+	config.ReportsAPI.Timeout, _ = time.ParseDuration(getEnv("REPORTS_API_TIMEOUT", "100s"))
+	config.ReportsAPI.Retries, _ = strconv.Atoi(getEnv("REPORTS_API_RETRIES", "5"))
+	config.ReportsAPI.Backoff, _ = time.ParseDuration(getEnv("REPORTS_API_BACKOFF", "1s"))
+	config.ReportsAPI.MaxBackoff, _ = time.ParseDuration(getEnv("REPORTS_API_MAX_BACKOFF", "1m"))
+
+	// Salts, 0 keeps only the current day
+	config.Salt.RetentionDays, _ = strconv.Atoi(getEnv("SALT_RETENTION_DAYS", "0"))
+
+	// Event buffering
+	config.EventBuffer.Enabled, _ = strconv.ParseBool(getEnv("EVENT_BUFFER_ENABLED", "false"))
+	config.EventBuffer.Size, _ = strconv.Atoi(getEnv("EVENT_BUFFER_SIZE", "10000"))
+	config.EventBuffer.BatchSize, _ = strconv.Atoi(getEnv("EVENT_BUFFER_BATCH_SIZE", "1000"))
+	config.EventBuffer.FlushInterval, _ = time.ParseDuration(getEnv("EVENT_BUFFER_FLUSH_INTERVAL", "5s"))
+	config.EventBuffer.EnqueueTimeout, _ = time.ParseDuration(getEnv("EVENT_BUFFER_ENQUEUE_TIMEOUT", "1s"))
 
 	return &config
 }
@@ -1,14 +1,13 @@
 package db
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"time"
 
 	extraClausePlugin "github.com/WinterYukky/gorm-extra-clause-plugin"
-	"github.com/datacite/keeshond/internal/app/event"
-	"github.com/datacite/keeshond/internal/app/session"
 	"gorm.io/driver/clickhouse"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
@@ -49,29 +48,14 @@ func NewGormClickhouseConnection(dsn string) (*gorm.DB, error) {
 
 // Test if the database connection is working
 func TestConnection(db *gorm.DB) error {
-	sqlDB, err := db.DB()
-	if err != nil {
-		return err
-	}
-	err = sqlDB.Ping()
-	if err != nil {
-		return err
-	}
-	return nil
+	return TestConnectionContext(context.Background(), db)
 }
 
-// Migrate models
-func AutoMigrate(db *gorm.DB) error {
-	var err error
-
-	err = db.Set("gorm:table_options", event.TABLE_OPTIONS).AutoMigrate(&event.Event{})
-
+// TestConnectionContext pings the database, giving up once the context is done
+func TestConnectionContext(ctx context.Context, db *gorm.DB) error {
+	sqlDB, err := db.DB()
 	if err != nil {
 		return err
 	}
-
-	err = db.AutoMigrate(
-		&session.Salt{},
-	)
-	return err
+	return sqlDB.PingContext(ctx)
 }
@@ -0,0 +1,313 @@
+package db
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Migrations are SQL files named NNNN_name.up.sql with a matching
+// NNNN_name.down.sql to undo them, applied in order of their version number.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Table recording which migrations have been applied. Rows are only ever
+// appended, the latest row for a version says if it is currently applied.
+const MigrationsTable = "schema_migrations"
+
+const createMigrationsTable = `CREATE TABLE IF NOT EXISTS ` + MigrationsTable + ` (
+	version UInt64,
+	name String,
+	applied UInt8,
+	applied_at DateTime64(3)
+) ENGINE = MergeTree ORDER BY (version, applied_at)`
+
+var ErrPendingMigrations = errors.New("database has pending migrations, run the migrate up command")
+
+var migrationFilename = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+var statementEnd = regexp.MustCompile(`;\s*(\n|$)`)
+
+type Migration struct {
+	Version uint64
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// LoadMigrations reads and orders the migrations in a directory of the file
+// system, every migration must have both an up and a down file.
+func LoadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[uint64]*Migration)
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		parts := migrationFilename.FindStringSubmatch(entry.Name())
+		if parts == nil {
+			return nil, fmt.Errorf("invalid migration filename %s", entry.Name())
+		}
+
+		version, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		contents, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: parts[2]}
+			byVersion[version] = migration
+		}
+
+		if migration.Name != parts[2] {
+			return nil, fmt.Errorf("migration version %d has more than one name", version)
+		}
+
+		if parts[3] == "up" {
+			migration.Up = string(contents)
+		} else {
+			migration.Down = string(contents)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// splitStatements splits a migration into single statements as Clickhouse
+// only runs one statement at a time. Statements end with a semicolon at the
+// end of a line.
+func splitStatements(sql string) []string {
+	var statements []string
+
+	for _, statement := range statementEnd.Split(sql, -1) {
+		// Drop comment only lines so a trailing comment is not a statement
+		var lines []string
+		for _, line := range strings.Split(statement, "\n") {
+			if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+				lines = append(lines, line)
+			}
+		}
+
+		if statement := strings.TrimSpace(strings.Join(lines, "\n")); statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+
+	return statements
+}
+
+type Migrator struct {
+	db         *gorm.DB
+	migrations []Migration
+}
+
+// NewMigrator creates a migrator for the migrations embedded in the binary
+func NewMigrator(db *gorm.DB) (*Migrator, error) {
+	migrations, err := LoadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{
+		db:         db,
+		migrations: migrations,
+	}, nil
+}
+
+// Status returns every known migration and whether it is applied
+func (migrator *Migrator) Status() ([]MigrationStatus, error) {
+	if err := migrator.db.Exec(createMigrationsTable).Error; err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		Version   uint64
+		Applied   uint8
+		AppliedAt time.Time
+	}
+
+	err := migrator.db.Table(MigrationsTable).
+		Select("version, argMax(applied, applied_at) as applied, max(applied_at) as applied_at").
+		Group("version").
+		Scan(&rows).Error
+
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make(map[uint64]time.Time)
+	for _, row := range rows {
+		if row.Applied == 1 {
+			applied[row.Version] = row.AppliedAt
+		}
+	}
+
+	var statuses []MigrationStatus
+	for _, migration := range migrator.migrations {
+		appliedAt, ok := applied[migration.Version]
+		statuses = append(statuses, MigrationStatus{
+			Migration: migration,
+			Applied:   ok,
+			AppliedAt: appliedAt,
+		})
+	}
+
+	return statuses, nil
+}
+
+// Pending returns the migrations that are not applied yet in order
+func (migrator *Migrator) Pending() ([]Migration, error) {
+	statuses, err := migrator.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+	for _, status := range statuses {
+		if !status.Applied {
+			pending = append(pending, status.Migration)
+		}
+	}
+
+	return pending, nil
+}
+
+// Up applies all pending migrations in order and returns those applied, it
+// stops at the first that fails.
+func (migrator *Migrator) Up() ([]Migration, error) {
+	pending, err := migrator.Pending()
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	for _, migration := range pending {
+		if err := migrator.run(migration.Up); err != nil {
+			return applied, fmt.Errorf("migration %d_%s failed: %w", migration.Version, migration.Name, err)
+		}
+
+		if err := migrator.record(migration, true); err != nil {
+			return applied, err
+		}
+
+		applied = append(applied, migration)
+	}
+
+	return applied, nil
+}
+
+// Down rolls back the given number of most recently applied migrations and
+// returns those rolled back.
+func (migrator *Migrator) Down(steps int) ([]Migration, error) {
+	statuses, err := migrator.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	var rolledBack []Migration
+	for i := len(statuses) - 1; i >= 0 && len(rolledBack) < steps; i-- {
+		if !statuses[i].Applied {
+			continue
+		}
+
+		migration := statuses[i].Migration
+
+		if err := migrator.run(migration.Down); err != nil {
+			return rolledBack, fmt.Errorf("migration %d_%s rollback failed: %w", migration.Version, migration.Name, err)
+		}
+
+		if err := migrator.record(migration, false); err != nil {
+			return rolledBack, err
+		}
+
+		rolledBack = append(rolledBack, migration)
+	}
+
+	return rolledBack, nil
+}
+
+// CheckMigrations returns ErrPendingMigrations unless every migration has been
+// applied to the database.
+func CheckMigrations(db *gorm.DB) error {
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	pending, err := migrator.Pending()
+	if err != nil {
+		return err
+	}
+
+	if len(pending) > 0 {
+		var names []string
+		for _, migration := range pending {
+			names = append(names, fmt.Sprintf("%d_%s", migration.Version, migration.Name))
+		}
+		return fmt.Errorf("%w: %s", ErrPendingMigrations, strings.Join(names, ", "))
+	}
+
+	return nil
+}
+
+func (migrator *Migrator) run(sql string) error {
+	for _, statement := range splitStatements(sql) {
+		if err := migrator.db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (migrator *Migrator) record(migration Migration, applied bool) error {
+	var appliedFlag uint8
+	if applied {
+		appliedFlag = 1
+	}
+
+	return migrator.db.Exec(
+		"INSERT INTO "+MigrationsTable+" (version, name, applied, applied_at) VALUES (?, ?, ?, ?)",
+		migration.Version, migration.Name, appliedFlag, time.Now(),
+	).Error
+}
@@ -0,0 +1,88 @@
+package db
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadMigrationsOrdersByVersion(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/0010_later.up.sql":   {Data: []byte("CREATE TABLE later (id UInt64) ENGINE = Memory;")},
+		"migrations/0010_later.down.sql": {Data: []byte("DROP TABLE later;")},
+		"migrations/0002_first.up.sql":   {Data: []byte("CREATE TABLE first (id UInt64) ENGINE = Memory;")},
+		"migrations/0002_first.down.sql": {Data: []byte("DROP TABLE first;")},
+	}
+
+	migrations, err := LoadMigrations(fsys, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(migrations) != 2 {
+		t.Fatalf("Expected 2 migrations but got %d", len(migrations))
+	}
+
+	if migrations[0].Version != 2 || migrations[0].Name != "first" {
+		t.Errorf("First migration should be 2_first but got %d_%s", migrations[0].Version, migrations[0].Name)
+	}
+
+	if migrations[1].Version != 10 || migrations[1].Down != "DROP TABLE later;" {
+		t.Errorf("Second migration should be 10_later with its down file but got %+v", migrations[1])
+	}
+}
+
+func TestLoadMigrationsRejectsInvalidFiles(t *testing.T) {
+	tests := map[string]fstest.MapFS{
+		"missing down": {
+			"migrations/0001_only_up.up.sql": {Data: []byte("SELECT 1;")},
+		},
+		"bad filename": {
+			"migrations/create_events.sql": {Data: []byte("SELECT 1;")},
+		},
+		"conflicting names": {
+			"migrations/0001_one.up.sql":   {Data: []byte("SELECT 1;")},
+			"migrations/0001_two.down.sql": {Data: []byte("SELECT 1;")},
+		},
+	}
+
+	for name, fsys := range tests {
+		if _, err := LoadMigrations(fsys, "migrations"); err == nil {
+			t.Errorf("%s: LoadMigrations should return an error", name)
+		}
+	}
+}
+
+func TestEmbeddedMigrationsLoad(t *testing.T) {
+	migrations, err := LoadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, migration := range migrations {
+		if migration.Version != uint64(i+1) {
+			t.Errorf("Migration versions should be sequential, expected %d but got %d", i+1, migration.Version)
+		}
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	sql := `-- Leading comment
+CREATE TABLE a (
+	id UInt64
+) ENGINE = Memory;
+
+-- Second table
+CREATE TABLE b (id UInt64) ENGINE = Memory;
+-- Trailing comment
+`
+
+	statements := splitStatements(sql)
+
+	if len(statements) != 2 {
+		t.Fatalf("Expected 2 statements but got %d: %q", len(statements), statements)
+	}
+
+	if statements[1] != "CREATE TABLE b (id UInt64) ENGINE = Memory" {
+		t.Errorf("Unexpected second statement %q", statements[1])
+	}
+}
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS salts;
+
+DROP TABLE IF EXISTS events;
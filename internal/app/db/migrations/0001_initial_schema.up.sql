@@ -0,0 +1,17 @@
+-- Tables previously created by GORM AutoMigrate, existing databases already
+-- have these so they are only created when missing.
+CREATE TABLE IF NOT EXISTS events (
+	timestamp DateTime64(3),
+	name String,
+	repo_id String,
+	user_id UInt64,
+	session_id UInt64,
+	url String,
+	pid String
+) ENGINE = MergeTree PARTITION BY toYYYYMM(timestamp) ORDER BY (repo_id, toDate(timestamp), user_id) SAMPLE BY user_id;
+
+CREATE TABLE IF NOT EXISTS salts (
+	id UInt64,
+	salt String,
+	created DateTime64(3)
+) ENGINE = MergeTree ORDER BY tuple();
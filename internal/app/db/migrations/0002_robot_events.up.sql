@@ -0,0 +1,10 @@
+-- Requests filtered out by the COUNTER robots list, kept apart from events so
+-- they never count towards usage.
+CREATE TABLE IF NOT EXISTS robot_events (
+	timestamp DateTime64(3),
+	name String,
+	repo_id String,
+	url String,
+	pid String,
+	pattern String
+) ENGINE = MergeTree PARTITION BY toYYYYMM(timestamp) ORDER BY (repo_id, toDate(timestamp), pattern);
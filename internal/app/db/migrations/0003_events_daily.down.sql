@@ -0,0 +1,3 @@
+DROP VIEW IF EXISTS events_daily_mv;
+
+DROP TABLE IF EXISTS events_daily;
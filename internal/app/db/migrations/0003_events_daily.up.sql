@@ -0,0 +1,26 @@
+-- Daily rollup of the deduplicated events. Totals are summed and unique
+-- sessions kept as uniq states so they can be merged exactly over any number
+-- of days.
+CREATE TABLE IF NOT EXISTS events_daily (
+	date Date,
+	repo_id String,
+	pid String,
+	name String,
+	total SimpleAggregateFunction(sum, UInt64),
+	unique_sessions AggregateFunction(uniq, UInt64)
+) ENGINE = AggregatingMergeTree PARTITION BY toYYYYMM(date) ORDER BY (repo_id, date, pid, name);
+
+-- Appends each day to the rollup once it is over, applying the same double
+-- click filter as the stats queries. The first refresh backfills every past
+-- day. Refreshable materialized views need Clickhouse 24.10 or later.
+CREATE MATERIALIZED VIEW IF NOT EXISTS events_daily_mv
+REFRESH EVERY 1 DAY OFFSET 10 MINUTE APPEND TO events_daily AS
+SELECT toDate(timestamp) AS date, repo_id, pid, name, count() AS total, uniqState(session_id) AS unique_sessions
+FROM (
+	SELECT repo_id, name, pid, session_id, timestamp,
+		leadInFrame(toNullable(timestamp)) OVER (PARTITION BY repo_id, name, pid, user_id ORDER BY timestamp ASC ROWS BETWEEN CURRENT ROW AND 1 FOLLOWING) AS next_click
+	FROM events
+	WHERE toDate(timestamp) > (SELECT max(date) FROM events_daily) AND toDate(timestamp) < today()
+)
+WHERE next_click IS NULL OR toUnixTimestamp64Milli(next_click) - toUnixTimestamp64Milli(timestamp) > 30000
+GROUP BY date, repo_id, pid, name;
@@ -0,0 +1 @@
+ALTER TABLE salts DROP COLUMN IF EXISTS day;
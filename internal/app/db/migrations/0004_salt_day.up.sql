@@ -0,0 +1,3 @@
+-- Salts belong to a single UTC day so replicas agree on which to use and
+-- expired salts can be deleted.
+ALTER TABLE salts ADD COLUMN IF NOT EXISTS day Date DEFAULT toDate(created, 'UTC');
@@ -0,0 +1,15 @@
+DROP VIEW IF EXISTS events_daily_mv;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS events_daily_mv
+REFRESH EVERY 1 DAY OFFSET 10 MINUTE APPEND TO events_daily AS
+SELECT toDate(timestamp) AS date, repo_id, pid, name, count() AS total, uniqState(session_id) AS unique_sessions
+FROM (
+	SELECT repo_id, name, pid, session_id, timestamp,
+		leadInFrame(toNullable(timestamp)) OVER (PARTITION BY repo_id, name, pid, user_id ORDER BY timestamp ASC ROWS BETWEEN CURRENT ROW AND 1 FOLLOWING) AS next_click
+	FROM events
+	WHERE toDate(timestamp) > (SELECT max(date) FROM events_daily) AND toDate(timestamp) < today()
+)
+WHERE next_click IS NULL OR toUnixTimestamp64Milli(next_click) - toUnixTimestamp64Milli(timestamp) > 30000
+GROUP BY date, repo_id, pid, name;
+
+ALTER TABLE events DROP COLUMN IF EXISTS validation_status;
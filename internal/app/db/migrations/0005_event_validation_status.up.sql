@@ -0,0 +1,22 @@
+-- Events accepted before asynchronous validation has confirmed them are
+-- pending (1) and those that failed are quarantined (2), only confirmed (0)
+-- events are counted.
+ALTER TABLE events ADD COLUMN IF NOT EXISTS validation_status UInt8 DEFAULT 0;
+
+-- The rollup only counts confirmed events, days are not rolled up while any
+-- of their events are still pending.
+DROP VIEW IF EXISTS events_daily_mv;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS events_daily_mv
+REFRESH EVERY 1 DAY OFFSET 10 MINUTE APPEND TO events_daily AS
+SELECT toDate(timestamp) AS date, repo_id, pid, name, count() AS total, uniqState(session_id) AS unique_sessions
+FROM (
+	SELECT repo_id, name, pid, session_id, timestamp,
+		leadInFrame(toNullable(timestamp)) OVER (PARTITION BY repo_id, name, pid, user_id ORDER BY timestamp ASC ROWS BETWEEN CURRENT ROW AND 1 FOLLOWING) AS next_click
+	FROM events
+	WHERE validation_status = 0
+		AND toDate(timestamp) > (SELECT max(date) FROM events_daily)
+		AND toDate(timestamp) < least(today(), ifNull((SELECT minOrNull(toDate(timestamp)) FROM events WHERE validation_status = 1), today()))
+)
+WHERE next_click IS NULL OR toUnixTimestamp64Milli(next_click) - toUnixTimestamp64Milli(timestamp) > 30000
+GROUP BY date, repo_id, pid, name;
@@ -0,0 +1,3 @@
+-- Type of the persistent identifier, events stored before identifiers other
+-- than DOIs were supported are all DOIs.
+ALTER TABLE events ADD COLUMN IF NOT EXISTS pid_type LowCardinality(String) DEFAULT 'doi';
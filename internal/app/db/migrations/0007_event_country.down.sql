@@ -0,0 +1,33 @@
+DROP VIEW IF EXISTS events_daily_mv;
+
+-- Columns of the key can not be dropped, so the rollup is copied without them
+CREATE TABLE IF NOT EXISTS events_daily_without_country (
+	date Date,
+	repo_id String,
+	pid String,
+	name String,
+	total SimpleAggregateFunction(sum, UInt64),
+	unique_sessions AggregateFunction(uniq, UInt64)
+) ENGINE = AggregatingMergeTree PARTITION BY toYYYYMM(date) ORDER BY (repo_id, date, pid, name);
+
+INSERT INTO events_daily_without_country SELECT date, repo_id, pid, name, total, unique_sessions FROM events_daily;
+
+DROP TABLE IF EXISTS events_daily;
+
+RENAME TABLE events_daily_without_country TO events_daily;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS events_daily_mv
+REFRESH EVERY 1 DAY OFFSET 10 MINUTE APPEND TO events_daily AS
+SELECT toDate(timestamp) AS date, repo_id, pid, name, count() AS total, uniqState(session_id) AS unique_sessions
+FROM (
+	SELECT repo_id, name, pid, session_id, timestamp,
+		leadInFrame(toNullable(timestamp)) OVER (PARTITION BY repo_id, name, pid, user_id ORDER BY timestamp ASC ROWS BETWEEN CURRENT ROW AND 1 FOLLOWING) AS next_click
+	FROM events
+	WHERE validation_status = 0
+		AND toDate(timestamp) > (SELECT max(date) FROM events_daily)
+		AND toDate(timestamp) < least(today(), ifNull((SELECT minOrNull(toDate(timestamp)) FROM events WHERE validation_status = 1), today()))
+)
+WHERE next_click IS NULL OR toUnixTimestamp64Milli(next_click) - toUnixTimestamp64Milli(timestamp) > 30000
+GROUP BY date, repo_id, pid, name;
+
+ALTER TABLE events DROP COLUMN IF EXISTS country;
@@ -0,0 +1,23 @@
+-- Country of the client, looked up from its ip when a GeoIP database is
+-- configured. Events stored without one have no country.
+ALTER TABLE events ADD COLUMN IF NOT EXISTS country LowCardinality(String) DEFAULT '';
+
+-- The rollup keeps countries apart, so the country has to be part of the key
+-- or rows of different countries would be merged together.
+ALTER TABLE events_daily ADD COLUMN IF NOT EXISTS country LowCardinality(String) DEFAULT '' AFTER name, MODIFY ORDER BY (repo_id, date, pid, name, country);
+
+DROP VIEW IF EXISTS events_daily_mv;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS events_daily_mv
+REFRESH EVERY 1 DAY OFFSET 10 MINUTE APPEND TO events_daily AS
+SELECT toDate(timestamp) AS date, repo_id, pid, name, country, count() AS total, uniqState(session_id) AS unique_sessions
+FROM (
+	SELECT repo_id, name, pid, country, session_id, timestamp,
+		leadInFrame(toNullable(timestamp)) OVER (PARTITION BY repo_id, name, pid, user_id ORDER BY timestamp ASC ROWS BETWEEN CURRENT ROW AND 1 FOLLOWING) AS next_click
+	FROM events
+	WHERE validation_status = 0
+		AND toDate(timestamp) > (SELECT max(date) FROM events_daily)
+		AND toDate(timestamp) < least(today(), ifNull((SELECT minOrNull(toDate(timestamp)) FROM events WHERE validation_status = 1), today()))
+)
+WHERE next_click IS NULL OR toUnixTimestamp64Milli(next_click) - toUnixTimestamp64Milli(timestamp) > 30000
+GROUP BY date, repo_id, pid, name, country;
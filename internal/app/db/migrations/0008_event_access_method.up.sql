@@ -0,0 +1,22 @@
+-- COUNTER access method of the event, machine access is by API clients and
+-- scripts. Events stored before then are all regular.
+ALTER TABLE events ADD COLUMN IF NOT EXISTS access_method LowCardinality(String) DEFAULT 'regular';
+
+-- The rollup keeps access methods apart in the same way as countries
+ALTER TABLE events_daily ADD COLUMN IF NOT EXISTS access_method LowCardinality(String) DEFAULT 'regular' AFTER country, MODIFY ORDER BY (repo_id, date, pid, name, country, access_method);
+
+DROP VIEW IF EXISTS events_daily_mv;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS events_daily_mv
+REFRESH EVERY 1 DAY OFFSET 10 MINUTE APPEND TO events_daily AS
+SELECT toDate(timestamp) AS date, repo_id, pid, name, country, access_method, count() AS total, uniqState(session_id) AS unique_sessions
+FROM (
+	SELECT repo_id, name, pid, country, access_method, session_id, timestamp,
+		leadInFrame(toNullable(timestamp)) OVER (PARTITION BY repo_id, name, pid, user_id ORDER BY timestamp ASC ROWS BETWEEN CURRENT ROW AND 1 FOLLOWING) AS next_click
+	FROM events
+	WHERE validation_status = 0
+		AND toDate(timestamp) > (SELECT max(date) FROM events_daily)
+		AND toDate(timestamp) < least(today(), ifNull((SELECT minOrNull(toDate(timestamp)) FROM events WHERE validation_status = 1), today()))
+)
+WHERE next_click IS NULL OR toUnixTimestamp64Milli(next_click) - toUnixTimestamp64Milli(timestamp) > 30000
+GROUP BY date, repo_id, pid, name, country, access_method;
@@ -0,0 +1,11 @@
+-- Parts of usage reports acknowledged by the Reports API, so a failed report
+-- run can resume after the parts that were already sent.
+CREATE TABLE IF NOT EXISTS report_submissions (
+	repo_id String,
+	begin_date Date,
+	end_date Date,
+	format LowCardinality(String),
+	granularity LowCardinality(String),
+	part UInt32,
+	submitted DateTime64(3)
+) ENGINE = ReplacingMergeTree(submitted) ORDER BY (repo_id, begin_date, end_date, format, granularity, part);
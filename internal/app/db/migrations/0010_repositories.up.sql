@@ -0,0 +1,15 @@
+-- Registered repositories, their reporting details and the settings their
+-- events are checked with. Each change inserts a new version of the row and
+-- deleted repositories are kept as a deleted version, read with FINAL.
+CREATE TABLE IF NOT EXISTS repositories (
+	repo_id String,
+	client_id String,
+	publisher String,
+	platform String,
+	allowed_domains Array(String),
+	validate_doi_existence Nullable(Bool),
+	validate_doi_url Nullable(Bool),
+	reporting_enabled Bool,
+	updated DateTime64(3),
+	deleted Bool
+) ENGINE = ReplacingMergeTree(updated) ORDER BY repo_id;
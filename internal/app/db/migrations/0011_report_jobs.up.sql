@@ -0,0 +1,14 @@
+-- History of scheduled report runs, one row for each attempt at the report of
+-- a repository and month with whether it succeeded.
+CREATE TABLE IF NOT EXISTS report_jobs (
+	repo_id String,
+	begin_date Date,
+	end_date Date,
+	format LowCardinality(String),
+	granularity LowCardinality(String),
+	status LowCardinality(String),
+	error String,
+	parts UInt32,
+	started DateTime64(3),
+	finished DateTime64(3)
+) ENGINE = MergeTree ORDER BY (repo_id, begin_date, started);
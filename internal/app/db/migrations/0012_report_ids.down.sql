@@ -0,0 +1 @@
+ALTER TABLE report_submissions DROP COLUMN IF EXISTS report_id;
@@ -0,0 +1,3 @@
+-- Id the Reports API gave each part, re-submissions of a part update that
+-- report rather than creating another. Parts acknowledged before then have none.
+ALTER TABLE report_submissions ADD COLUMN IF NOT EXISTS report_id String DEFAULT '' AFTER part;
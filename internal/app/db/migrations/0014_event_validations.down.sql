@@ -0,0 +1,25 @@
+DROP VIEW IF EXISTS events_daily_mv;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS events_daily_mv
+REFRESH EVERY 1 DAY OFFSET 10 MINUTE APPEND TO events_daily AS
+SELECT toDate(timestamp) AS date, repo_id, pid, name, country, access_method, count() AS total, uniqState(session_id) AS unique_sessions
+FROM (
+	SELECT repo_id, name, pid, country, access_method, session_id, timestamp,
+		leadInFrame(toNullable(timestamp)) OVER (PARTITION BY repo_id, name, pid, user_id ORDER BY timestamp ASC ROWS BETWEEN CURRENT ROW AND 1 FOLLOWING) AS next_click
+	FROM events
+	LEFT JOIN (SELECT repo_id, max(date) AS rolled_up FROM events_daily GROUP BY repo_id) AS rollup USING (repo_id)
+	LEFT JOIN (SELECT repo_id, min(toDate(timestamp)) AS first_pending FROM events WHERE validation_status = 1 GROUP BY repo_id) AS pending USING (repo_id)
+	WHERE validation_status = 0
+		AND toDate(timestamp) > ifNull(rolled_up, toDate(0))
+		AND toDate(timestamp) < least(today(), ifNull(first_pending, today()))
+)
+WHERE next_click IS NULL OR toUnixTimestamp64Milli(next_click) - toUnixTimestamp64Milli(timestamp) > 30000
+GROUP BY date, repo_id, pid, name, country, access_method
+SETTINGS join_use_nulls = 1;
+
+-- Outcomes are written back to the events before they are dropped
+ALTER TABLE events UPDATE validation_status = 0 WHERE validation_status = 1 AND (repo_id, pid, url, toDate(timestamp)) IN (SELECT repo_id, pid, url, date FROM event_validations FINAL WHERE status = 0) SETTINGS mutations_sync = 1;
+
+ALTER TABLE events UPDATE validation_status = 2 WHERE validation_status = 1 AND (repo_id, pid, url, toDate(timestamp)) IN (SELECT repo_id, pid, url, date FROM event_validations FINAL WHERE status = 2) SETTINGS mutations_sync = 1;
+
+DROP TABLE IF EXISTS event_validations;
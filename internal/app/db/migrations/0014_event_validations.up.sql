@@ -0,0 +1,39 @@
+-- Outcome of validating the pending events of a pid and url on a day. Pending
+-- events keep their status in the events table and are counted once their
+-- outcome here is confirmed (0), so validating them does not rewrite parts of
+-- the events table. Recording the same outcome again replaces it.
+CREATE TABLE IF NOT EXISTS event_validations (
+	repo_id String,
+	pid String,
+	url String,
+	date Date,
+	status UInt8,
+	validated_at DateTime64(3)
+) ENGINE = ReplacingMergeTree(validated_at) ORDER BY (repo_id, date, pid, url);
+
+-- Pending events with a confirmed outcome are rolled up, those without an
+-- outcome yet hold back the rollup of their repository
+DROP VIEW IF EXISTS events_daily_mv;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS events_daily_mv
+REFRESH EVERY 1 DAY OFFSET 10 MINUTE APPEND TO events_daily AS
+SELECT toDate(timestamp) AS date, repo_id, pid, name, country, access_method, count() AS total, uniqState(session_id) AS unique_sessions
+FROM (
+	SELECT repo_id, name, pid, country, access_method, session_id, timestamp,
+		leadInFrame(toNullable(timestamp)) OVER (PARTITION BY repo_id, name, pid, user_id ORDER BY timestamp ASC ROWS BETWEEN CURRENT ROW AND 1 FOLLOWING) AS next_click
+	FROM events
+	LEFT JOIN (SELECT repo_id, max(date) AS rolled_up FROM events_daily GROUP BY repo_id) AS rollup USING (repo_id)
+	LEFT JOIN (
+		SELECT repo_id, min(toDate(timestamp)) AS first_pending
+		FROM events
+		WHERE validation_status = 1
+			AND (repo_id, pid, url, toDate(timestamp)) NOT IN (SELECT repo_id, pid, url, date FROM event_validations)
+		GROUP BY repo_id
+	) AS pending USING (repo_id)
+	WHERE (validation_status = 0 OR (validation_status = 1 AND (repo_id, pid, url, toDate(timestamp)) IN (SELECT repo_id, pid, url, date FROM event_validations FINAL WHERE status = 0)))
+		AND toDate(timestamp) > ifNull(rolled_up, toDate(0))
+		AND toDate(timestamp) < least(today(), ifNull(first_pending, today()))
+)
+WHERE next_click IS NULL OR toUnixTimestamp64Milli(next_click) - toUnixTimestamp64Milli(timestamp) > 30000
+GROUP BY date, repo_id, pid, name, country, access_method
+SETTINGS join_use_nulls = 1;
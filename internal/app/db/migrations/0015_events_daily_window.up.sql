@@ -0,0 +1,49 @@
+-- Events can arrive after their day was rolled up, so the rollup is made
+-- again for the last week on every refresh. Rows of a day made again replace
+-- those made before, the rollup is read with FINAL.
+DROP VIEW IF EXISTS events_daily_mv;
+
+CREATE TABLE IF NOT EXISTS events_daily_replacing (
+	date Date,
+	repo_id String,
+	pid String,
+	name String,
+	country LowCardinality(String) DEFAULT '',
+	access_method LowCardinality(String) DEFAULT 'regular',
+	total SimpleAggregateFunction(sum, UInt64),
+	unique_sessions AggregateFunction(uniq, UInt64),
+	refreshed DateTime DEFAULT now()
+) ENGINE = ReplacingMergeTree(refreshed) PARTITION BY toYYYYMM(date) ORDER BY (repo_id, date, pid, name, country, access_method);
+
+-- Rows not merged yet are merged as they are copied
+INSERT INTO events_daily_replacing (date, repo_id, pid, name, country, access_method, total, unique_sessions)
+SELECT date, repo_id, pid, name, country, access_method, sum(total), uniqMergeState(unique_sessions)
+FROM events_daily
+GROUP BY date, repo_id, pid, name, country, access_method;
+
+DROP TABLE IF EXISTS events_daily;
+
+RENAME TABLE events_daily_replacing TO events_daily;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS events_daily_mv
+REFRESH EVERY 1 DAY OFFSET 10 MINUTE APPEND TO events_daily AS
+SELECT toDate(timestamp) AS date, repo_id, pid, name, country, access_method, count() AS total, uniqState(session_id) AS unique_sessions, now() AS refreshed
+FROM (
+	SELECT repo_id, name, pid, country, access_method, session_id, timestamp,
+		leadInFrame(toNullable(timestamp)) OVER (PARTITION BY repo_id, name, pid, user_id ORDER BY timestamp ASC ROWS BETWEEN CURRENT ROW AND 1 FOLLOWING) AS next_click
+	FROM events
+	LEFT JOIN (SELECT repo_id, max(date) AS rolled_up FROM events_daily GROUP BY repo_id) AS rollup USING (repo_id)
+	LEFT JOIN (
+		SELECT repo_id, min(toDate(timestamp)) AS first_pending
+		FROM events
+		WHERE validation_status = 1
+			AND (repo_id, pid, url, toDate(timestamp)) NOT IN (SELECT repo_id, pid, url, date FROM event_validations)
+		GROUP BY repo_id
+	) AS pending USING (repo_id)
+	WHERE (validation_status = 0 OR (validation_status = 1 AND (repo_id, pid, url, toDate(timestamp)) IN (SELECT repo_id, pid, url, date FROM event_validations FINAL WHERE status = 0)))
+		AND toDate(timestamp) > least(ifNull(rolled_up, toDate(0)), today() - 8)
+		AND toDate(timestamp) < least(today(), ifNull(first_pending, today()))
+)
+WHERE next_click IS NULL OR toUnixTimestamp64Milli(next_click) - toUnixTimestamp64Milli(timestamp) > 30000
+GROUP BY date, repo_id, pid, name, country, access_method
+SETTINGS join_use_nulls = 1;
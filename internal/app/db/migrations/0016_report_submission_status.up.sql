@@ -0,0 +1,4 @@
+-- Whether the Reports API acknowledged the part, or a create failed after it
+-- may have reached the Reports API. Parts recorded before then were all
+-- acknowledged.
+ALTER TABLE report_submissions ADD COLUMN IF NOT EXISTS status LowCardinality(String) DEFAULT 'acknowledged' AFTER report_id;
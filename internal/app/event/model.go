@@ -12,6 +12,14 @@ type Event struct {
 	SessionID uint64    `json:"sessionId"`
 	Url       string    `json:"url"`
 	Pid       string    `json:"pid"`
+	PidType   string    `json:"pidType"` // See pid.Type
+	Country   string    `json:"country"` // ISO 3166-1 alpha-2 code, empty when unknown
+
+	// See AccessRegular and AccessMachine
+	AccessMethod string `json:"accessMethod"`
+
+	// Only confirmed events are counted, see ValidationConfirmed
+	ValidationStatus uint8 `json:"validationStatus"`
 
 	// The following are excluded from being stored, this is part of preventing
 	// user identifable information being available to be leaked.
@@ -20,4 +28,71 @@ type Event struct {
 	Useragent string `gorm:"-:all" json:"useragent"`
 }
 
-const TABLE_OPTIONS = "ENGINE=MergeTree PARTITION BY toYYYYMM(timestamp) ORDER BY (repo_id, toDate(timestamp), user_id) SAMPLE BY user_id"
+// Validation states of an event. Events validated before they are stored, or
+// not needing validation, are confirmed straight away. With asynchronous
+// validation they are pending until the background validator confirms or
+// quarantines them.
+const (
+	ValidationConfirmed   uint8 = 0
+	ValidationPending     uint8 = 1
+	ValidationQuarantined uint8 = 2
+)
+
+// Access methods of an event as defined by COUNTER. Machine access is by API
+// clients and scripts that are not robots.
+const (
+	AccessRegular = "regular"
+	AccessMachine = "machine"
+)
+
+// RobotEvent is a request that was filtered out because the useragent matched
+// the COUNTER robots list. They are kept apart from events so they never count
+// towards usage, only what is needed to audit the filtering is stored.
+type RobotEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	Name      string    `json:"name"`
+	RepoId    string    `json:"repoId"`
+	Url       string    `json:"url"`
+	Pid       string    `json:"pid"`
+	Pattern   string    `json:"pattern"` // Robots list pattern that matched
+}
+
+// PendingValidation identifies events waiting for asynchronous validation,
+// every event with the same pid and url on the day gets the same result.
+type PendingValidation struct {
+	RepoId string
+	Pid    string
+	Url    string
+	Date   time.Time
+	// Time of the oldest of the pending events
+	Oldest time.Time
+}
+
+// EventValidation is the outcome of validating pending events, see
+// PendingValidation. Pending events are counted once confirmed here, their
+// own status is left as it is.
+type EventValidation struct {
+	RepoId      string
+	Pid         string
+	Url         string
+	Date        time.Time `gorm:"type:Date"`
+	Status      uint8     // ValidationConfirmed or ValidationQuarantined
+	ValidatedAt time.Time
+}
+
+// StoredPid is a distinct pid of the stored events with its pid type, the type
+// is empty when events of the pid have been stored with different types
+type StoredPid struct {
+	Pid     string
+	PidType string
+	// Only left in the daily rollup by a rename that did not finish, there
+	// are no events to take the type from
+	RollupOnly bool
+}
+
+// PidRename moves the events stored with a pid to its normalised form
+type PidRename struct {
+	From string
+	To   string
+	Type string
+}
@@ -0,0 +1,76 @@
+package event
+
+import (
+	"log"
+
+	"github.com/datacite/keeshond/internal/app/pid"
+)
+
+// StoredPidRepository is implemented by repositories whose stored pids can be
+// rewritten
+type StoredPidRepository interface {
+	Pids(after string, limit int) ([]StoredPid, error)
+	RenamePids(renames []PidRename) error
+}
+
+type NormaliseResult struct {
+	Scanned int // Distinct pids looked at
+	Renamed int // Pids moved to their normalised form or given their type
+	Invalid int // Malformed DOIs left as they are
+}
+
+// NormaliseStoredPids canonicalises the pids of events stored before they
+// were normalised on ingestion, a batch of distinct pids at a time. Malformed
+// DOIs can not be fixed so they are logged and left alone. Pids already in
+// their normalised form and type are left alone too, so running it again
+// renames nothing, and a run that failed part way is finished by running it
+// again. With dryRun the renames are only logged.
+func NormaliseStoredPids(repository StoredPidRepository, batchSize int, dryRun bool) (NormaliseResult, error) {
+	var result NormaliseResult
+
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+
+	after := ""
+	for {
+		pids, err := repository.Pids(after, batchSize)
+		if err != nil {
+			return result, err
+		}
+
+		if len(pids) == 0 {
+			return result, nil
+		}
+
+		var renames []PidRename
+		for _, stored := range pids {
+			result.Scanned++
+
+			identifier, err := pid.Parse(stored.Pid)
+			if err != nil {
+				log.Printf("Skipping %q: %v", stored.Pid, err)
+				result.Invalid++
+				continue
+			}
+
+			// Events stored before pid types were recorded are all typed as DOIs
+			if identifier.Value != stored.Pid || (!stored.RollupOnly && string(identifier.Type) != stored.PidType) {
+				renames = append(renames, PidRename{From: stored.Pid, To: identifier.Value, Type: string(identifier.Type)})
+			}
+		}
+
+		for _, rename := range renames {
+			log.Printf("Renaming %q to %q of type %s", rename.From, rename.To, rename.Type)
+		}
+
+		if !dryRun {
+			if err := repository.RenamePids(renames); err != nil {
+				return result, err
+			}
+		}
+
+		result.Renamed += len(renames)
+		after = pids[len(pids)-1].Pid
+	}
+}
@@ -0,0 +1,126 @@
+package event
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Stored pids held in memory, renames are applied to them
+type MockStoredPidRepository struct {
+	pids       map[string]string // Pid to pid type
+	rollupOnly map[string]bool   // Pids with no events left
+	renames    [][]PidRename
+}
+
+func (m *MockStoredPidRepository) Pids(after string, limit int) ([]StoredPid, error) {
+	var pids []StoredPid
+	for p, pidType := range m.pids {
+		if p > after {
+			pids = append(pids, StoredPid{Pid: p, PidType: pidType, RollupOnly: m.rollupOnly[p]})
+		}
+	}
+	sort.Slice(pids, func(i, j int) bool { return pids[i].Pid < pids[j].Pid })
+
+	if len(pids) > limit {
+		pids = pids[:limit]
+	}
+	return pids, nil
+}
+
+func (m *MockStoredPidRepository) RenamePids(renames []PidRename) error {
+	m.renames = append(m.renames, renames)
+	for _, rename := range renames {
+		delete(m.pids, rename.From)
+		delete(m.rollupOnly, rename.From)
+		m.pids[rename.To] = rename.Type
+	}
+	return nil
+}
+
+func TestNormaliseStoredPids(t *testing.T) {
+	repository := &MockStoredPidRepository{
+		pids: map[string]string{
+			"10.5072/abc":                 "doi",
+			"10.5072/ABC":                 "doi",
+			"doi:10.5072/def":             "doi",
+			"https://doi.org/10.5072%2Fg": "doi",
+			"20.500.12345/item":           "doi",
+			"10.5072":                     "doi",
+		},
+	}
+
+	result, err := NormaliseStoredPids(repository, 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Scanned != 6 || result.Renamed != 4 || result.Invalid != 1 {
+		t.Errorf("Expected 6 scanned, 4 renamed and 1 invalid but got %+v", result)
+	}
+
+	want := map[string]string{
+		"10.5072/abc":       "doi",
+		"10.5072/def":       "doi",
+		"10.5072/g":         "doi",
+		"20.500.12345/item": "handle",
+		"10.5072":           "doi",
+	}
+
+	if len(repository.pids) != len(want) {
+		t.Errorf("Expected pids %v but got %v", want, repository.pids)
+	}
+	for p, pidType := range want {
+		if repository.pids[p] != pidType {
+			t.Errorf("Expected %s of type %s but got %q", p, pidType, repository.pids[p])
+		}
+	}
+
+	// Everything is normalised so a second run renames nothing
+	result, err = NormaliseStoredPids(repository, 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Renamed != 0 || result.Scanned != 5 {
+		t.Errorf("Second run should scan 5 and rename nothing but got %+v", result)
+	}
+}
+
+func TestNormaliseStoredPidsDryRun(t *testing.T) {
+	repository := &MockStoredPidRepository{
+		pids: map[string]string{"10.5072/ABC": "doi"},
+	}
+
+	result, err := NormaliseStoredPids(repository, 10, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Renamed != 1 || len(repository.renames) != 0 {
+		t.Errorf("Dry run should count the rename without applying it but got %+v", result)
+	}
+}
+
+func TestNormaliseStoredPidsFinishesRenamesLeftInTheRollup(t *testing.T) {
+	// A rename failed once the events were moved, the old pid is only left in
+	// the rollup. Pids in the rollup have no type.
+	repository := &MockStoredPidRepository{
+		pids: map[string]string{
+			"10.5072/abc":                 "doi",
+			"https://doi.org/10.5072/ABC": "",
+			"10.5072/def":                 "",
+		},
+		rollupOnly: map[string]bool{"https://doi.org/10.5072/ABC": true, "10.5072/def": true},
+	}
+
+	result, err := NormaliseStoredPids(repository, 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []PidRename{{From: "https://doi.org/10.5072/ABC", To: "10.5072/abc", Type: "doi"}}
+	if result.Renamed != 1 || len(repository.renames) != 1 || !reflect.DeepEqual(repository.renames[0], expected) {
+		t.Errorf("Only the pid left in the rollup should be renamed but got %v", repository.renames)
+	}
+}
@@ -2,16 +2,25 @@ package event
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/datacite/keeshond/internal/app"
+	"github.com/datacite/keeshond/internal/app/metrics"
 	"gorm.io/gorm"
 )
 
 type EventRepositoryReader interface {
 	Create(event *Event) error
+	CreateRobot(event *RobotEvent) error
 	// GetAll() ([]Event, error)
 	// GetByID(id uint) (Event, error)
 }
@@ -35,9 +44,446 @@ func NewEventRepository(db *gorm.DB, config *app.Config) *EventRepository {
 
 // Create a new event
 func (repository *EventRepository) Create(event *Event) error {
+	start := time.Now()
+	err := repository.db.Create(event).Error
+	metrics.ObserveSince(metrics.EventInsertDuration, start, metrics.Outcome(err))
+
+	return err
+}
+
+// Create many events with a single insert
+func (repository *EventRepository) CreateBatch(events []Event) error {
+	return createBatch(repository.db, events)
+}
+
+// Record a request that was filtered as a robot
+func (repository *EventRepository) CreateRobot(event *RobotEvent) error {
 	return repository.db.Create(event).Error
 }
 
+// Create many robot events with a single insert
+func (repository *EventRepository) CreateRobotBatch(events []RobotEvent) error {
+	return createBatch(repository.db, events)
+}
+
+// Pending returns up to limit distinct pid and url pairs of each day with
+// events waiting for validation, those waiting longest first
+func (repository *EventRepository) Pending(limit int) ([]PendingValidation, error) {
+	var pending []PendingValidation
+
+	err := repository.db.Model(&Event{}).
+		Select("repo_id, pid, url, toDate(timestamp) AS date, min(timestamp) AS oldest").
+		Where("validation_status = ?", ValidationPending).
+		Where("(repo_id, pid, url, toDate(timestamp)) NOT IN (?)", repository.db.Model(&EventValidation{}).Select("repo_id, pid, url, date")).
+		Group("repo_id, pid, url, date").
+		Order("oldest").
+		Limit(limit).
+		Scan(&pending).Error
+
+	return pending, err
+}
+
+// SetValidationStatus records the outcome of the pending events of the given
+// pid and url pairs. The outcomes are inserted rather than the events updated,
+// so each cycle is a small insert instead of a mutation of the events table.
+func (repository *EventRepository) SetValidationStatus(pending []PendingValidation, status uint8) error {
+	validatedAt := time.Now()
+
+	validations := make([]EventValidation, 0, len(pending))
+	for _, p := range pending {
+		validations = append(validations, EventValidation{
+			RepoId:      p.RepoId,
+			Pid:         p.Pid,
+			Url:         p.Url,
+			Date:        p.Date,
+			Status:      status,
+			ValidatedAt: validatedAt,
+		})
+	}
+
+	return createBatch(repository.db, validations)
+}
+
+// Pids returns up to limit distinct pids of stored events and the daily
+// rollup that sort after the given pid with their pid type, in order so all
+// of them can be paged through. Pids only in the rollup are left there by a
+// rename that failed part way, they are returned so it can be finished.
+func (repository *EventRepository) Pids(after string, limit int) ([]StoredPid, error) {
+	var pids []StoredPid
+
+	// Rollup rows have no pid type, types are only counted from the events
+	events := repository.db.Model(&Event{}).
+		Select("pid, toNullable(pid_type) AS pid_type").
+		Where("pid > ?", after)
+
+	rollup := repository.db.Table("events_daily").
+		Distinct("pid", "CAST(NULL, 'Nullable(String)') AS pid_type").
+		Where("pid > ?", after)
+
+	err := repository.db.Table("(? UNION ALL ?) AS stored", events, rollup).
+		Select("pid, ifNull(if(uniqExact(pid_type) = 1, any(pid_type), ''), '') AS pid_type, toBool(count(pid_type) = 0) AS rollup_only").
+		Group("pid").
+		Order("pid").
+		Limit(limit).
+		Scan(&pids).Error
+
+	return pids, err
+}
+
+// RenamePids moves stored events from each pid to its normalised form and
+// sets the pid type of the events, then remakes the daily rollup rows of the
+// days the moved pids were rolled up on from the events and deletes those of
+// the old pids. Each step can be repeated, so running the renames again after
+// a failure leaves the same rollup as a run that did not fail.
+func (repository *EventRepository) RenamePids(renames []PidRename) error {
+	if len(renames) == 0 {
+		return nil
+	}
+
+	var from, to, types []interface{}
+	for _, rename := range renames {
+		from = append(from, rename.From)
+		to = append(to, rename.To)
+		types = append(types, rename.Type)
+	}
+
+	// Slices are bound as tuples, transform needs arrays
+	array := arrayPlaceholder(len(renames))
+
+	var args []interface{}
+	args = append(args, from...)
+	args = append(args, to...)
+	args = append(args, from...)
+	args = append(args, types...)
+	args = append(args, from)
+
+	err := repository.db.Exec(
+		"ALTER TABLE events UPDATE pid = transform(pid, "+array+", "+array+"), pid_type = transform(pid, "+array+", "+array+", pid_type) WHERE pid IN ? SETTINGS mutations_sync = 1",
+		args...,
+	).Error
+	if err != nil {
+		return err
+	}
+
+	// Only the type of some pids changes, their rollup rows stay where they are
+	var movedFrom, movedTo []interface{}
+	for _, rename := range renames {
+		if rename.From != rename.To {
+			movedFrom = append(movedFrom, rename.From)
+			movedTo = append(movedTo, rename.To)
+		}
+	}
+
+	if len(movedFrom) == 0 {
+		return nil
+	}
+
+	array = arrayPlaceholder(len(movedFrom))
+
+	args = nil
+	args = append(args, movedFrom...)
+	args = append(args, movedTo...)
+	args = append(args, movedFrom)
+
+	// Validation outcomes follow their events, recording them again replaces them
+	err = repository.db.Exec(
+		"INSERT INTO event_validations SELECT repo_id, transform(pid, "+array+", "+array+"), url, date, status, validated_at FROM event_validations WHERE pid IN ?",
+		args...,
+	).Error
+	if err != nil {
+		return err
+	}
+
+	// Days with rollup rows of either pid are made again
+	var moved []interface{}
+	moved = append(moved, movedFrom...)
+	moved = append(moved, movedTo...)
+
+	// Rolled up as events_daily_mv does, the rows replace any made before
+	err = repository.db.Exec(
+		`INSERT INTO events_daily (date, repo_id, pid, name, country, access_method, total, unique_sessions)
+		SELECT toDate(timestamp) AS date, repo_id, pid, name, country, access_method, count() AS total, uniqState(session_id) AS unique_sessions
+		FROM (
+			SELECT repo_id, name, pid, country, access_method, session_id, timestamp,
+				leadInFrame(toNullable(timestamp)) OVER (PARTITION BY repo_id, name, pid, user_id ORDER BY timestamp ASC ROWS BETWEEN CURRENT ROW AND 1 FOLLOWING) AS next_click
+			FROM events
+			WHERE pid IN ?
+				AND (repo_id, toDate(timestamp)) IN (SELECT repo_id, date FROM events_daily WHERE pid IN ?)
+				AND (validation_status = ? OR (validation_status = ? AND (repo_id, pid, url, toDate(timestamp)) IN (SELECT repo_id, pid, url, date FROM event_validations FINAL WHERE status = ?)))
+		)
+		WHERE next_click IS NULL OR toUnixTimestamp64Milli(next_click) - toUnixTimestamp64Milli(timestamp) > 30000
+		GROUP BY date, repo_id, pid, name, country, access_method`,
+		movedTo, moved, ValidationConfirmed, ValidationPending, ValidationConfirmed,
+	).Error
+	if err != nil {
+		return err
+	}
+
+	return repository.db.Exec(
+		"ALTER TABLE events_daily DELETE WHERE pid IN ? SETTINGS mutations_sync = 1",
+		movedFrom,
+	).Error
+}
+
+// arrayPlaceholder returns an array literal of n placeholders
+func arrayPlaceholder(n int) string {
+	return "[" + strings.TrimSuffix(strings.Repeat("?, ", n), ", ") + "]"
+}
+
+func createBatch[T any](db *gorm.DB, rows []T) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	// The clickhouse driver only sends the rows as one block when the insert
+	// happens inside a transaction, otherwise every row is a seperate insert.
+	return db.Transaction(func(tx *gorm.DB) error {
+		return tx.Create(&rows).Error
+	})
+}
+
+//
+// Buffered implementation of the event repository
+//
+
+// EventBatchWriter is implemented by repositories that can store many events at once
+type EventBatchWriter interface {
+	CreateBatch(events []Event) error
+	CreateRobotBatch(events []RobotEvent) error
+}
+
+var (
+	ErrEventBufferFull   = errors.New("event buffer is full, try again later")
+	ErrEventBufferClosed = errors.New("event buffer is closed")
+)
+
+// Number of attempts made to write a batch before the events are dropped
+const bufferFlushAttempts = 3
+
+type EventBufferStats struct {
+	Depth    int    `json:"depth"`    // Events waiting in the queue
+	Capacity int    `json:"capacity"` // Maximum events the queue can hold
+	Flushed  uint64 `json:"flushed"`  // Events successfully written
+	Failed   uint64 `json:"failed"`   // Events dropped after failed writes
+	Rejected uint64 `json:"rejected"` // Events refused because the queue was full
+}
+
+// BufferedEventRepository queues events in memory and writes them in batches,
+// either when a batch is full or when the flush interval has passed.
+type BufferedEventRepository struct {
+	events *batchQueue[Event]
+	robots *batchQueue[RobotEvent]
+}
+
+// NewBufferedEventRepository creates a buffered repository and starts the
+// background flushing, Close must be called to drain remaining events.
+func NewBufferedEventRepository(writer EventBatchWriter, config *app.Config) *BufferedEventRepository {
+	return &BufferedEventRepository{
+		events: newBatchQueue("events", writer.CreateBatch, true, config),
+		robots: newBatchQueue("robot events", writer.CreateRobotBatch, false, config),
+	}
+}
+
+// Create queues an event, when the queue is full it waits up to the enqueue
+// timeout before rejecting the event so callers feel the backpressure.
+func (repository *BufferedEventRepository) Create(event *Event) error {
+	return repository.events.add(*event)
+}
+
+// CreateRobot queues a robot event in a seperate queue so robot traffic can
+// never crowd out real events.
+func (repository *BufferedEventRepository) CreateRobot(event *RobotEvent) error {
+	return repository.robots.add(*event)
+}
+
+// Stats returns the current state of the events queue
+func (repository *BufferedEventRepository) Stats() EventBufferStats {
+	return repository.events.stats()
+}
+
+// RobotStats returns the current state of the robot events queue
+func (repository *BufferedEventRepository) RobotStats() EventBufferStats {
+	return repository.robots.stats()
+}
+
+// Close stops accepting events and waits for the queues to be written out or
+// for the context to expire, whichever is first.
+func (repository *BufferedEventRepository) Close(ctx context.Context) error {
+	return errors.Join(
+		repository.events.close(ctx),
+		repository.robots.close(ctx),
+	)
+}
+
+// batchQueue is a bounded queue that hands rows to the write function in batches
+type batchQueue[T any] struct {
+	name           string
+	write          func([]T) error
+	queue          chan T
+	batchSize      int
+	flushInterval  time.Duration
+	enqueueTimeout time.Duration
+	retryDelay     time.Duration
+	// Writes are recorded in the event insert duration
+	timed bool
+
+	// Guards closed, senders hold a read lock so the queue is never closed
+	// underneath them.
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+
+	flushed  atomic.Uint64
+	failed   atomic.Uint64
+	rejected atomic.Uint64
+}
+
+func newBatchQueue[T any](name string, write func([]T) error, timed bool, config *app.Config) *batchQueue[T] {
+	size := config.EventBuffer.Size
+	if size <= 0 {
+		size = 10000
+	}
+
+	batchSize := config.EventBuffer.BatchSize
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+
+	flushInterval := config.EventBuffer.FlushInterval
+	if flushInterval <= 0 {
+		flushInterval = 5 * time.Second
+	}
+
+	q := &batchQueue[T]{
+		name:           name,
+		write:          write,
+		queue:          make(chan T, size),
+		batchSize:      batchSize,
+		flushInterval:  flushInterval,
+		enqueueTimeout: config.EventBuffer.EnqueueTimeout,
+		retryDelay:     time.Second,
+		timed:          timed,
+		done:           make(chan struct{}),
+	}
+
+	go q.run()
+
+	return q
+}
+
+func (q *batchQueue[T]) add(row T) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		return ErrEventBufferClosed
+	}
+
+	select {
+	case q.queue <- row:
+		return nil
+	default:
+	}
+
+	if q.enqueueTimeout <= 0 {
+		q.rejected.Add(1)
+		return ErrEventBufferFull
+	}
+
+	timer := time.NewTimer(q.enqueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case q.queue <- row:
+		return nil
+	case <-timer.C:
+		q.rejected.Add(1)
+		return ErrEventBufferFull
+	}
+}
+
+func (q *batchQueue[T]) stats() EventBufferStats {
+	return EventBufferStats{
+		Depth:    len(q.queue),
+		Capacity: cap(q.queue),
+		Flushed:  q.flushed.Load(),
+		Failed:   q.failed.Load(),
+		Rejected: q.rejected.Load(),
+	}
+}
+
+func (q *batchQueue[T]) close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.queue)
+	}
+	q.mu.Unlock()
+
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%s buffer not drained, %d remaining: %w", q.name, len(q.queue), ctx.Err())
+	}
+}
+
+func (q *batchQueue[T]) run() {
+	defer close(q.done)
+
+	ticker := time.NewTicker(q.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]T, 0, q.batchSize)
+
+	for {
+		select {
+		case row, ok := <-q.queue:
+			if !ok {
+				// Queue closed, write out whatever is left
+				q.flush(batch)
+				return
+			}
+
+			batch = append(batch, row)
+			if len(batch) >= q.batchSize {
+				q.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			q.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (q *batchQueue[T]) flush(batch []T) {
+	if len(batch) == 0 {
+		return
+	}
+
+	var err error
+	for attempt := 1; attempt <= bufferFlushAttempts; attempt++ {
+		start := time.Now()
+		err = q.write(batch)
+		if q.timed {
+			metrics.ObserveSince(metrics.EventInsertDuration, start, metrics.Outcome(err))
+		}
+
+		if err == nil {
+			q.flushed.Add(uint64(len(batch)))
+			return
+		}
+
+		if attempt < bufferFlushAttempts {
+			time.Sleep(time.Duration(attempt) * q.retryDelay)
+		}
+	}
+
+	q.failed.Add(uint64(len(batch)))
+	log.Printf("Failed to write batch of %d %s: %v", len(batch), q.name, err)
+}
+
 //
 // Plausible implementation of the event repository
 //
@@ -101,3 +547,8 @@ func (repository *RepositoryPlausible) Create(event *Event) error {
 
 	return nil
 }
+
+// Robot traffic is not sent to plausible as it does its own bot filtering
+func (repository *RepositoryPlausible) CreateRobot(event *RobotEvent) error {
+	return nil
+}
@@ -0,0 +1,245 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/datacite/keeshond/internal/app"
+	"github.com/datacite/keeshond/internal/app/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Batch writer that records the batches it was given
+type MockEventBatchWriter struct {
+	mu      sync.Mutex
+	batches [][]Event
+	robots  []RobotEvent
+	err     error
+	block   chan struct{}
+}
+
+func (m *MockEventBatchWriter) CreateBatch(events []Event) error {
+	if m.block != nil {
+		<-m.block
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+
+	// Copy as the buffer reuses the slice
+	batch := make([]Event, len(events))
+	copy(batch, events)
+	m.batches = append(m.batches, batch)
+
+	return nil
+}
+
+func (m *MockEventBatchWriter) CreateRobotBatch(events []RobotEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+
+	m.robots = append(m.robots, events...)
+
+	return nil
+}
+
+func (m *MockEventBatchWriter) Batches() [][]Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.batches
+}
+
+func buildBufferConfig(size int, batchSize int, flushInterval time.Duration, enqueueTimeout time.Duration) *app.Config {
+	config := &app.Config{}
+	config.EventBuffer.Enabled = true
+	config.EventBuffer.Size = size
+	config.EventBuffer.BatchSize = batchSize
+	config.EventBuffer.FlushInterval = flushInterval
+	config.EventBuffer.EnqueueTimeout = enqueueTimeout
+
+	return config
+}
+
+func TestBufferedEventRepositoryFlushesWhenBatchIsFull(t *testing.T) {
+	writer := &MockEventBatchWriter{}
+	repository := NewBufferedEventRepository(writer, buildBufferConfig(100, 3, time.Hour, 0))
+
+	for i := 0; i < 3; i++ {
+		if err := repository.Create(&Event{Name: "view"}); err != nil {
+			t.Fatalf("Create should not return an error but got %v", err)
+		}
+	}
+
+	// Wait for the background flush
+	deadline := time.Now().Add(time.Second)
+	for len(writer.Batches()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	batches := writer.Batches()
+	if len(batches) != 1 || len(batches[0]) != 3 {
+		t.Fatalf("Expected one batch of 3 events but got %v", batches)
+	}
+
+	repository.Close(context.Background())
+}
+
+// Number of inserts recorded in the event insert duration with the outcome
+func insertsObserved(t *testing.T, outcome string) uint64 {
+	var metric dto.Metric
+	if err := metrics.EventInsertDuration.WithLabelValues(outcome).(prometheus.Metric).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestBufferedEventRepositoryTimesBatchInserts(t *testing.T) {
+	before := insertsObserved(t, metrics.OutcomeOk)
+
+	writer := &MockEventBatchWriter{block: make(chan struct{})}
+	repository := NewBufferedEventRepository(writer, buildBufferConfig(100, 1000, time.Hour, 0))
+
+	// Queueing is not an insert
+	for i := 0; i < 3; i++ {
+		repository.Create(&Event{Name: "view"})
+	}
+	repository.CreateRobot(&RobotEvent{})
+
+	if observed := insertsObserved(t, metrics.OutcomeOk) - before; observed != 0 {
+		t.Errorf("Queueing events should not be timed but got %d inserts", observed)
+	}
+
+	close(writer.block)
+	repository.Close(context.Background())
+
+	// A single batch of events, robot events are not timed
+	if observed := insertsObserved(t, metrics.OutcomeOk) - before; observed != 1 {
+		t.Errorf("Expected the batch insert to be timed once but got %d", observed)
+	}
+}
+
+func TestBufferedEventRepositoryFlushesOnInterval(t *testing.T) {
+	writer := &MockEventBatchWriter{}
+	repository := NewBufferedEventRepository(writer, buildBufferConfig(100, 1000, 20*time.Millisecond, 0))
+
+	repository.Create(&Event{Name: "view"})
+
+	deadline := time.Now().Add(time.Second)
+	for len(writer.Batches()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(writer.Batches()) != 1 {
+		t.Fatalf("Expected the interval to flush a single batch but got %d", len(writer.Batches()))
+	}
+
+	repository.Close(context.Background())
+}
+
+func TestBufferedEventRepositoryDrainsOnClose(t *testing.T) {
+	writer := &MockEventBatchWriter{}
+	repository := NewBufferedEventRepository(writer, buildBufferConfig(100, 1000, time.Hour, 0))
+
+	for i := 0; i < 10; i++ {
+		repository.Create(&Event{Name: "download"})
+	}
+
+	if err := repository.Close(context.Background()); err != nil {
+		t.Fatalf("Close should not return an error but got %v", err)
+	}
+
+	total := 0
+	for _, batch := range writer.Batches() {
+		total += len(batch)
+	}
+
+	if total != 10 {
+		t.Errorf("Expected 10 events written on close but got %d", total)
+	}
+
+	if stats := repository.Stats(); stats.Flushed != 10 {
+		t.Errorf("Expected 10 flushed events in stats but got %d", stats.Flushed)
+	}
+
+	if err := repository.Create(&Event{Name: "view"}); !errors.Is(err, ErrEventBufferClosed) {
+		t.Errorf("Create after close should return ErrEventBufferClosed but got %v", err)
+	}
+}
+
+func TestBufferedEventRepositoryRejectsWhenFull(t *testing.T) {
+	// Block the writer so nothing leaves the queue
+	writer := &MockEventBatchWriter{block: make(chan struct{})}
+	repository := NewBufferedEventRepository(writer, buildBufferConfig(2, 1, time.Hour, 10*time.Millisecond))
+
+	// First event is taken by the flusher and blocks, the next two fill the queue
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		err = repository.Create(&Event{Name: "view"})
+	}
+
+	if !errors.Is(err, ErrEventBufferFull) {
+		t.Errorf("Create should return ErrEventBufferFull but got %v", err)
+	}
+
+	stats := repository.Stats()
+	if stats.Rejected != 1 {
+		t.Errorf("Expected 1 rejected event but got %d", stats.Rejected)
+	}
+	if stats.Depth != stats.Capacity {
+		t.Errorf("Expected queue depth %d to equal capacity %d", stats.Depth, stats.Capacity)
+	}
+
+	close(writer.block)
+	repository.Close(context.Background())
+}
+
+func TestBufferedEventRepositoryCountsFailedBatches(t *testing.T) {
+	writer := &MockEventBatchWriter{err: errors.New("database unavailable")}
+	repository := NewBufferedEventRepository(writer, buildBufferConfig(100, 1000, time.Hour, 0))
+	repository.events.retryDelay = time.Millisecond
+
+	repository.Create(&Event{Name: "view"})
+	repository.Create(&Event{Name: "view"})
+	repository.Close(context.Background())
+
+	if stats := repository.Stats(); stats.Failed != 2 {
+		t.Errorf("Expected 2 failed events but got %d", stats.Failed)
+	}
+}
+
+func TestBufferedEventRepositoryQueuesRobotEventsSeparately(t *testing.T) {
+	writer := &MockEventBatchWriter{}
+	repository := NewBufferedEventRepository(writer, buildBufferConfig(100, 1000, time.Hour, 0))
+
+	repository.Create(&Event{Name: "view"})
+	repository.CreateRobot(&RobotEvent{Name: "view", Pattern: "bot"})
+	repository.CreateRobot(&RobotEvent{Name: "download", Pattern: "crawl"})
+
+	if err := repository.Close(context.Background()); err != nil {
+		t.Fatalf("Close should not return an error but got %v", err)
+	}
+
+	if len(writer.robots) != 2 {
+		t.Errorf("Expected 2 robot events written but got %d", len(writer.robots))
+	}
+
+	if stats := repository.Stats(); stats.Flushed != 1 {
+		t.Errorf("Expected 1 flushed event but got %d", stats.Flushed)
+	}
+
+	if stats := repository.RobotStats(); stats.Flushed != 2 {
+		t.Errorf("Expected 2 flushed robot events but got %d", stats.Flushed)
+	}
+}
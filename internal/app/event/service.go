@@ -1,41 +1,105 @@
 package event
 
 import (
-	"encoding/json"
 	"errors"
-	"fmt"
-	"io"
-	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
 	"github.com/datacite/keeshond/internal/app"
+	"github.com/datacite/keeshond/internal/app/geoip"
+	"github.com/datacite/keeshond/internal/app/metrics"
+	"github.com/datacite/keeshond/internal/app/pid"
 	"github.com/datacite/keeshond/internal/app/session"
 )
 
 type EventService struct {
 	eventRepository EventRepositoryReader
 	sessionService  *session.SessionService
+	validator       *doiValidator
+	validators      map[pid.Type]PidValidator
+	locator         geoip.Locator
+	settings        RepositorySettingsFunc
 	config          *app.Config
 }
 
+// PidValidator checks that an identifier of one type exists and belongs to
+// the url it was viewed at. ErrValidationUnavailable is returned when it can
+// not be checked right now.
+type PidValidator interface {
+	Validate(identifier pid.PID, url string) error
+}
+
 type EventRequest struct {
-	Name      string `json:"name"`
-	RepoId    string `json:"repoId"`
-	Url       string `json:"url"`
-	Useragent string `json:"useragent"`
-	ClientIp  string `json:"clientIp"`
-	Pid       string `json:"pid"`
+	Name         string `json:"name"`
+	RepoId       string `json:"repoId"`
+	Url          string `json:"url"`
+	Useragent    string `json:"useragent"`
+	ClientIp     string `json:"clientIp"`
+	Pid          string `json:"pid"`
+	AccessMethod string `json:"accessMethod"` // Regular when empty
 }
 
+var ErrInvalidAccessMethod = errors.New("access method is not valid, expected regular or machine")
+
+var ErrDomainNotAllowed = errors.New("url is not on an allowed domain of the repository")
+
+// RepositorySettings change how the events of a registered repository are
+// checked, validation settings that are nil use the configured default.
+type RepositorySettings struct {
+	AllowedDomains       []string // Any domain is allowed when empty
+	ValidateDoiExistence *bool
+	ValidateDoiUrl       *bool
+}
+
+// RepositorySettingsFunc returns the settings of a repository, ok is false
+// when the repository is not registered.
+type RepositorySettingsFunc func(repoId string) (settings RepositorySettings, ok bool)
+
 // NewEventService creates a new event service
 func NewEventService(repository EventRepositoryReader, sessionService *session.SessionService, config *app.Config) *EventService {
-	return &EventService{
+	service := &EventService{
 		eventRepository: repository,
 		sessionService:  sessionService,
+		validator:       newDoiValidator(config),
+		validators:      make(map[pid.Type]PidValidator),
 		config:          config,
 	}
+
+	if config.Validate.DoiExistence || config.Validate.DoiUrl {
+		service.RegisterValidator(pid.DOI, service.validator)
+	}
+
+	return service
+}
+
+// CountEvent counts an event request by its outcome. Requests are only
+// counted by repository when the repository is registered, others are counted
+// as unknown so a request body can not create any number of series.
+func (service *EventService) CountEvent(repoId string, outcome string) {
+	if _, ok := service.repositorySettings(repoId); repoId == "" || !ok {
+		repoId = metrics.UnknownRepo
+	}
+
+	metrics.Events.WithLabelValues(repoId, outcome).Inc()
+}
+
+// RegisterValidator sets the validator for identifiers of the type, events
+// with identifiers of a type without a validator are accepted as they are.
+func (service *EventService) RegisterValidator(pidType pid.Type, validator PidValidator) {
+	service.validators[pidType] = validator
+}
+
+// SetRepositorySettings enables per repository settings, events of
+// repositories without settings are checked with the configured defaults.
+func (service *EventService) SetRepositorySettings(settings RepositorySettingsFunc) {
+	service.settings = settings
+}
+
+// SetLocator enables looking up the country of each event from the client ip,
+// only the country is stored.
+func (service *EventService) SetLocator(locator geoip.Locator) {
+	service.locator = locator
 }
 
 func (service *EventService) CreateEvent(eventRequest *EventRequest) (Event, error) {
@@ -43,14 +107,23 @@ func (service *EventService) CreateEvent(eventRequest *EventRequest) (Event, err
 
 	now := time.Now()
 
+	// Canonicalise the pid first so every form of it is counted together
+	identifier, err := pid.Parse(eventRequest.Pid)
+	if err != nil {
+		service.CountEvent(eventRequest.RepoId, metrics.OutcomeInvalid)
+		return Event{}, err
+	}
+
 	salt, err := service.sessionService.GetSalt()
 	if err != nil {
+		service.CountEvent(eventRequest.RepoId, metrics.OutcomeError)
 		return Event{}, err
 	}
 
 	// Get hostname from the url
 	url, err := url.Parse(eventRequest.Url)
 	if err != nil {
+		service.CountEvent(eventRequest.RepoId, metrics.OutcomeInvalid)
 		return Event{}, err
 	}
 	hostDomain := strings.TrimPrefix(url.Hostname(), "www.")
@@ -81,9 +154,52 @@ func (service *EventService) CreateEvent(eventRequest *EventRequest) (Event, err
 		Url:       eventRequest.Url,
 		Useragent: eventRequest.Useragent,
 		ClientIp:  eventRequest.ClientIp,
-		Pid:       eventRequest.Pid,
+		Pid:       identifier.Value,
+		PidType:   string(identifier.Type),
+
+		AccessMethod: AccessRegular,
 	}
+
+	if eventRequest.AccessMethod == AccessMachine {
+		event.AccessMethod = AccessMachine
+	}
+
+	if service.locator != nil {
+		event.Country = service.locator.Country(eventRequest.ClientIp)
+	}
+
+	// Left for the background validator to confirm or quarantine
+	if service.config.Validate.Async && shouldValidate(service, eventRequest) {
+		event.ValidationStatus = ValidationPending
+	}
+
 	err = service.eventRepository.Create(&event)
+
+	switch {
+	case err == nil:
+		service.CountEvent(eventRequest.RepoId, metrics.OutcomeAccepted)
+	case errors.Is(err, ErrEventBufferFull):
+		service.CountEvent(eventRequest.RepoId, metrics.OutcomeBufferFull)
+	default:
+		service.CountEvent(eventRequest.RepoId, metrics.OutcomeError)
+	}
+
+	return event, err
+}
+
+// CreateRobotEvent records a request that was filtered out by the robots list,
+// nothing that could identify the user is kept.
+func (service *EventService) CreateRobotEvent(eventRequest *EventRequest, pattern string) (RobotEvent, error) {
+	event := RobotEvent{
+		Timestamp: time.Now(),
+		Name:      eventRequest.Name,
+		RepoId:    eventRequest.RepoId,
+		Url:       eventRequest.Url,
+		Pid:       pid.Normalize(eventRequest.Pid),
+		Pattern:   pattern,
+	}
+
+	err := service.eventRepository.CreateRobot(&event)
 	return event, err
 }
 
@@ -93,34 +209,61 @@ func (service *EventService) CreateRaw(event Event) (Event, error) {
 	return event, err
 }
 
-func (service *EventService) Validate(eventRequest *EventRequest) error {
-	var err error
-
-	if !shouldValidate(service, eventRequest) {
+// Validate checks the identifier of the event with the validator for its
+// type, DOIs are checked with DataCite. With asynchronous
+// validation nothing is checked here, the event is stored as pending instead.
+func (service *EventService) Validate(eventRequest *EventRequest) (err error) {
+	// Malformed DOIs are rejected whether or not they would be looked up
+	if _, err := pid.Parse(eventRequest.Pid); err != nil {
+		service.CountEvent(eventRequest.RepoId, metrics.OutcomeInvalid)
 		return err
 	}
 
-	resp, err := getDoi(eventRequest.Pid, service.config.DataCite.Url)
+	switch eventRequest.AccessMethod {
+	case "", AccessRegular, AccessMachine:
+	default:
+		service.CountEvent(eventRequest.RepoId, metrics.OutcomeInvalid)
+		return ErrInvalidAccessMethod
+	}
 
-	if err != nil {
-		return fmt.Errorf("failed to make request: %v", err)
+	if settings, ok := service.repositorySettings(eventRequest.RepoId); ok && !allowedDomain(eventRequest.Url, settings.AllowedDomains) {
+		service.CountEvent(eventRequest.RepoId, metrics.OutcomeInvalid)
+		return ErrDomainNotAllowed
 	}
 
-	defer resp.Body.Close()
+	if !shouldValidate(service, eventRequest) || service.config.Validate.Async {
+		return nil
+	}
+
+	defer func(start time.Time) {
+		metrics.ObserveSince(metrics.ValidationDuration, start, metrics.Outcome(err))
+		if err != nil {
+			service.CountEvent(eventRequest.RepoId, metrics.OutcomeInvalid)
+		}
+	}(time.Now())
 
-	if service.config.Validate.DoiExistence {
-		err = checkDoiExistence(resp)
+	err = service.validateRequest(eventRequest)
+
+	// Accept events while DataCite is unavailable when configured to
+	if service.config.Validate.FailOpen && errors.Is(err, ErrValidationUnavailable) {
+		return nil
 	}
 
+	return err
+}
+
+func (service *EventService) validateRequest(eventRequest *EventRequest) error {
+	identifier, err := pid.Parse(eventRequest.Pid)
 	if err != nil {
 		return err
 	}
 
-	if service.config.Validate.DoiUrl {
-		err = checkDoiUrl(resp, eventRequest.Url)
+	validator, ok := service.validatorFor(eventRequest.RepoId, identifier.Type)
+	if !ok {
+		return nil
 	}
 
-	return err
+	return validator.Validate(identifier, eventRequest.Url)
 }
 
 func shouldValidate(service *EventService, eventRequest *EventRequest) bool {
@@ -128,45 +271,63 @@ func shouldValidate(service *EventService, eventRequest *EventRequest) bool {
 		return false
 	}
 
-	return service.config.Validate.DoiExistence || service.config.Validate.DoiUrl
+	_, ok := service.validatorFor(eventRequest.RepoId, pid.Detect(eventRequest.Pid))
+	return ok
 }
 
-func getDoi(doi string, dataciteApiUrl string) (*http.Response, error) {
-	apiUrl := fmt.Sprintf("%s/dois/%s/get-url", dataciteApiUrl, doi)
-
-	return http.Get(apiUrl)
+func (service *EventService) repositorySettings(repoId string) (RepositorySettings, bool) {
+	if service.settings == nil {
+		return RepositorySettings{}, false
+	}
+	return service.settings(repoId)
 }
 
-func checkDoiExistence(resp *http.Response) error {
-	if resp.StatusCode == 404 {
-		return errors.New("this DOI doesn't exist in DataCite")
+// validatorFor returns the validator for identifiers of the type, DOIs of a
+// repository with its own validation settings are checked with those instead.
+func (service *EventService) validatorFor(repoId string, pidType pid.Type) (PidValidator, bool) {
+	settings, ok := service.repositorySettings(repoId)
+	if pidType != pid.DOI || !ok || (settings.ValidateDoiExistence == nil && settings.ValidateDoiUrl == nil) {
+		validator, ok := service.validators[pidType]
+		return validator, ok
 	}
 
-	return nil
-}
-
-func checkDoiUrl(resp *http.Response, url string) error {
-	body, err := io.ReadAll(resp.Body)
+	checkExists := service.config.Validate.DoiExistence
+	if settings.ValidateDoiExistence != nil {
+		checkExists = *settings.ValidateDoiExistence
+	}
 
-	if err != nil {
-		return fmt.Errorf("failed to read body: %v", err)
+	checkUrl := service.config.Validate.DoiUrl
+	if settings.ValidateDoiUrl != nil {
+		checkUrl = *settings.ValidateDoiUrl
 	}
 
-	var result struct {
-		Url string `json:"url"`
+	if !checkExists && !checkUrl {
+		return nil, false
 	}
 
-	err = json.Unmarshal(body, &result)
+	return service.validator.withChecks(checkExists, checkUrl), true
+}
+
+// allowedDomain reports whether the host of the url is one of the domains or
+// a subdomain of one, www. is ignored.
+func allowedDomain(rawUrl string, domains []string) bool {
+	if len(domains) == 0 {
+		return true
+	}
 
+	parsedUrl, err := url.Parse(rawUrl)
 	if err != nil {
-		return errors.New("can not unmarshal JSON")
+		return false
 	}
+	host := strings.TrimPrefix(strings.ToLower(parsedUrl.Hostname()), "www.")
 
-	if !validateDoiUrl(result.Url, url) {
-		return errors.New("this DOI doesn't match this URL")
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
 	}
 
-	return nil
+	return false
 }
 
 func validateDoiUrl(doiUrl string, urlCompare string) bool {
@@ -176,7 +337,10 @@ func validateDoiUrl(doiUrl string, urlCompare string) bool {
 
 // Function to strip the scheme from a URL
 func stripScheme(urlToStrip string) string {
-	parsedUrl, _ := url.ParseRequestURI(urlToStrip)
+	parsedUrl, err := url.ParseRequestURI(urlToStrip)
+	if err != nil {
+		return urlToStrip
+	}
 	parsedUrl.Scheme = ""
 	// Strip trailing slash from path
 	parsedUrl.Path = strings.TrimSuffix(parsedUrl.Path, "/")
@@ -201,6 +365,9 @@ func CreateMockEvent(metricName string, repoId string, doi string, userId uint64
 		SessionID: sessionId,
 		Url:       url,
 		Pid:       doi,
+		PidType:   string(pid.DOI),
 		Timestamp: timestamp,
+
+		AccessMethod: AccessRegular,
 	}
 }
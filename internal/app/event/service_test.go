@@ -5,31 +5,17 @@ import (
 	"testing"
 
 	"github.com/datacite/keeshond/internal/app"
+	"github.com/datacite/keeshond/internal/app/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func buildEventService(dataCiteUrl string, validateDoiExistence bool, validateDoiUrl bool) *EventService {
-	config := &app.Config{
-		DataCite: struct {
-			Url          string
-			JWT          string
-			JWTPublicKey string
-		}{
-			Url: dataCiteUrl,
-		},
-		Validate: struct {
-			DoiExistence bool
-			DoiUrl       bool
-		}{
-			DoiExistence: validateDoiExistence,
-			DoiUrl:       validateDoiUrl,
-		},
-	}
-
-	eventService := &EventService{
-		config: config,
-	}
-
-	return eventService
+	config := &app.Config{}
+	config.DataCite.Url = dataCiteUrl
+	config.Validate.DoiExistence = validateDoiExistence
+	config.Validate.DoiUrl = validateDoiUrl
+
+	return NewEventService(nil, nil, config)
 }
 
 func TestValidateDoiUrl(t *testing.T) {
@@ -185,3 +171,117 @@ func TestValidateFailureWhenCannotAccessDataCiteApi(t *testing.T) {
 		t.Errorf("Validate should return an error")
 	}
 }
+
+// Locator with a fixed country for each ip
+type fakeLocator map[string]string
+
+func (locator fakeLocator) Country(ip string) string {
+	return locator[ip]
+}
+
+func TestCreateEventLooksUpCountry(t *testing.T) {
+	service := buildBufferedEventService(t, buildValidationConfig("http://127.0.0.1:0"))
+
+	request := viewRequest("10.5072/country")
+	request.Name = "download"
+	request.ClientIp = "81.2.69.160"
+
+	// Without a locator no country is stored
+	event, err := service.CreateEvent(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Country != "" {
+		t.Errorf("Event should not have a country without a locator but got %s", event.Country)
+	}
+
+	service.SetLocator(fakeLocator{"81.2.69.160": "GB", "2001:218:85a3::1": "JP"})
+
+	tests := map[string]string{
+		"81.2.69.160":      "GB",
+		"2001:218:85a3::1": "JP",
+		"10.0.0.1":         "",
+	}
+
+	for clientIp, want := range tests {
+		request.ClientIp = clientIp
+		event, err := service.CreateEvent(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.Country != want {
+			t.Errorf("Event from %s should have country %q but got %q", clientIp, want, event.Country)
+		}
+	}
+}
+
+func TestValidateFailureWithUnknownAccessMethod(t *testing.T) {
+	eventService := buildEventService("https://api.stage.datacite.org", false, false)
+
+	eventRequest := &EventRequest{
+		Name:         "view",
+		Pid:          "10.70102/mdc.jeopardy",
+		AccessMethod: "tdm",
+	}
+
+	if err := eventService.Validate(eventRequest); err != ErrInvalidAccessMethod {
+		t.Errorf("Validate should return %v but got %v", ErrInvalidAccessMethod, err)
+	}
+}
+
+func TestCreateEventAccessMethod(t *testing.T) {
+	service := buildBufferedEventService(t, buildValidationConfig("http://127.0.0.1:0"))
+
+	request := viewRequest("10.5072/access")
+	request.Name = "download"
+
+	tests := []struct {
+		hint string
+		want string
+	}{
+		{"", AccessRegular},
+		{AccessRegular, AccessRegular},
+		{AccessMachine, AccessMachine},
+	}
+
+	for _, test := range tests {
+		request.AccessMethod = test.hint
+		event, err := service.CreateEvent(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.AccessMethod != test.want {
+			t.Errorf("Event with access method %q should be %s but got %s", test.hint, test.want, event.AccessMethod)
+		}
+	}
+}
+
+func TestCountEventLabelsUnregisteredRepositoriesAsUnknown(t *testing.T) {
+	eventService := buildEventService("https://api.stage.datacite.org", false, false)
+	eventService.SetRepositorySettings(func(repoId string) (RepositorySettings, bool) {
+		return RepositorySettings{}, repoId == "registered.example"
+	})
+
+	registered := testutil.ToFloat64(metrics.Events.WithLabelValues("registered.example", metrics.OutcomeInvalid))
+	unknown := testutil.ToFloat64(metrics.Events.WithLabelValues(metrics.UnknownRepo, metrics.OutcomeInvalid))
+	unknownAccepted := testutil.ToFloat64(metrics.Events.WithLabelValues(metrics.UnknownRepo, metrics.OutcomeAccepted))
+
+	eventService.CountEvent("registered.example", metrics.OutcomeInvalid)
+	eventService.CountEvent("random.example", metrics.OutcomeInvalid)
+	eventService.CountEvent("", metrics.OutcomeInvalid)
+	eventService.CountEvent("unregistered.example", metrics.OutcomeAccepted)
+
+	if count := testutil.ToFloat64(metrics.Events.WithLabelValues("registered.example", metrics.OutcomeInvalid)) - registered; count != 1 {
+		t.Errorf("Registered repository should be counted by repo id but got %v", count)
+	}
+	if count := testutil.ToFloat64(metrics.Events.WithLabelValues(metrics.UnknownRepo, metrics.OutcomeInvalid)) - unknown; count != 2 {
+		t.Errorf("Unregistered repositories should be counted as unknown but got %v", count)
+	}
+	// Accepted events of unregistered repositories are unknown too
+	if count := testutil.ToFloat64(metrics.Events.WithLabelValues(metrics.UnknownRepo, metrics.OutcomeAccepted)) - unknownAccepted; count != 1 {
+		t.Errorf("Accepted events of unregistered repositories should be counted as unknown but got %v", count)
+	}
+	if count := testutil.ToFloat64(metrics.Events.WithLabelValues("unregistered.example", metrics.OutcomeAccepted)); count != 0 {
+		t.Errorf("Unregistered repository should have no series but got %v", count)
+	}
+}
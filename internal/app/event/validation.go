@@ -0,0 +1,401 @@
+package event
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/datacite/keeshond/internal/app"
+	"github.com/datacite/keeshond/internal/app/pid"
+)
+
+var ErrValidationUnavailable = errors.New("DOI validation is unavailable, the DataCite API could not be reached")
+
+// What the DataCite API knows about a DOI
+type doiRecord struct {
+	Exists bool
+	Url    string
+}
+
+// doiCache is a least recently used cache of DOI records. Records for DOIs
+// that do not exist expire sooner so new DOIs are picked up quickly.
+type doiCache struct {
+	mu          sync.Mutex
+	size        int
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+	entries     map[string]*list.Element
+	order       *list.List // Most recently used at the front
+	now         func() time.Time
+}
+
+type doiCacheEntry struct {
+	doi     string
+	record  doiRecord
+	expires time.Time
+}
+
+func newDoiCache(size int, positiveTTL time.Duration, negativeTTL time.Duration) *doiCache {
+	return &doiCache{
+		size:        size,
+		positiveTTL: positiveTTL,
+		negativeTTL: negativeTTL,
+		entries:     make(map[string]*list.Element),
+		order:       list.New(),
+		now:         time.Now,
+	}
+}
+
+func (cache *doiCache) get(doi string) (doiRecord, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	element, ok := cache.entries[doi]
+	if !ok {
+		return doiRecord{}, false
+	}
+
+	entry := element.Value.(*doiCacheEntry)
+	if cache.now().After(entry.expires) {
+		cache.order.Remove(element)
+		delete(cache.entries, doi)
+		return doiRecord{}, false
+	}
+
+	cache.order.MoveToFront(element)
+	return entry.record, true
+}
+
+func (cache *doiCache) add(doi string, record doiRecord) {
+	ttl := cache.positiveTTL
+	if !record.Exists {
+		ttl = cache.negativeTTL
+	}
+
+	// A zero size or TTL disables caching
+	if cache.size <= 0 || ttl <= 0 {
+		return
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	expires := cache.now().Add(ttl)
+
+	if element, ok := cache.entries[doi]; ok {
+		element.Value = &doiCacheEntry{doi: doi, record: record, expires: expires}
+		cache.order.MoveToFront(element)
+		return
+	}
+
+	cache.entries[doi] = cache.order.PushFront(&doiCacheEntry{doi: doi, record: record, expires: expires})
+
+	for cache.order.Len() > cache.size {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*doiCacheEntry).doi)
+	}
+}
+
+func (cache *doiCache) len() int {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.order.Len()
+}
+
+// circuitBreaker stops calls to the DataCite API after a run of failures. Once
+// the cooldown has passed a single call is let through to test it again.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	probing   bool
+	now       func() time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// allow reports if a call may be made
+func (breaker *circuitBreaker) allow() bool {
+	// A zero threshold disables the breaker
+	if breaker.threshold <= 0 {
+		return true
+	}
+
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	if breaker.failures < breaker.threshold {
+		return true
+	}
+
+	// Open, let one call through after the cooldown
+	if breaker.probing || breaker.now().Before(breaker.openUntil) {
+		return false
+	}
+
+	breaker.probing = true
+	return true
+}
+
+func (breaker *circuitBreaker) record(err error) {
+	if breaker.threshold <= 0 {
+		return
+	}
+
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	breaker.probing = false
+
+	if err == nil {
+		breaker.failures = 0
+		return
+	}
+
+	breaker.failures++
+	if breaker.failures >= breaker.threshold {
+		breaker.openUntil = breaker.now().Add(breaker.cooldown)
+	}
+}
+
+// doiValidator looks up DOIs in the DataCite API with caching, bounded
+// retries and a circuit breaker so a slow or failing API does not stall the
+// tracker.
+type doiValidator struct {
+	apiUrl      string
+	client      *http.Client
+	retries     int
+	retryDelay  time.Duration
+	checkExists bool
+	checkUrl    bool
+	cache       *doiCache
+	breaker     *circuitBreaker
+}
+
+func newDoiValidator(config *app.Config) *doiValidator {
+	return &doiValidator{
+		apiUrl:      config.DataCite.Url,
+		client:      &http.Client{Timeout: config.Validate.Timeout},
+		retries:     config.Validate.Retries,
+		retryDelay:  100 * time.Millisecond,
+		checkExists: config.Validate.DoiExistence,
+		checkUrl:    config.Validate.DoiUrl,
+		cache:       newDoiCache(config.Validate.CacheSize, config.Validate.CacheTTL, config.Validate.NegativeCacheTTL),
+		breaker:     newCircuitBreaker(config.Validate.BreakerThreshold, config.Validate.BreakerCooldown),
+	}
+}
+
+// withChecks returns a validator making the given checks, it shares the cache
+// and circuit breaker with this one.
+func (validator *doiValidator) withChecks(checkExists bool, checkUrl bool) *doiValidator {
+	copy := *validator
+	copy.checkExists = checkExists
+	copy.checkUrl = checkUrl
+	return &copy
+}
+
+// Validate checks the DOI exists in DataCite and is registered with the url
+func (validator *doiValidator) Validate(identifier pid.PID, url string) error {
+	record, err := validator.lookup(identifier.Value)
+	if err != nil {
+		return err
+	}
+
+	if validator.checkExists && !record.Exists {
+		return errors.New("this DOI doesn't exist in DataCite")
+	}
+
+	if validator.checkUrl && !validateDoiUrl(record.Url, url) {
+		return errors.New("this DOI doesn't match this URL")
+	}
+
+	return nil
+}
+
+// lookup returns what DataCite knows about the DOI, from the cache when
+// possible. ErrValidationUnavailable is returned when the API can not answer.
+func (validator *doiValidator) lookup(doi string) (doiRecord, error) {
+	if record, ok := validator.cache.get(doi); ok {
+		return record, nil
+	}
+
+	if !validator.breaker.allow() {
+		return doiRecord{}, ErrValidationUnavailable
+	}
+
+	var record doiRecord
+	var err error
+
+	for attempt := 0; attempt <= validator.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * validator.retryDelay)
+		}
+
+		var retry bool
+		record, retry, err = validator.fetch(doi)
+		if !retry {
+			break
+		}
+	}
+
+	validator.breaker.record(err)
+
+	if err != nil {
+		return doiRecord{}, fmt.Errorf("%w: %v", ErrValidationUnavailable, err)
+	}
+
+	validator.cache.add(doi, record)
+
+	return record, nil
+}
+
+// fetch makes a single request for the DOI, it reports whether a failure is
+// worth retrying.
+func (validator *doiValidator) fetch(doi string) (doiRecord, bool, error) {
+	resp, err := validator.client.Get(fmt.Sprintf("%s/dois/%s/get-url", validator.apiUrl, doi))
+	if err != nil {
+		return doiRecord{}, true, err
+	}
+
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return doiRecord{Exists: false}, false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return doiRecord{}, true, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	case resp.StatusCode != http.StatusOK:
+		// Only a missing DOI fails the existence check, without a url the
+		// url check still fails
+		return doiRecord{Exists: true}, false, nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return doiRecord{}, true, fmt.Errorf("failed to read body: %v", err)
+	}
+
+	var result struct {
+		Url string `json:"url"`
+	}
+
+	// Without a url the url check fails
+	if err := json.Unmarshal(body, &result); err != nil {
+		return doiRecord{Exists: true}, false, nil
+	}
+
+	return doiRecord{Exists: true, Url: result.Url}, false, nil
+}
+
+// PendingEventRepository is implemented by repositories holding events that
+// wait for asynchronous validation
+type PendingEventRepository interface {
+	Pending(limit int) ([]PendingValidation, error)
+	SetValidationStatus(pending []PendingValidation, status uint8) error
+}
+
+// AsyncValidator validates events that were accepted without waiting for
+// validation. Each cycle it confirms or quarantines a batch of pending pid and
+// url pairs, those that can not be checked while DataCite is unavailable stay
+// pending for the next cycle. Pairs pending for longer than the maximum age
+// are quarantined, as days of a repository are not rolled up while any of its
+// events are pending.
+type AsyncValidator struct {
+	repository PendingEventRepository
+	service    *EventService
+	interval   time.Duration
+	batchSize  int
+	maxAge     time.Duration
+	now        func() time.Time
+}
+
+func NewAsyncValidator(repository PendingEventRepository, service *EventService, config *app.Config) *AsyncValidator {
+	interval := config.Validate.AsyncInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	return &AsyncValidator{
+		repository: repository,
+		service:    service,
+		interval:   interval,
+		batchSize:  config.Validate.AsyncBatchSize,
+		maxAge:     config.Validate.PendingMaxAge,
+		now:        time.Now,
+	}
+}
+
+// Run validates pending events every interval until the context is done
+func (validator *AsyncValidator) Run(ctx context.Context) {
+	ticker := time.NewTicker(validator.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, _, err := validator.ValidatePending(); err != nil {
+				log.Printf("Asynchronous validation failed: %v", err)
+			}
+		}
+	}
+}
+
+// ValidatePending validates one batch of pending events and returns how many
+// pid and url pairs were confirmed and quarantined.
+func (validator *AsyncValidator) ValidatePending() (int, int, error) {
+	pending, err := validator.repository.Pending(validator.batchSize)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var confirmed, quarantined []PendingValidation
+
+	for _, p := range pending {
+		err := validator.service.validateRequest(&EventRequest{
+			Name:   "view",
+			RepoId: p.RepoId,
+			Pid:    p.Pid,
+			Url:    p.Url,
+		})
+
+		switch {
+		case err == nil:
+			confirmed = append(confirmed, p)
+		case errors.Is(err, ErrValidationUnavailable) && validator.maxAge > 0 && validator.now().Sub(p.Oldest) > validator.maxAge:
+			log.Printf("Quarantining %s of %s, pending validation since %s", p.Pid, p.RepoId, p.Oldest.Format(time.RFC3339))
+			quarantined = append(quarantined, p)
+		case errors.Is(err, ErrValidationUnavailable):
+			// Try again next cycle
+		default:
+			quarantined = append(quarantined, p)
+		}
+	}
+
+	if err := validator.repository.SetValidationStatus(confirmed, ValidationConfirmed); err != nil {
+		return 0, 0, err
+	}
+
+	if err := validator.repository.SetValidationStatus(quarantined, ValidationQuarantined); err != nil {
+		return len(confirmed), 0, err
+	}
+
+	return len(confirmed), len(quarantined), nil
+}
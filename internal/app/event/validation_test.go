@@ -0,0 +1,537 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/datacite/keeshond/internal/app"
+	"github.com/datacite/keeshond/internal/app/pid"
+	"github.com/datacite/keeshond/internal/app/session"
+)
+
+// Fake DataCite API, DOIs ending in .missing do not exist and the status can
+// be forced to simulate an outage.
+type fakeDataCite struct {
+	server   *httptest.Server
+	requests atomic.Int64
+	status   atomic.Int64
+	failures atomic.Int64 // Number of requests to fail before answering
+	delay    time.Duration
+}
+
+func newFakeDataCite(t *testing.T) *fakeDataCite {
+	fake := &fakeDataCite{}
+	fake.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fake.requests.Add(1)
+		time.Sleep(fake.delay)
+
+		if fake.failures.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		if status := fake.status.Load(); status != 0 {
+			w.WriteHeader(int(status))
+			return
+		}
+
+		doi := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/dois/"), "/get-url")
+		if strings.HasSuffix(doi, ".missing") {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Write([]byte(`{"url": "https://example.org/datasets/` + doi + `"}`))
+	}))
+	t.Cleanup(fake.server.Close)
+
+	return fake
+}
+
+func buildValidationConfig(dataCiteUrl string) *app.Config {
+	config := &app.Config{}
+	config.DataCite.Url = dataCiteUrl
+	config.Validate.DoiExistence = true
+	config.Validate.DoiUrl = true
+	config.Validate.Timeout = time.Second
+	config.Validate.CacheSize = 100
+	config.Validate.CacheTTL = time.Hour
+	config.Validate.NegativeCacheTTL = time.Minute
+
+	return config
+}
+
+func viewRequest(doi string) *EventRequest {
+	return &EventRequest{
+		Name: "view",
+		Pid:  doi,
+		Url:  "https://example.org/datasets/" + doi,
+	}
+}
+
+// buildBufferedEventService returns a service with a fixed salt whose events
+// are buffered for the rest of the test
+func buildBufferedEventService(t *testing.T, config *app.Config) *EventService {
+	repository := NewBufferedEventRepository(&MockEventBatchWriter{}, buildBufferConfig(10, 10, time.Hour, 0))
+	t.Cleanup(func() { repository.Close(context.Background()) })
+
+	return NewEventService(repository, session.NewSessionService(fixedSaltRepository{}, config), config)
+}
+
+func TestValidateCachesResults(t *testing.T) {
+	fake := newFakeDataCite(t)
+	service := NewEventService(nil, nil, buildValidationConfig(fake.server.URL))
+
+	for i := 0; i < 3; i++ {
+		if err := service.Validate(viewRequest("10.5072/cached")); err != nil {
+			t.Fatalf("Validate should return nil but got %v", err)
+		}
+	}
+
+	if fake.requests.Load() != 1 {
+		t.Errorf("Expected 1 request to DataCite but got %d", fake.requests.Load())
+	}
+
+	// The url check uses the cached record too
+	request := viewRequest("10.5072/cached")
+	request.Url = "https://example.org/elsewhere"
+	if err := service.Validate(request); err == nil || err.Error() != "this DOI doesn't match this URL" {
+		t.Errorf("Validate should fail the url check but got %v", err)
+	}
+}
+
+func TestValidateNegativeResultsExpireSooner(t *testing.T) {
+	fake := newFakeDataCite(t)
+	service := NewEventService(nil, nil, buildValidationConfig(fake.server.URL))
+
+	now := time.Now()
+	service.validator.cache.now = func() time.Time { return now }
+
+	service.Validate(viewRequest("10.5072/found"))
+	err := service.Validate(viewRequest("10.5072/new.missing"))
+
+	if err == nil || err.Error() != "this DOI doesn't exist in DataCite" {
+		t.Errorf("Validate should fail the existence check but got %v", err)
+	}
+
+	// Past the negative TTL but within the positive TTL
+	now = now.Add(2 * time.Minute)
+	fake.requests.Store(0)
+
+	service.Validate(viewRequest("10.5072/found"))
+	service.Validate(viewRequest("10.5072/new.missing"))
+
+	if fake.requests.Load() != 1 {
+		t.Errorf("Only the missing DOI should be looked up again but got %d requests", fake.requests.Load())
+	}
+}
+
+func TestDoiCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newDoiCache(2, time.Hour, time.Hour)
+
+	cache.add("a", doiRecord{Exists: true})
+	cache.add("b", doiRecord{Exists: true})
+	cache.get("a")
+	cache.add("c", doiRecord{Exists: true})
+
+	if _, ok := cache.get("b"); ok {
+		t.Errorf("Least recently used entry should be evicted")
+	}
+
+	if _, ok := cache.get("a"); !ok {
+		t.Errorf("Recently used entry should be kept")
+	}
+
+	if cache.len() != 2 {
+		t.Errorf("Cache should hold 2 entries but has %d", cache.len())
+	}
+}
+
+func TestValidateRetriesServerErrors(t *testing.T) {
+	fake := newFakeDataCite(t)
+	fake.failures.Store(1)
+
+	config := buildValidationConfig(fake.server.URL)
+	config.Validate.Retries = 2
+	service := NewEventService(nil, nil, config)
+	service.validator.retryDelay = time.Millisecond
+
+	if err := service.Validate(viewRequest("10.5072/retried")); err != nil {
+		t.Errorf("Validate should succeed after a retry but got %v", err)
+	}
+
+	if fake.requests.Load() != 2 {
+		t.Errorf("Expected 2 requests but got %d", fake.requests.Load())
+	}
+}
+
+func TestValidateTimesOutSlowApi(t *testing.T) {
+	fake := newFakeDataCite(t)
+	fake.delay = 200 * time.Millisecond
+
+	config := buildValidationConfig(fake.server.URL)
+	config.Validate.Timeout = 20 * time.Millisecond
+	service := NewEventService(nil, nil, config)
+
+	start := time.Now()
+	err := service.Validate(viewRequest("10.5072/slow"))
+
+	if !errors.Is(err, ErrValidationUnavailable) {
+		t.Errorf("Validate should return ErrValidationUnavailable but got %v", err)
+	}
+
+	if time.Since(start) >= fake.delay {
+		t.Errorf("Validate should not wait for the slow API")
+	}
+}
+
+func TestValidateCircuitBreaker(t *testing.T) {
+	tests := []struct {
+		name     string
+		failOpen bool
+	}{
+		{"fail closed", false},
+		{"fail open", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeDataCite(t)
+			fake.status.Store(http.StatusServiceUnavailable)
+
+			config := buildValidationConfig(fake.server.URL)
+			config.Validate.BreakerThreshold = 2
+			config.Validate.BreakerCooldown = time.Minute
+			config.Validate.FailOpen = test.failOpen
+			service := NewEventService(nil, nil, config)
+
+			now := time.Now()
+			service.validator.breaker.now = func() time.Time { return now }
+
+			for i := 0; i < 5; i++ {
+				err := service.Validate(viewRequest("10.5072/outage"))
+
+				if test.failOpen && err != nil {
+					t.Errorf("Validate should accept events while DataCite is down but got %v", err)
+				}
+				if !test.failOpen && !errors.Is(err, ErrValidationUnavailable) {
+					t.Errorf("Validate should reject events while DataCite is down but got %v", err)
+				}
+			}
+
+			// The breaker opened after 2 failures
+			if fake.requests.Load() != 2 {
+				t.Errorf("Expected 2 requests before the breaker opened but got %d", fake.requests.Load())
+			}
+
+			// After the cooldown a request is let through and closes the breaker
+			fake.status.Store(0)
+			now = now.Add(2 * time.Minute)
+
+			if err := service.Validate(viewRequest("10.5072/recovered")); err != nil {
+				t.Errorf("Validate should succeed once DataCite recovers but got %v", err)
+			}
+
+			if !service.validator.breaker.allow() {
+				t.Errorf("Breaker should be closed after a successful request")
+			}
+		})
+	}
+}
+
+// Pending events held in memory
+type MockPendingEventRepository struct {
+	pending []PendingValidation
+	status  map[string]uint8
+}
+
+func (m *MockPendingEventRepository) Pending(limit int) ([]PendingValidation, error) {
+	var pending []PendingValidation
+	for _, p := range m.pending {
+		if _, done := m.status[p.Pid]; !done && len(pending) < limit {
+			pending = append(pending, p)
+		}
+	}
+	return pending, nil
+}
+
+func (m *MockPendingEventRepository) SetValidationStatus(pending []PendingValidation, status uint8) error {
+	for _, p := range pending {
+		m.status[p.Pid] = status
+	}
+	return nil
+}
+
+// Salt repository with a fixed salt for every day
+type fixedSaltRepository struct{}
+
+func (fixedSaltRepository) Create(salt *session.Salt) error { return nil }
+
+func (fixedSaltRepository) GetForDay(day time.Time) (session.Salt, error) {
+	return session.Salt{Salt: []byte("0123456789abcdef"), Day: day}, nil
+}
+
+func (fixedSaltRepository) DeleteBefore(day time.Time) error { return nil }
+
+func TestCreateEventIsPendingWithAsyncValidation(t *testing.T) {
+	config := buildValidationConfig("http://127.0.0.1:0")
+	config.Validate.Async = true
+
+	service := buildBufferedEventService(t, config)
+
+	// Nothing is checked up front so an unreachable API does not matter
+	if err := service.Validate(viewRequest("10.5072/unchecked")); err != nil {
+		t.Errorf("Validate should not check anything in async mode but got %v", err)
+	}
+
+	view, err := service.CreateEvent(viewRequest("10.5072/unchecked"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if view.ValidationStatus != ValidationPending {
+		t.Errorf("View should be pending validation but got %d", view.ValidationStatus)
+	}
+
+	download := viewRequest("10.5072/unchecked")
+	download.Name = "download"
+
+	// Downloads are never validated
+	if event, _ := service.CreateEvent(download); event.ValidationStatus != ValidationConfirmed {
+		t.Errorf("Download should be confirmed but got %d", event.ValidationStatus)
+	}
+}
+
+func TestAsyncValidatorConfirmsAndQuarantines(t *testing.T) {
+	fake := newFakeDataCite(t)
+
+	config := buildValidationConfig(fake.server.URL)
+	config.Validate.Async = true
+	config.Validate.AsyncBatchSize = 10
+	// Keep a lookup that fails for the outage below from being cached
+	config.Validate.CacheSize = 0
+	service := NewEventService(nil, nil, config)
+
+	repository := &MockPendingEventRepository{
+		pending: []PendingValidation{
+			{RepoId: "example.com", Pid: "10.5072/good", Url: "https://example.org/datasets/10.5072/good"},
+			{RepoId: "example.com", Pid: "10.5072/gone.missing", Url: "https://example.org/datasets/10.5072/gone.missing"},
+			{RepoId: "example.com", Pid: "10.5072/moved", Url: "https://example.org/elsewhere"},
+		},
+		status: make(map[string]uint8),
+	}
+
+	validator := NewAsyncValidator(repository, service, config)
+
+	// While DataCite is down everything stays pending
+	fake.status.Store(http.StatusServiceUnavailable)
+
+	confirmed, quarantined, err := validator.ValidatePending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if confirmed != 0 || quarantined != 0 || len(repository.status) != 0 {
+		t.Errorf("Events should stay pending while DataCite is unavailable")
+	}
+
+	fake.status.Store(0)
+
+	confirmed, quarantined, err = validator.ValidatePending()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if confirmed != 1 || quarantined != 2 {
+		t.Errorf("Expected 1 confirmed and 2 quarantined but got %d and %d", confirmed, quarantined)
+	}
+
+	if repository.status["10.5072/good"] != ValidationConfirmed {
+		t.Errorf("Valid DOI should be confirmed")
+	}
+
+	if repository.status["10.5072/gone.missing"] != ValidationQuarantined || repository.status["10.5072/moved"] != ValidationQuarantined {
+		t.Errorf("Invalid DOIs should be quarantined")
+	}
+}
+
+func TestAsyncValidatorQuarantinesLongPendingEvents(t *testing.T) {
+	fake := newFakeDataCite(t)
+	fake.status.Store(http.StatusServiceUnavailable)
+
+	config := buildValidationConfig(fake.server.URL)
+	config.Validate.AsyncBatchSize = 10
+	config.Validate.PendingMaxAge = 48 * time.Hour
+	service := NewEventService(nil, nil, config)
+
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	repository := &MockPendingEventRepository{
+		pending: []PendingValidation{
+			{RepoId: "example.com", Pid: "10.5072/stuck", Url: "https://example.org/datasets/10.5072/stuck", Oldest: now.Add(-72 * time.Hour)},
+			{RepoId: "example.com", Pid: "10.5072/recent", Url: "https://example.org/datasets/10.5072/recent", Oldest: now.Add(-time.Hour)},
+		},
+		status: make(map[string]uint8),
+	}
+
+	validator := NewAsyncValidator(repository, service, config)
+	validator.now = func() time.Time { return now }
+
+	confirmed, quarantined, err := validator.ValidatePending()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if confirmed != 0 || quarantined != 1 || repository.status["10.5072/stuck"] != ValidationQuarantined {
+		t.Errorf("Only the event pending past the maximum age should be quarantined but got %v", repository.status)
+	}
+	if _, done := repository.status["10.5072/recent"]; done {
+		t.Errorf("Recent event should stay pending while DataCite is unavailable")
+	}
+}
+
+// Validator that rejects every identifier and records what it was given
+type rejectingValidator struct {
+	validated []pid.PID
+}
+
+func (v *rejectingValidator) Validate(identifier pid.PID, url string) error {
+	v.validated = append(v.validated, identifier)
+	return errors.New("this identifier is not known")
+}
+
+func TestValidateUsesValidatorForPidType(t *testing.T) {
+	fake := newFakeDataCite(t)
+	service := NewEventService(nil, nil, buildValidationConfig(fake.server.URL))
+
+	arks := &rejectingValidator{}
+	service.RegisterValidator(pid.ARK, arks)
+
+	if err := service.Validate(viewRequest("https://n2t.net/ark:/13030/tf5p30086k")); err == nil {
+		t.Errorf("ARK should be checked by the ARK validator")
+	}
+
+	if len(arks.validated) != 1 || arks.validated[0].Value != "ark:/13030/tf5p30086k" {
+		t.Errorf("ARK validator should be given the normalised ARK but got %+v", arks.validated)
+	}
+
+	// No validator for handles so they are accepted without a lookup
+	if err := service.Validate(viewRequest("20.500.12345/item-1")); err != nil {
+		t.Errorf("Handle should be accepted but got %v", err)
+	}
+
+	if fake.requests.Load() != 0 {
+		t.Errorf("Only DOIs should be looked up in DataCite but got %d requests", fake.requests.Load())
+	}
+}
+
+func TestCreateEventStoresNormalisedPid(t *testing.T) {
+	config := buildValidationConfig("http://127.0.0.1:0")
+
+	service := buildBufferedEventService(t, config)
+
+	tests := []struct {
+		pid      string
+		wantPid  string
+		wantType pid.Type
+	}{
+		{"https://doi.org/10.5072/ABC", "10.5072/abc", pid.DOI},
+		{"hdl:20.500.12345/Item-1", "20.500.12345/item-1", pid.Handle},
+		{"doi:10.5072%2FDEF", "10.5072/def", pid.DOI},
+		{"urn:NBN:de:101:1-2011", "urn:nbn:de:101:1-2011", pid.URN},
+	}
+
+	for _, test := range tests {
+		request := viewRequest(test.pid)
+		request.Name = "download"
+
+		event, err := service.CreateEvent(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if event.Pid != test.wantPid || event.PidType != string(test.wantType) {
+			t.Errorf("Event for %s should have pid %s of type %s but got %s of type %s", test.pid, test.wantPid, test.wantType, event.Pid, event.PidType)
+		}
+	}
+}
+
+func TestInvalidDOIsAreRejected(t *testing.T) {
+	config := buildValidationConfig("http://127.0.0.1:0")
+
+	service := buildBufferedEventService(t, config)
+
+	request := viewRequest("doi:10.5072")
+	request.Name = "download"
+
+	// Downloads are not looked up but are still checked
+	if err := service.Validate(request); !errors.Is(err, pid.ErrInvalidDOI) {
+		t.Errorf("Validate should return ErrInvalidDOI but got %v", err)
+	}
+
+	if _, err := service.CreateEvent(request); !errors.Is(err, pid.ErrInvalidDOI) {
+		t.Errorf("CreateEvent should return ErrInvalidDOI but got %v", err)
+	}
+}
+
+func TestValidateRepositorySettings(t *testing.T) {
+	fake := newFakeDataCite(t)
+	config := buildValidationConfig(fake.server.URL)
+	config.Validate.DoiUrl = false
+	service := NewEventService(nil, nil, config)
+
+	checkUrl := true
+	skipChecks := false
+	service.SetRepositorySettings(func(repoId string) (RepositorySettings, bool) {
+		switch repoId {
+		case "strict":
+			return RepositorySettings{ValidateDoiUrl: &checkUrl}, true
+		case "lenient":
+			return RepositorySettings{ValidateDoiExistence: &skipChecks}, true
+		case "restricted":
+			return RepositorySettings{AllowedDomains: []string{"example.org"}}, true
+		}
+		return RepositorySettings{}, false
+	})
+
+	request := func(repoId string, doi string, url string) *EventRequest {
+		return &EventRequest{Name: "view", RepoId: repoId, Pid: doi, Url: url}
+	}
+
+	// The url is only checked for the repository that asks for it
+	if err := service.Validate(request("other", "10.1234/a", "https://example.org/elsewhere")); err != nil {
+		t.Errorf("Url should not be checked by default but got %v", err)
+	}
+	if err := service.Validate(request("strict", "10.1234/a", "https://example.org/elsewhere")); err == nil {
+		t.Errorf("Url should be checked for the strict repository")
+	}
+
+	// Neither check is made so DataCite is not asked
+	requests := fake.requests.Load()
+	if err := service.Validate(request("lenient", "10.1234/b.missing", "https://example.org/datasets/10.1234/b.missing")); err != nil {
+		t.Errorf("DOI should not be checked for the lenient repository but got %v", err)
+	}
+	if fake.requests.Load() != requests {
+		t.Errorf("DataCite should not be asked about DOIs of the lenient repository")
+	}
+
+	for url, allowed := range map[string]bool{
+		"https://example.org/datasets/10.1234/c":      true,
+		"https://www.example.org/datasets/10.1234/c":  true,
+		"https://data.example.org/datasets/10.1234/c": true,
+		"https://notexample.org/datasets/10.1234/c":   false,
+		"https://example.com/datasets/10.1234/c":      false,
+	} {
+		err := service.Validate(request("restricted", "10.1234/c", url))
+		if allowed && err != nil {
+			t.Errorf("%s should be allowed but got %v", url, err)
+		}
+		if !allowed && !errors.Is(err, ErrDomainNotAllowed) {
+			t.Errorf("%s should not be allowed but got %v", url, err)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package geoip
+
+import (
+	"net"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Locator finds the country an IP address is in
+type Locator interface {
+	// ISO 3166-1 alpha-2 code of the country, empty when it is unknown
+	Country(ip string) string
+}
+
+//
+// MaxMind implementation of the locator, reads a local GeoIP2 or GeoLite2
+// Country or City MMDB file so no addresses are sent anywhere
+//
+
+type MMDBLocator struct {
+	reader *maxminddb.Reader
+}
+
+// Only the country code is read from the record
+type countryRecord struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+func NewMMDBLocator(path string) (*MMDBLocator, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MMDBLocator{
+		reader: reader,
+	}, nil
+}
+
+func (locator *MMDBLocator) Country(ip string) string {
+	address := net.ParseIP(strings.TrimSpace(ip))
+	if address == nil {
+		return ""
+	}
+
+	var record countryRecord
+	if err := locator.reader.Lookup(address, &record); err != nil {
+		return ""
+	}
+
+	// Fall back to where the network is registered, e.g. for anonymous proxies
+	if record.Country.IsoCode != "" {
+		return record.Country.IsoCode
+	}
+	return record.RegisteredCountry.IsoCode
+}
+
+func (locator *MMDBLocator) Close() error {
+	return locator.reader.Close()
+}
@@ -0,0 +1,36 @@
+package geoip
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMMDBLocatorCountry(t *testing.T) {
+	locator, err := NewMMDBLocator(filepath.Join("testdata", "country-test.mmdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer locator.Close()
+
+	tests := map[string]string{
+		"81.2.69.160":     "GB",
+		"216.160.83.56":   "US",
+		"2001:218:85a3::": "JP",
+		" 81.2.69.160 ":   "GB",
+		"10.0.0.1":        "",
+		"not an ip":       "",
+		"":                "",
+	}
+
+	for ip, want := range tests {
+		if got := locator.Country(ip); got != want {
+			t.Errorf("Country of %q should be %q but got %q", ip, want, got)
+		}
+	}
+}
+
+func TestNewMMDBLocatorMissingFile(t *testing.T) {
+	if _, err := NewMMDBLocator(filepath.Join(t.TempDir(), "missing.mmdb")); err == nil {
+		t.Errorf("Opening a missing database should return an error")
+	}
+}
@@ -0,0 +1,31 @@
+package jobs
+
+import "time"
+
+// Outcomes of a report job
+const (
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	StatusSkipped   = "skipped" // Nothing to report, or the repository is not reported on
+)
+
+// ReportJob is one attempt at generating and submitting the report of a
+// repository for a month
+type ReportJob struct {
+	RepoId      string
+	BeginDate   time.Time `gorm:"type:Date"`
+	EndDate     time.Time `gorm:"type:Date"` // Last day of the month
+	Format      string
+	Granularity string
+	Status      string
+	Error       string
+	Parts       uint32 // Parts sent by this attempt
+	Started     time.Time
+	Finished    time.Time
+}
+
+// First event of a repository within a period
+type RepositoryActivity struct {
+	RepoId     string
+	FirstEvent time.Time
+}
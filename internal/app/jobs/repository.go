@@ -0,0 +1,73 @@
+package jobs
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type JobsRepositoryReader interface {
+	// Repositories with events in the period and the first of them, a zero
+	// start leaves the period open
+	RepositoriesWithEvents(start time.Time, end time.Time) ([]RepositoryActivity, error)
+	// Begin date of the latest month reported successfully for each repository
+	LastSucceeded(format string, granularity string) (map[string]time.Time, error)
+	// Record the outcome of a job
+	Create(job *ReportJob) error
+}
+
+type JobsRepository struct {
+	db *gorm.DB
+}
+
+func NewJobsRepository(db *gorm.DB) *JobsRepository {
+	return &JobsRepository{
+		db: db,
+	}
+}
+
+func (repository *JobsRepository) RepositoriesWithEvents(start time.Time, end time.Time) ([]RepositoryActivity, error) {
+	var activity []RepositoryActivity
+
+	query := repository.db.Table("events").
+		Select("repo_id, min(timestamp) AS first_event").
+		Where("timestamp < ?", end)
+
+	if !start.IsZero() {
+		query = query.Where("timestamp >= ?", start)
+	}
+
+	err := query.
+		Group("repo_id").
+		Order("repo_id").
+		Scan(&activity).Error
+
+	return activity, err
+}
+
+func (repository *JobsRepository) LastSucceeded(format string, granularity string) (map[string]time.Time, error) {
+	var results []struct {
+		RepoId        string
+		LastSucceeded time.Time
+	}
+
+	err := repository.db.Model(&ReportJob{}).
+		Select("repo_id, max(begin_date) AS last_succeeded").
+		Where("format = ? AND granularity = ? AND status = ?", format, granularity, StatusSucceeded).
+		Group("repo_id").
+		Scan(&results).Error
+	if err != nil {
+		return nil, err
+	}
+
+	succeeded := make(map[string]time.Time, len(results))
+	for _, result := range results {
+		succeeded[result.RepoId] = result.LastSucceeded
+	}
+
+	return succeeded, nil
+}
+
+func (repository *JobsRepository) Create(job *ReportJob) error {
+	return repository.db.Create(job).Error
+}
@@ -0,0 +1,221 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/datacite/keeshond/internal/app/registry"
+	"github.com/datacite/keeshond/internal/app/reports"
+)
+
+// Reporter generates and submits the report of a job, it returns the number
+// of parts it sent
+type Reporter func(job ReportJob) (int, error)
+
+// Options of a scheduled run
+type Options struct {
+	Format      string
+	Granularity string
+	// Report every month since the last successful report of each repository
+	// rather than only the previous month
+	CatchUp bool
+	// Report months that were already reported successfully again, updating
+	// the reports in the Reports API in place
+	Resubmit bool
+}
+
+// Number of jobs of a run with each outcome
+type Summary struct {
+	Succeeded int
+	Failed    int
+	Skipped   int
+}
+
+// JobsService reports the monthly usage of every repository with events,
+// running the reports of several repositories at a time and keeping a history
+// of each job.
+type JobsService struct {
+	repository JobsRepositoryReader
+	reporter   Reporter
+	workers    int
+	now        func() time.Time
+}
+
+func NewJobsService(repository JobsRepositoryReader, reporter Reporter, workers int) *JobsService {
+	if workers < 1 {
+		workers = 1
+	}
+
+	return &JobsService{
+		repository: repository,
+		reporter:   reporter,
+		workers:    workers,
+		now:        time.Now,
+	}
+}
+
+// Plan returns the jobs of the months to report, months that were already
+// reported successfully are left out unless resubmitting
+func (service *JobsService) Plan(options Options) ([]ReportJob, error) {
+	// Only whole months before the current one are reported
+	end := monthStart(service.now())
+	previous := end.AddDate(0, -1, 0)
+
+	start := previous
+	if options.CatchUp {
+		start = time.Time{}
+	}
+
+	activity, err := service.repository.RepositoriesWithEvents(start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	succeeded, err := service.repository.LastSucceeded(options.Format, options.Granularity)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []ReportJob
+	for _, repository := range activity {
+		from := previous
+		if options.CatchUp {
+			from = monthStart(repository.FirstEvent)
+		}
+
+		if last, ok := succeeded[repository.RepoId]; ok && !last.Before(from) && !options.Resubmit {
+			from = monthStart(last).AddDate(0, 1, 0)
+		}
+
+		for month := from; month.Before(end); month = month.AddDate(0, 1, 0) {
+			jobs = append(jobs, ReportJob{
+				RepoId:      repository.RepoId,
+				BeginDate:   month,
+				EndDate:     month.AddDate(0, 1, -1), // Included in the report
+				Format:      options.Format,
+				Granularity: options.Granularity,
+			})
+		}
+	}
+
+	return jobs, nil
+}
+
+// RunMonthly runs the planned jobs with a bounded number of workers and
+// records the outcome of each. A failed job does not stop the others.
+func (service *JobsService) RunMonthly(options Options) (Summary, error) {
+	jobs, err := service.Plan(options)
+	if err != nil {
+		return Summary{}, err
+	}
+
+	log.Printf("Running %d report jobs with %d workers", len(jobs), service.workers)
+
+	queue := make(chan ReportJob)
+	results := make(chan ReportJob)
+
+	var wg sync.WaitGroup
+	for i := 0; i < service.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				results <- service.run(job)
+			}
+		}()
+	}
+
+	go func() {
+		for _, job := range jobs {
+			queue <- job
+		}
+		close(queue)
+		wg.Wait()
+		close(results)
+	}()
+
+	var summary Summary
+	var errs []error
+
+	for job := range results {
+		switch job.Status {
+		case StatusSucceeded:
+			summary.Succeeded++
+		case StatusSkipped:
+			summary.Skipped++
+		default:
+			summary.Failed++
+		}
+
+		if err := service.repository.Create(&job); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return summary, errors.Join(errs...)
+}
+
+func (service *JobsService) run(job ReportJob) ReportJob {
+	job.Started = service.now()
+	parts, err := service.reporter(job)
+	job.Finished = service.now()
+	job.Parts = uint32(parts)
+
+	switch {
+	case err == nil:
+		job.Status = StatusSucceeded
+	case errors.Is(err, reports.ErrNoResults), errors.Is(err, registry.ErrNotFound), errors.Is(err, registry.ErrReportingDisabled):
+		job.Status = StatusSkipped
+		job.Error = err.Error()
+	default:
+		job.Status = StatusFailed
+		job.Error = err.Error()
+	}
+
+	if job.Error != "" {
+		log.Printf("Report of %s for %s %s: %s", job.RepoId, job.BeginDate.Format("2006-01"), job.Status, job.Error)
+	} else {
+		log.Printf("Report of %s for %s %s, %d parts sent", job.RepoId, job.BeginDate.Format("2006-01"), job.Status, job.Parts)
+	}
+
+	return job
+}
+
+// Run reports the previous month once the delay has passed after the start of
+// every month, it blocks until the context is done. When started later in the
+// month it runs straight away, months already reported are not sent again.
+func (service *JobsService) Run(ctx context.Context, options Options, delay time.Duration) {
+	for {
+		now := service.now()
+		if scheduled := monthStart(now).Add(delay); now.Before(scheduled) {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(scheduled.Sub(now)):
+			}
+		}
+
+		summary, err := service.RunMonthly(options)
+		if err != nil {
+			log.Printf("Scheduled reporting failed: %v", err)
+		}
+		log.Printf("Scheduled reporting finished, %d succeeded, %d failed and %d skipped", summary.Succeeded, summary.Failed, summary.Skipped)
+
+		// Wait for the start of the next month
+		next := monthStart(service.now()).AddDate(0, 1, 0)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+	}
+}
+
+// Start of the UTC month of the time
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
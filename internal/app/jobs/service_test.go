@@ -0,0 +1,252 @@
+package jobs
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/datacite/keeshond/internal/app/registry"
+	"github.com/datacite/keeshond/internal/app/reports"
+)
+
+type MockJobsRepositoryReader struct {
+	activity []RepositoryActivity
+	jobs     []ReportJob
+}
+
+// Repositories whose first event is in the period, good enough for the tests
+func (m *MockJobsRepositoryReader) RepositoriesWithEvents(start time.Time, end time.Time) ([]RepositoryActivity, error) {
+	var activity []RepositoryActivity
+	for _, repository := range m.activity {
+		if repository.FirstEvent.Before(end) && !repository.FirstEvent.Before(start) {
+			activity = append(activity, repository)
+		}
+	}
+	return activity, nil
+}
+
+func (m *MockJobsRepositoryReader) LastSucceeded(format string, granularity string) (map[string]time.Time, error) {
+	succeeded := make(map[string]time.Time)
+	for _, job := range m.jobs {
+		if job.Status == StatusSucceeded && job.Format == format && job.Granularity == granularity && job.BeginDate.After(succeeded[job.RepoId]) {
+			succeeded[job.RepoId] = job.BeginDate
+		}
+	}
+	return succeeded, nil
+}
+
+func (m *MockJobsRepositoryReader) Create(job *ReportJob) error {
+	m.jobs = append(m.jobs, *job)
+	return nil
+}
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func buildJobsService(repository *MockJobsRepositoryReader, reporter Reporter, workers int) *JobsService {
+	service := NewJobsService(repository, reporter, workers)
+	service.now = func() time.Time { return time.Date(2024, 4, 2, 12, 0, 0, 0, time.UTC) }
+	return service
+}
+
+// Months of the planned jobs of each repository
+func plannedMonths(jobs []ReportJob) map[string][]string {
+	months := make(map[string][]string)
+	for _, job := range jobs {
+		months[job.RepoId] = append(months[job.RepoId], job.BeginDate.Format("2006-01-02")+"/"+job.EndDate.Format("2006-01-02"))
+	}
+	return months
+}
+
+func TestJobsServicePlanPreviousMonth(t *testing.T) {
+	repository := &MockJobsRepositoryReader{
+		activity: []RepositoryActivity{
+			{RepoId: "active", FirstEvent: date(2024, 3, 5)},
+			{RepoId: "reported", FirstEvent: date(2024, 3, 1)},
+			{RepoId: "quiet", FirstEvent: date(2024, 1, 10)},
+		},
+		jobs: []ReportJob{
+			{RepoId: "reported", BeginDate: date(2024, 3, 1), Format: reports.FormatRD1, Granularity: reports.GranularityTotals, Status: StatusSucceeded},
+		},
+	}
+	service := buildJobsService(repository, nil, 1)
+
+	jobs, err := service.Plan(Options{Format: reports.FormatRD1, Granularity: reports.GranularityTotals})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]string{
+		"active": {"2024-03-01/2024-03-31"},
+	}
+	if months := plannedMonths(jobs); !reflect.DeepEqual(months, expected) {
+		t.Errorf("Expected %v but got %v", expected, months)
+	}
+
+	// A report in another format has not been sent yet
+	jobs, err = service.Plan(Options{Format: reports.FormatR51, Granularity: reports.GranularityTotals})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 {
+		t.Errorf("Both repositories should be reported in another format but got %v", plannedMonths(jobs))
+	}
+}
+
+func TestJobsServicePlanResubmit(t *testing.T) {
+	repository := &MockJobsRepositoryReader{
+		activity: []RepositoryActivity{
+			{RepoId: "reported", FirstEvent: date(2024, 2, 1)},
+		},
+		jobs: []ReportJob{
+			{RepoId: "reported", BeginDate: date(2024, 2, 1), Status: StatusSucceeded},
+			{RepoId: "reported", BeginDate: date(2024, 3, 1), Status: StatusSucceeded},
+		},
+	}
+	service := buildJobsService(repository, nil, 1)
+
+	jobs, err := service.Plan(Options{CatchUp: true, Resubmit: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]string{
+		"reported": {"2024-02-01/2024-02-29", "2024-03-01/2024-03-31"},
+	}
+	if months := plannedMonths(jobs); !reflect.DeepEqual(months, expected) {
+		t.Errorf("Reported months should be planned again but got %v", months)
+	}
+}
+
+func TestJobsServicePlanCatchUp(t *testing.T) {
+	repository := &MockJobsRepositoryReader{
+		activity: []RepositoryActivity{
+			{RepoId: "new", FirstEvent: date(2024, 2, 20)},
+			{RepoId: "behind", FirstEvent: date(2023, 6, 1)},
+			{RepoId: "current", FirstEvent: date(2023, 1, 1)},
+		},
+		jobs: []ReportJob{
+			{RepoId: "behind", BeginDate: date(2023, 12, 1), Status: StatusSucceeded},
+			{RepoId: "behind", BeginDate: date(2024, 1, 1), Status: StatusFailed},
+			{RepoId: "current", BeginDate: date(2024, 3, 1), Status: StatusSucceeded},
+		},
+	}
+	service := buildJobsService(repository, nil, 1)
+
+	jobs, err := service.Plan(Options{CatchUp: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]string{
+		"new":    {"2024-02-01/2024-02-29", "2024-03-01/2024-03-31"},
+		"behind": {"2024-01-01/2024-01-31", "2024-02-01/2024-02-29", "2024-03-01/2024-03-31"},
+	}
+	if months := plannedMonths(jobs); !reflect.DeepEqual(months, expected) {
+		t.Errorf("Expected %v but got %v", expected, months)
+	}
+}
+
+func TestJobsServiceRunMonthlyRecordsOutcomes(t *testing.T) {
+	repository := &MockJobsRepositoryReader{
+		activity: []RepositoryActivity{
+			{RepoId: "ok", FirstEvent: date(2024, 3, 1)},
+			{RepoId: "empty", FirstEvent: date(2024, 3, 1)},
+			{RepoId: "unregistered", FirstEvent: date(2024, 3, 1)},
+			{RepoId: "broken", FirstEvent: date(2024, 3, 1)},
+		},
+	}
+
+	service := buildJobsService(repository, func(job ReportJob) (int, error) {
+		switch job.RepoId {
+		case "ok":
+			return 2, nil
+		case "empty":
+			return 0, reports.ErrNoResults
+		case "unregistered":
+			return 0, fmt.Errorf("%w: %s", registry.ErrNotFound, job.RepoId)
+		}
+		return 1, errors.New("sending part 2: reports API unavailable")
+	}, 2)
+
+	summary, err := service.RunMonthly(Options{Format: reports.FormatRD1, Granularity: reports.GranularityTotals})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if summary != (Summary{Succeeded: 1, Failed: 1, Skipped: 2}) {
+		t.Errorf("Unexpected summary %+v", summary)
+	}
+
+	statuses := make(map[string]ReportJob)
+	for _, job := range repository.jobs {
+		statuses[job.RepoId] = job
+	}
+
+	if job := statuses["ok"]; job.Status != StatusSucceeded || job.Parts != 2 || job.Error != "" {
+		t.Errorf("Successful job recorded as %+v", job)
+	}
+	if job := statuses["broken"]; job.Status != StatusFailed || job.Parts != 1 || job.Error != "sending part 2: reports API unavailable" {
+		t.Errorf("Failed job recorded as %+v", job)
+	}
+	if statuses["empty"].Status != StatusSkipped || statuses["unregistered"].Status != StatusSkipped {
+		t.Errorf("Repositories with nothing to report should be skipped but got %+v", statuses)
+	}
+
+	// Only the failed repository is tried again
+	summary, err = service.RunMonthly(Options{Format: reports.FormatRD1, Granularity: reports.GranularityTotals})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Succeeded != 0 || summary.Failed+summary.Skipped != 3 {
+		t.Errorf("Successful report should not be run again but got %+v", summary)
+	}
+}
+
+func TestJobsServiceBoundsWorkers(t *testing.T) {
+	repository := &MockJobsRepositoryReader{}
+	for i := 0; i < 10; i++ {
+		repository.activity = append(repository.activity, RepositoryActivity{RepoId: fmt.Sprintf("repo-%d", i), FirstEvent: date(2024, 3, 1)})
+	}
+
+	var running, most atomic.Int64
+	var mu sync.Mutex
+	reported := make(map[string]bool)
+
+	service := buildJobsService(repository, func(job ReportJob) (int, error) {
+		now := running.Add(1)
+		defer running.Add(-1)
+
+		for {
+			previous := most.Load()
+			if now <= previous || most.CompareAndSwap(previous, now) {
+				break
+			}
+		}
+
+		time.Sleep(5 * time.Millisecond)
+
+		mu.Lock()
+		reported[job.RepoId] = true
+		mu.Unlock()
+
+		return 1, nil
+	}, 3)
+
+	summary, err := service.RunMonthly(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if summary.Succeeded != 10 || len(reported) != 10 {
+		t.Errorf("Every repository should be reported but got %+v", summary)
+	}
+	if most.Load() > 3 {
+		t.Errorf("At most 3 reports should run at a time but %d did", most.Load())
+	}
+}
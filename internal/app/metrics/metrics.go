@@ -0,0 +1,161 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "keeshond"
+
+// Outcomes of a metric event request
+const (
+	OutcomeAccepted   = "accepted"
+	OutcomeBadRequest = "bad_request"
+	OutcomeTooLarge   = "too_large"
+	OutcomeBot        = "bot"
+	OutcomeInvalid    = "invalid"
+	OutcomeBufferFull = "buffer_full"
+	OutcomeError      = "error"
+)
+
+// Repository label of event requests that can not be told apart, such as
+// requests of repositories that are not registered or could not be read
+const UnknownRepo = "unknown"
+
+// Outcomes of a timed call
+const (
+	OutcomeOk     = "ok"
+	OutcomeFailed = "failed"
+)
+
+var (
+	// Every metric event request by repository and what happened to it
+	Events = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_total",
+		Help:      "Metric event requests by repository and outcome.",
+	}, []string{"repo_id", "outcome"})
+
+	EventInsertDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "event_insert_duration_seconds",
+		Help:      "Time to insert an event, or a batch of events when buffering is enabled.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"outcome"})
+
+	ValidationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "validation_duration_seconds",
+		Help:      "Time to validate an event against the DataCite API.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"outcome"})
+
+	StatsQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "stats_query_duration_seconds",
+		Help:      "Time to run a statistics query against Clickhouse.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"query"})
+
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "status"})
+
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time to serve HTTP requests by method and route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+)
+
+// Outcome returns the outcome label for an error
+func Outcome(err error) string {
+	if err != nil {
+		return OutcomeFailed
+	}
+	return OutcomeOk
+}
+
+// ObserveSince records the time since start in the histogram
+func ObserveSince(histogram *prometheus.HistogramVec, start time.Time, labels ...string) {
+	histogram.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+}
+
+// Gauges registered with RegisterGaugeFunc by name, the function a gauge
+// reads can be replaced
+var (
+	gaugesMu sync.Mutex
+	gauges   = make(map[string]*gaugeFunc)
+)
+
+type gaugeFunc struct {
+	gauge prometheus.GaugeFunc
+	value atomic.Pointer[func() float64]
+}
+
+// RegisterGaugeFunc exposes a value read at scrape time. Registering the same
+// name again reads the new value instead, so servers can be created more than
+// once.
+func RegisterGaugeFunc(name string, help string, value func() float64) {
+	gaugesMu.Lock()
+	defer gaugesMu.Unlock()
+
+	if registered, ok := gauges[name]; ok {
+		registered.value.Store(&value)
+		return
+	}
+
+	registered := &gaugeFunc{}
+	registered.value.Store(&value)
+	registered.gauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, func() float64 {
+		return (*registered.value.Load())()
+	})
+
+	prometheus.MustRegister(registered.gauge)
+	gauges[name] = registered
+}
+
+// Handler serves the metrics for Prometheus to scrape
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Middleware counts and times requests by their route pattern rather than
+// path so repository and pid parameters do not each become a series.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if routeContext := chi.RouteContext(r.Context()); routeContext != nil && routeContext.RoutePattern() != "" {
+			route = routeContext.RoutePattern()
+		}
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		HTTPRequests.WithLabelValues(r.Method, route, strconv.Itoa(status)).Inc()
+		ObserveSince(HTTPRequestDuration, start, r.Method, route)
+	})
+}
@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMiddlewareLabelsByRoutePattern(t *testing.T) {
+	router := chi.NewRouter()
+	router.Use(Middleware)
+	router.Get("/api/check/{repoId}", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "No events found", http.StatusNotFound)
+	})
+
+	for _, repoId := range []string{"one.example.com", "two.example.com"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/check/"+repoId, nil))
+	}
+
+	count := testutil.ToFloat64(HTTPRequests.WithLabelValues(http.MethodGet, "/api/check/{repoId}", "404"))
+	if count != 2 {
+		t.Errorf("Expected 2 requests counted against the route pattern but got %v", count)
+	}
+}
+
+func TestOutcome(t *testing.T) {
+	if Outcome(nil) != OutcomeOk {
+		t.Errorf("Outcome of no error should be %s", OutcomeOk)
+	}
+
+	if Outcome(errors.New("timeout")) != OutcomeFailed {
+		t.Errorf("Outcome of an error should be %s", OutcomeFailed)
+	}
+}
+
+func TestRegisterGaugeFuncTwice(t *testing.T) {
+	RegisterGaugeFunc("test_depth", "Test gauge.", func() float64 { return 1 })
+
+	// Registering again, as a second server would, must not panic
+	RegisterGaugeFunc("test_depth", "Test gauge.", func() float64 { return 2 })
+
+	if value := testutil.ToFloat64(gauges["test_depth"].gauge); value != 2 {
+		t.Errorf("Gauge should read the value registered last but got %v", value)
+	}
+}
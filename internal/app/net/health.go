@@ -0,0 +1,150 @@
+package net
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datacite/keeshond/internal/app/db"
+)
+
+type HealthCheckResult struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type HealthResponse struct {
+	Status string                       `json:"status"`
+	Checks map[string]HealthCheckResult `json:"checks,omitempty"`
+}
+
+// A dependency check, it should return once the context is done
+type healthCheck func(ctx context.Context) error
+
+// runHealthChecks runs the checks concurrently, each is given the timeout to
+// finish before it is reported as failed.
+func runHealthChecks(ctx context.Context, checks map[string]healthCheck, timeout time.Duration) HealthResponse {
+	response := HealthResponse{
+		Status: "ok",
+		Checks: make(map[string]HealthCheckResult, len(checks)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check healthCheck) {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			start := time.Now()
+
+			// Run apart so a check that ignores the context still times out
+			done := make(chan error, 1)
+			go func() { done <- check(checkCtx) }()
+
+			var err error
+			select {
+			case err = <-done:
+			case <-checkCtx.Done():
+				err = checkCtx.Err()
+			}
+
+			result := HealthCheckResult{
+				Status:    "ok",
+				LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				result.Status = "failed"
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			response.Checks[name] = result
+			if err != nil {
+				response.Status = "failed"
+			}
+		}(name, check)
+	}
+
+	wg.Wait()
+
+	return response
+}
+
+// Checks the server needs to be working to accept events
+func (s *Http) readinessChecks() map[string]healthCheck {
+	checks := map[string]healthCheck{
+		"database": func(ctx context.Context) error {
+			return db.TestConnectionContext(ctx, s.db)
+		},
+		"salt": func(ctx context.Context) error {
+			_, err := s.sessionService.GetSalt()
+			return err
+		},
+		"robots": func(ctx context.Context) error {
+			if !s.robotsService.Loaded() {
+				return errors.New("robots list not loaded")
+			}
+			return nil
+		},
+	}
+
+	// DataCite is only needed to validate DOIs and is down more often than we are
+	if s.config.Health.CheckDataCite {
+		checks["datacite"] = func(ctx context.Context) error {
+			url := strings.TrimSuffix(s.config.DataCite.Url, "/") + "/heartbeat"
+
+			request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+			if err != nil {
+				return err
+			}
+
+			resp, err := http.DefaultClient.Do(request)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("unexpected status %d", resp.StatusCode)
+			}
+			return nil
+		}
+	}
+
+	return checks
+}
+
+func writeHealthResponse(w http.ResponseWriter, response HealthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if response.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// Liveness only says the process is serving requests, dependencies are left to
+// readiness so an outage elsewhere does not get the server restarted.
+func (s *Http) livez(w http.ResponseWriter, r *http.Request) {
+	writeHealthResponse(w, HealthResponse{Status: "ok"})
+}
+
+// Readiness checks every dependency needed to accept events
+func (s *Http) readyz(w http.ResponseWriter, r *http.Request) {
+	writeHealthResponse(w, runHealthChecks(r.Context(), s.readinessChecks(), s.config.Health.Timeout))
+}
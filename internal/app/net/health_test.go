@@ -0,0 +1,71 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRunHealthChecksReportsEachCheck(t *testing.T) {
+	checks := map[string]healthCheck{
+		"working": func(ctx context.Context) error { return nil },
+		"broken":  func(ctx context.Context) error { return errors.New("connection refused") },
+	}
+
+	response := runHealthChecks(context.Background(), checks, time.Second)
+
+	if response.Status != "failed" {
+		t.Errorf("Status should be failed when a check fails but got %s", response.Status)
+	}
+
+	if response.Checks["working"].Status != "ok" {
+		t.Errorf("Working check should be ok but got %+v", response.Checks["working"])
+	}
+
+	if response.Checks["broken"].Error != "connection refused" {
+		t.Errorf("Broken check should report its error but got %+v", response.Checks["broken"])
+	}
+}
+
+func TestRunHealthChecksTimesOutSlowChecks(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	checks := map[string]healthCheck{
+		// Ignores the context so only the timeout can end it
+		"stuck": func(ctx context.Context) error {
+			<-release
+			return nil
+		},
+	}
+
+	start := time.Now()
+	response := runHealthChecks(context.Background(), checks, 20*time.Millisecond)
+
+	if time.Since(start) > time.Second {
+		t.Errorf("Health checks should not wait for a stuck check")
+	}
+
+	if response.Checks["stuck"].Status != "failed" {
+		t.Errorf("Stuck check should fail but got %+v", response.Checks["stuck"])
+	}
+}
+
+func TestWriteHealthResponseStatusCodes(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writeHealthResponse(recorder, HealthResponse{Status: "ok"})
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected status 200 but got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	writeHealthResponse(recorder, HealthResponse{Status: "failed"})
+
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 but got %d", recorder.Code)
+	}
+}
@@ -1,18 +1,27 @@
 package net
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
+	stdnet "net"
 	"net/http"
-	"regexp"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/datacite/keeshond/internal/app"
 	"github.com/datacite/keeshond/internal/app/auth"
 	"github.com/datacite/keeshond/internal/app/event"
+	"github.com/datacite/keeshond/internal/app/geoip"
+	"github.com/datacite/keeshond/internal/app/metrics"
+	"github.com/datacite/keeshond/internal/app/pid"
+	"github.com/datacite/keeshond/internal/app/registry"
+	"github.com/datacite/keeshond/internal/app/robots"
 	"github.com/datacite/keeshond/internal/app/session"
 	"github.com/datacite/keeshond/internal/app/stats"
 	"github.com/go-chi/chi/v5"
@@ -30,21 +39,41 @@ type Http struct {
 	tokenAuth *jwtauth.JWTAuth
 
 	eventServiceDB *event.EventService
+	eventBuffer    *event.BufferedEventRepository
+
+	sessionService *session.SessionService
 
 	statsService *stats.StatsService
+
+	registryService *registry.RegistryService
+
+	robotsService *robots.RobotsService
+
+	// Nil when no machine agents list is configured
+	machineService *robots.RobotsService
+
+	locator *geoip.MMDBLocator
+
+	// Stops background jobs such as salt rotation and robots list reloading
+	cancel context.CancelFunc
 }
 
 type ErrorResponse struct {
 	Error string `json:"error"`
 }
 
-func NewHttpServer(config *app.Config, db *gorm.DB) *Http {
+func NewHttpServer(config *app.Config, db *gorm.DB) (*Http, error) {
 
 	tokenAuth := auth.GetAuthToken(config)
 
 	// Create a new server that wraps the net/http server & add a router.
 	s := &Http{
-		server:    &http.Server{},
+		server: &http.Server{
+			ReadTimeout:       config.HTTP.ReadTimeout,
+			ReadHeaderTimeout: config.HTTP.ReadHeaderTimeout,
+			WriteTimeout:      config.HTTP.WriteTimeout,
+			IdleTimeout:       config.HTTP.IdleTimeout,
+		},
 		router:    chi.NewRouter(),
 		config:    config,
 		db:        db,
@@ -55,6 +84,8 @@ func NewHttpServer(config *app.Config, db *gorm.DB) *Http {
 	s.router.Use(middleware.RealIP)
 	s.router.Use(middleware.Logger)
 	s.router.Use(middleware.Recoverer)
+	s.router.Use(metrics.Middleware)
+	s.router.Use(middleware.RequestSize(config.HTTP.MaxBodyBytes))
 
 	s.router.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"*"},
@@ -65,13 +96,66 @@ func NewHttpServer(config *app.Config, db *gorm.DB) *Http {
 		MaxAge:           300, // Maximum value not ignored by any of major browsers
 	}))
 
+	// Background jobs run until the server is shut down
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+
 	// Register repositories and services
 	eventRepositoryDB := event.NewEventRepository(s.db, config)
 
+	// Optionally queue events in memory and insert them in batches
+	var eventRepository event.EventRepositoryReader = eventRepositoryDB
+	if config.EventBuffer.Enabled {
+		s.eventBuffer = event.NewBufferedEventRepository(eventRepositoryDB, config)
+		eventRepository = s.eventBuffer
+
+		metrics.RegisterGaugeFunc("event_buffer_depth", "Events waiting in the buffer to be written.", func() float64 {
+			return float64(s.eventBuffer.Stats().Depth)
+		})
+		metrics.RegisterGaugeFunc("robot_event_buffer_depth", "Robot events waiting in the buffer to be written.", func() float64 {
+			return float64(s.eventBuffer.RobotStats().Depth)
+		})
+	}
+
 	sessionRepository := session.NewSessionRepository(s.db, config)
 	sessionService := session.NewSessionService(sessionRepository, config)
 
-	eventServiceDB := event.NewEventService(eventRepositoryDB, sessionService, config)
+	// Get the salt for today ready, it is then rotated every UTC midnight
+	if err := sessionService.Rotate(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to rotate salt: %w", err)
+	}
+	go sessionService.Run(ctx)
+	s.sessionService = sessionService
+
+	eventServiceDB := event.NewEventService(eventRepository, sessionService, config)
+
+	// Optionally look up the country of events from a local GeoIP database
+	if config.GeoIP.Path != "" {
+		locator, err := geoip.NewMMDBLocator(config.GeoIP.Path)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("failed to open GeoIP database %s: %w", config.GeoIP.Path, err)
+		}
+		eventServiceDB.SetLocator(locator)
+		s.locator = locator
+	}
+
+	// Confirm or quarantine events that were accepted before validation, this
+	// runs without asynchronous validation too so events left pending when it
+	// was turned off do not hold back the rollup
+	go event.NewAsyncValidator(eventRepositoryDB, eventServiceDB, config).Run(ctx)
+
+	// Load the registered repositories for their settings, they are then
+	// reloaded so changes made through other replicas are picked up
+	registryService := registry.NewRegistryService(registry.NewRegistryRepository(s.db), config)
+	if err := registryService.Load(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to load registered repositories: %w", err)
+	}
+	go registryService.Run(ctx)
+	eventServiceDB.SetRepositorySettings(registryService.Settings)
+	s.registryService = registryService
 
 	statsRepository := stats.NewStatsRepository(s.db)
 	statsService := stats.NewStatsService(statsRepository)
@@ -79,11 +163,36 @@ func NewHttpServer(config *app.Config, db *gorm.DB) *Http {
 
 	s.eventServiceDB = eventServiceDB
 
+	// Load the COUNTER robots list once, it is then reloaded when it changes
+	robotsService := robots.NewRobotsService(robots.NewRobotsFileRepository(config.Robots.Path), config)
+	if err := robotsService.Load(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to load robots list from %s: %w", config.Robots.Path, err)
+	}
+	go robotsService.Watch(ctx)
+	s.robotsService = robotsService
+
+	// Load the list of API clients and scripts counted as machine access
+	if config.Robots.MachinePath != "" {
+		machineService := robots.NewMachineService(robots.NewRobotsFileRepository(config.Robots.MachinePath), config)
+		if err := machineService.Load(); err != nil {
+			cancel()
+			return nil, fmt.Errorf("failed to load machine agents list from %s: %w", config.Robots.MachinePath, err)
+		}
+		go machineService.Watch(ctx)
+		s.machineService = machineService
+	}
+
 	// Register routes.
 	s.router.Get("/heartbeat", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("ok"))
 	})
 
+	s.router.Get("/livez", s.livez)
+	s.router.Get("/readyz", s.readyz)
+
+	s.router.Handle("/metrics", metrics.Handler())
+
 	s.router.Get("/api/check/{repoId}", s.check)
 
 	s.router.Post("/api/metric", s.createMetric)
@@ -96,38 +205,117 @@ func NewHttpServer(config *app.Config, db *gorm.DB) *Http {
 		r.Get("/api/stats/aggregate/{repoId}", s.getAggregate)
 		r.Get("/api/stats/timeseries/{repoId}", s.getTimeseries)
 		r.Get("/api/stats/breakdown/{repoId}", s.getBreakdown)
+		r.Get("/api/stats/traffic/{repoId}", s.getTraffic)
+	})
+
+	// Admin routes
+	s.router.Group(func(r chi.Router) {
+		r.Use(jwtauth.Verifier(s.tokenAuth))
+		r.Use(jwtauth.Authenticator(s.tokenAuth))
+		r.Use(auth.RequireAdmin)
+
+		r.Get("/api/admin/repositories", s.listRepositories)
+		r.Post("/api/admin/repositories", s.createRepository)
+		r.Get("/api/admin/repositories/{repoId}", s.getRepository)
+		r.Put("/api/admin/repositories/{repoId}", s.updateRepository)
+		r.Delete("/api/admin/repositories/{repoId}", s.deleteRepository)
 	})
 
 	s.server.Handler = s.router
 
-	return s
+	return s, nil
 }
 
 // Open validates the server options and begins listening on the bind address.
+// It blocks until SIGTERM or SIGINT is received and the server is shut down.
 func (s *Http) Open() (err error) {
 	s.server.Addr = s.config.HTTP.Addr
 
-	log.Println("Server starting, listening on", s.config.HTTP.Addr)
-	return s.server.ListenAndServe()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Println("Server starting, listening on", s.config.HTTP.Addr)
+		serveErr <- s.server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		// Could not listen, nothing is in flight so just stop background jobs
+		s.cancel()
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutdown signal received, draining requests")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.HTTP.ShutdownTimeout)
+	defer cancel()
+
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+
+	log.Println("Server stopped")
+	return nil
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests, then
+// stops background jobs, writes any buffered events and closes the database
+// pool. Anything not done when the context ends is abandoned.
+func (s *Http) Shutdown(ctx context.Context) error {
+	var errs []error
+
+	if err := s.server.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to drain requests: %w", err))
+	}
+
+	s.cancel()
+
+	if s.eventBuffer != nil {
+		if err := s.eventBuffer.Close(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to drain event buffer: %w", err))
+		}
+	}
+
+	if s.locator != nil {
+		if err := s.locator.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close GeoIP database: %w", err))
+		}
+	}
+
+	if sqlDB, err := s.db.DB(); err == nil {
+		if err := sqlDB.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close database: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
 }
 
 // Get remote IP Address
 func getRemoteAddr(r *http.Request) string {
 	// X-Forwarded-For: client, proxy1, proxy2, ...
-	remoteAddr := strings.Split(r.Header.Get("X-Forwarded-For"), ",")[0]
+	remoteAddr := strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-For"), ",")[0])
 	if remoteAddr == "" {
 		remoteAddr = r.RemoteAddr
 	}
 
-	remoteAddr = strings.Split(remoteAddr, ":")[0]
-	return remoteAddr
+	// The port is removed when there is one, IPv6 addresses with a port are
+	// in brackets
+	if host, _, err := stdnet.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return strings.Trim(remoteAddr, "[]")
 }
 
 type MetricRequest struct {
-	Name   string `json:"n"`
-	RepoId string `json:"i"`
-	Url    string `json:"u"`
-	Pid    string `json:"p"`
+	Name         string `json:"n"`
+	RepoId       string `json:"i"`
+	Url          string `json:"u"`
+	Pid          string `json:"p"`
+	AccessMethod string `json:"a"`
 }
 
 func (s *Http) check(w http.ResponseWriter, r *http.Request) {
@@ -145,32 +333,6 @@ func (s *Http) check(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(result.Timestamp.Format("2006-01-02T15:04:05Z")))
 }
 
-// Function to check if useragent is a bot
-func isBot(userAgent string) bool {
-	// Read file with known bots
-	bots, err := ioutil.ReadFile("data/COUNTER_Robots_list.json")
-
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Read json file which is a list of objects containing pattern and last changed date
-	var botsList []map[string]interface{}
-	json.Unmarshal(bots, &botsList)
-
-	// Loop through list of bots and check if useragent matches pattern
-	for _, bot := range botsList {
-		pattern := bot["pattern"].(string)
-		regex := regexp.MustCompile("(?i)" + pattern)
-
-		if regex.MatchString(userAgent) {
-			return true
-		}
-	}
-
-	return false
-}
-
 func (s *Http) createMetric(w http.ResponseWriter, r *http.Request) {
 	// Metric request is different to a eventRequest as only some data comes
 	// from the json body
@@ -178,13 +340,15 @@ func (s *Http) createMetric(w http.ResponseWriter, r *http.Request) {
 
 	// Marshal json to metric
 	if err := json.NewDecoder(r.Body).Decode(&metricRequest); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			metrics.Events.WithLabelValues(metrics.UnknownRepo, metrics.OutcomeTooLarge).Inc()
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
 
-	// Return a bad request if useragent is a bot
-	if isBot(r.UserAgent()) {
-		http.Error(w, "Event request denied due to known bot", http.StatusForbidden)
+		metrics.Events.WithLabelValues(metrics.UnknownRepo, metrics.OutcomeBadRequest).Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -199,10 +363,40 @@ func (s *Http) createMetric(w http.ResponseWriter, r *http.Request) {
 		Useragent: r.UserAgent(),
 		ClientIp:  clientIp,
 		Pid:       metricRequest.Pid,
+
+		AccessMethod: metricRequest.AccessMethod,
+	}
+
+	// API clients and scripts are machine access, they are counted even when
+	// they are on the robots list too
+	isMachine := false
+	if s.machineService != nil {
+		_, isMachine = s.machineService.Match(r.UserAgent())
+	}
+	if isMachine {
+		eventRequest.AccessMethod = event.AccessMachine
+	}
+
+	// Record and deny the request if useragent is a bot
+	if robot, isBot := s.robotsService.Match(r.UserAgent()); isBot && !isMachine {
+		s.eventServiceDB.CountEvent(eventRequest.RepoId, metrics.OutcomeBot)
+
+		if _, err := s.eventServiceDB.CreateRobotEvent(&eventRequest, robot.Pattern); err != nil {
+			log.Printf("Failed to record robot event: %v", err)
+		}
+
+		http.Error(w, "Event request denied due to known bot", http.StatusForbidden)
+		return
 	}
 
 	// Validate Event Request
 	if err := s.eventServiceDB.Validate(&eventRequest); err != nil {
+		// DataCite could not be reached so the tracker should retry later
+		if errors.Is(err, event.ErrValidationUnavailable) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
 		// Format error message
 		errorMessage := fmt.Sprintf("%s - %s, Usage stats cannot be processed", eventRequest.Pid, err.Error())
 
@@ -213,12 +407,28 @@ func (s *Http) createMetric(w http.ResponseWriter, r *http.Request) {
 
 	// Create event db
 	if _, err := s.eventServiceDB.CreateEvent(&eventRequest); err != nil {
+		// Let the tracker know to back off when the event queue is full
+		if errors.Is(err, event.ErrEventBufferFull) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		if errors.Is(err, pid.ErrInvalidDOI) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
 // Take an error and return a json response
 func errorResponse(w http.ResponseWriter, err error) {
+	errorStatusResponse(w, err, http.StatusBadRequest)
+}
+
+// Take an error and return a json response with the status
+func errorStatusResponse(w http.ResponseWriter, err error, status int) {
 	// Create error response
 	errorResponse := ErrorResponse{
 		Error: err.Error(),
@@ -229,7 +439,7 @@ func errorResponse(w http.ResponseWriter, err error) {
 
 	// Write error response to response writer
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusBadRequest)
+	w.WriteHeader(status)
 	w.Write(jsonResponse)
 }
 
@@ -245,9 +455,16 @@ func (s *Http) getAggregate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	filters, err := stats.ParseFilters(r.URL.Query().Get("filters"))
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+
 	query := stats.Query{
-		Start: startDate,
-		End:   endDate,
+		Start:   startDate,
+		End:     endDate,
+		Filters: filters,
 	}
 
 	// Get total views for a repository in query period
@@ -277,10 +494,17 @@ func (s *Http) getTimeseries(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	filters, err := stats.ParseFilters(r.URL.Query().Get("filters"))
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+
 	query := stats.Query{
 		Start:    startDate,
 		End:      endDate,
 		Interval: interval,
+		Filters:  filters,
 	}
 
 	// Get total views for a repository in query period
@@ -319,13 +543,64 @@ func (s *Http) getBreakdown(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	filters, err := stats.ParseFilters(r.URL.Query().Get("filters"))
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+
+	query := stats.Query{
+		Start:   startDate,
+		End:     endDate,
+		Filters: filters,
+	}
+
+	// Break down by pid unless other properties are asked for, dimension is
+	// the older name of a single property
+	property := r.URL.Query().Get("property")
+	if property == "" {
+		property = r.URL.Query().Get("dimension")
+	}
+	if property == "" {
+		property = stats.DimensionPid
+	}
+
+	breakdown, err := stats.ParseBreakdown(property, r.URL.Query().Get("sort"))
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+
+	// Put results inside results object
+	data := make(map[string]interface{})
+	data["results"] = s.statsService.Breakdown(repoId, query, breakdown, page, pageSize)
+
+	// Set json response headers
+	w.Header().Set("Content-Type", "application/json")
+
+	// Serialise results but put inside a json object
+	json.NewEncoder(w).Encode(data)
+}
+
+func (s *Http) getTraffic(w http.ResponseWriter, r *http.Request) {
+	repoId := chi.URLParam(r, "repoId")
+	period := r.URL.Query().Get("period")
+	date := r.URL.Query().Get("date")
+
+	startDate, endDate, err := stats.ParsePeriodString(period, date)
+
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+
 	query := stats.Query{
 		Start: startDate,
 		End:   endDate,
 	}
 
-	// Get total views for a repository based on query
-	results := s.statsService.BreakdownByPID(repoId, query, page, pageSize)
+	// Get human and robot traffic for a repository in query period
+	results := s.statsService.Traffic(repoId, query)
 
 	// Put results inside results object
 	data := make(map[string]interface{})
@@ -337,3 +612,96 @@ func (s *Http) getBreakdown(w http.ResponseWriter, r *http.Request) {
 	// Serialise results but put inside a json object
 	json.NewEncoder(w).Encode(data)
 }
+
+// Return a registry error with the status matching it
+func registryErrorResponse(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, registry.ErrNotFound):
+		errorStatusResponse(w, err, http.StatusNotFound)
+	case errors.Is(err, registry.ErrExists):
+		errorStatusResponse(w, err, http.StatusConflict)
+	case errors.Is(err, registry.ErrInvalid):
+		errorStatusResponse(w, err, http.StatusBadRequest)
+	default:
+		errorStatusResponse(w, err, http.StatusInternalServerError)
+	}
+}
+
+// Serialise a registered repository as the response
+func repositoryResponse(w http.ResponseWriter, repository registry.Repository, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(repository)
+}
+
+func (s *Http) listRepositories(w http.ResponseWriter, r *http.Request) {
+	repositories, err := s.registryService.List()
+	if err != nil {
+		registryErrorResponse(w, err)
+		return
+	}
+
+	// Put results inside results object
+	data := make(map[string]interface{})
+	data["results"] = repositories
+
+	// Set json response headers
+	w.Header().Set("Content-Type", "application/json")
+
+	// Serialise results but put inside a json object
+	json.NewEncoder(w).Encode(data)
+}
+
+func (s *Http) getRepository(w http.ResponseWriter, r *http.Request) {
+	repository, err := s.registryService.Get(chi.URLParam(r, "repoId"))
+	if err != nil {
+		registryErrorResponse(w, err)
+		return
+	}
+
+	repositoryResponse(w, repository, http.StatusOK)
+}
+
+func (s *Http) createRepository(w http.ResponseWriter, r *http.Request) {
+	var repository registry.Repository
+	if err := json.NewDecoder(r.Body).Decode(&repository); err != nil {
+		errorResponse(w, err)
+		return
+	}
+
+	created, err := s.registryService.Create(repository)
+	if err != nil {
+		registryErrorResponse(w, err)
+		return
+	}
+
+	repositoryResponse(w, created, http.StatusCreated)
+}
+
+func (s *Http) updateRepository(w http.ResponseWriter, r *http.Request) {
+	var repository registry.Repository
+	if err := json.NewDecoder(r.Body).Decode(&repository); err != nil {
+		errorResponse(w, err)
+		return
+	}
+
+	// The repo id can not be changed, the one in the path is used
+	repository.RepoId = chi.URLParam(r, "repoId")
+
+	updated, err := s.registryService.Update(repository)
+	if err != nil {
+		registryErrorResponse(w, err)
+		return
+	}
+
+	repositoryResponse(w, updated, http.StatusOK)
+}
+
+func (s *Http) deleteRepository(w http.ResponseWriter, r *http.Request) {
+	if err := s.registryService.Delete(chi.URLParam(r, "repoId")); err != nil {
+		registryErrorResponse(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,35 @@
+package net
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetRemoteAddr(t *testing.T) {
+	tests := []struct {
+		remoteAddr   string
+		forwardedFor string
+		want         string
+	}{
+		{"81.2.69.160:52000", "", "81.2.69.160"},
+		{"[2001:218:85a3::1]:52000", "", "2001:218:85a3::1"},
+		{"10.0.0.1:52000", "81.2.69.160, 10.0.0.2", "81.2.69.160"},
+		{"10.0.0.1:52000", "2001:218:85a3::1, 10.0.0.2", "2001:218:85a3::1"},
+		{"10.0.0.1:52000", "[2001:218:85a3::1]:443", "2001:218:85a3::1"},
+		{"10.0.0.1:52000", "[2001:218:85a3::1]", "2001:218:85a3::1"},
+		{"10.0.0.1:52000", "81.2.69.160:443", "81.2.69.160"},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodPost, "/api/metric", nil)
+		request.RemoteAddr = test.remoteAddr
+		if test.forwardedFor != "" {
+			request.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+
+		if got := getRemoteAddr(request); got != test.want {
+			t.Errorf("Client ip of %q forwarded for %q should be %q but got %q", test.remoteAddr, test.forwardedFor, test.want, got)
+		}
+	}
+}
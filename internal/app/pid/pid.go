@@ -0,0 +1,147 @@
+package pid
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var ErrInvalidDOI = errors.New("this DOI is not valid, expected 10.<prefix>/<suffix>")
+
+// Type of a persistent identifier, stored with each event
+type Type string
+
+const (
+	DOI    Type = "doi"
+	Handle Type = "handle"
+	ARK    Type = "ark"
+	URN    Type = "urn"
+	URL    Type = "url"
+)
+
+// A persistent identifier in its normalised form
+type PID struct {
+	Type  Type
+	Value string
+}
+
+// Resolver and scheme prefixes that are stripped so the same identifier is
+// always stored the same way
+var (
+	doiPrefixes = []string{
+		"https://doi.org/", "http://doi.org/",
+		"https://dx.doi.org/", "http://dx.doi.org/",
+		"https://www.doi.org/", "http://www.doi.org/",
+		"doi.org/", "dx.doi.org/",
+		"info:doi/", "doi:",
+	}
+	handlePrefixes = []string{"https://hdl.handle.net/", "http://hdl.handle.net/", "hdl:"}
+)
+
+var (
+	// DOIs are handles with the 10 prefix, the registrant code has at least
+	// four digits and the suffix any printable characters
+	doiPattern    = regexp.MustCompile(`^10\.[0-9]{4,9}(\.[0-9]+)*/[[:graph:]]+$`)
+	handlePattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*/.+$`)
+	// ARKs can be given with any resolver in front, e.g. https://n2t.net/ark:/
+	arkPattern = regexp.MustCompile(`(?i)^(?:https?://[^/]+/)?ark:/?([0-9a-z]+)/(.+)$`)
+	urnPattern = regexp.MustCompile(`(?i)^urn:([a-z0-9][a-z0-9-]{0,31}):(.+)$`)
+)
+
+// Parse detects the type of the identifier and normalises it. DOIs and
+// Handles are case insensitive so they are lowercased, for ARKs and URNs only
+// the scheme, NAAN and namespace are. Anything else is treated as a URL and
+// kept as it is.
+//
+// Anything given as a DOI, with a DOI prefix or starting with 10., must be a
+// valid DOI once canonicalised or ErrInvalidDOI is returned.
+func Parse(raw string) (PID, error) {
+	value := strings.TrimSpace(raw)
+
+	if doi, ok := stripPrefix(value, doiPrefixes); ok || strings.HasPrefix(doi, "10.") {
+		return parseDOI(doi)
+	}
+
+	handle, ok := stripPrefix(value, handlePrefixes)
+	// Handles with the 10 prefix are DOIs given through the handle resolver
+	if ok && strings.HasPrefix(handle, "10.") {
+		return parseDOI(handle)
+	}
+	if handlePattern.MatchString(handle) {
+		return PID{Type: Handle, Value: strings.ToLower(handle)}, nil
+	}
+
+	if match := arkPattern.FindStringSubmatch(value); match != nil {
+		return PID{Type: ARK, Value: "ark:/" + strings.ToLower(match[1]) + "/" + match[2]}, nil
+	}
+
+	if match := urnPattern.FindStringSubmatch(value); match != nil {
+		return PID{Type: URN, Value: "urn:" + strings.ToLower(match[1]) + ":" + match[2]}, nil
+	}
+
+	return PID{Type: URL, Value: value}, nil
+}
+
+// parseDOI canonicalises a DOI with its prefix removed, DOIs copied from urls
+// often have their slash encoded.
+func parseDOI(value string) (PID, error) {
+	doi := strings.TrimSpace(value)
+
+	if strings.Contains(doi, "%") {
+		unescaped, err := url.PathUnescape(doi)
+		if err != nil {
+			return PID{Type: DOI, Value: strings.ToLower(doi)}, ErrInvalidDOI
+		}
+		doi = unescaped
+	}
+
+	doi = strings.ToLower(doi)
+
+	if !doiPattern.MatchString(doi) {
+		return PID{Type: DOI, Value: doi}, ErrInvalidDOI
+	}
+
+	return PID{Type: DOI, Value: doi}, nil
+}
+
+// Normalize returns the normalised form of the identifier, invalid DOIs are
+// canonicalised as far as they can be
+func Normalize(raw string) string {
+	identifier, _ := Parse(raw)
+	return identifier.Value
+}
+
+// Detect returns the type of the identifier
+func Detect(raw string) Type {
+	identifier, _ := Parse(raw)
+	return identifier.Type
+}
+
+// CounterType is the identifier type used for the dataset in COUNTER reports
+func (t Type) CounterType() string {
+	switch t {
+	case DOI:
+		return "DOI"
+	case Handle:
+		return "Handle"
+	case ARK:
+		return "ARK"
+	case URN:
+		return "URN"
+	default:
+		return "URI"
+	}
+}
+
+// stripPrefix removes the first matching prefix ignoring case, it reports
+// whether one was found
+func stripPrefix(value string, prefixes []string) (string, bool) {
+	lower := strings.ToLower(value)
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(lower, prefix) {
+			return value[len(prefix):], true
+		}
+	}
+	return value, false
+}
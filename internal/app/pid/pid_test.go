@@ -0,0 +1,85 @@
+package pid
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want PID
+	}{
+		{"10.5072/ABC", PID{DOI, "10.5072/abc"}},
+		{"https://doi.org/10.5072/ABC", PID{DOI, "10.5072/abc"}},
+		{"HTTP://DOI.ORG/10.5072/abc", PID{DOI, "10.5072/abc"}},
+		{" 10.5072/abc ", PID{DOI, "10.5072/abc"}},
+		{"doi:10.5072/ABC", PID{DOI, "10.5072/abc"}},
+		{"DOI: 10.5072/abc", PID{DOI, "10.5072/abc"}},
+		{"info:doi/10.5072/abc", PID{DOI, "10.5072/abc"}},
+		{"https://dx.doi.org/10.5072/abc", PID{DOI, "10.5072/abc"}},
+		{"dx.doi.org/10.5072/abc", PID{DOI, "10.5072/abc"}},
+		{"10.5072%2FABC", PID{DOI, "10.5072/abc"}},
+		{"https://doi.org/10.5072%2fABC%3Adef", PID{DOI, "10.5072/abc:def"}},
+		{"https://hdl.handle.net/10.5072/abc", PID{DOI, "10.5072/abc"}},
+		{"20.500.12345/Item-1", PID{Handle, "20.500.12345/item-1"}},
+		{"hdl:20.500.12345/item-1", PID{Handle, "20.500.12345/item-1"}},
+		{"https://hdl.handle.net/2027/mdp.39015", PID{Handle, "2027/mdp.39015"}},
+		{"ark:/13030/tf5p30086k", PID{ARK, "ark:/13030/tf5p30086k"}},
+		{"ARK:13030/TF5p30086k", PID{ARK, "ark:/13030/TF5p30086k"}},
+		{"https://n2t.net/ark:/13030/tf5p30086k", PID{ARK, "ark:/13030/tf5p30086k"}},
+		{"urn:nbn:de:101:1-201102033592", PID{URN, "urn:nbn:de:101:1-201102033592"}},
+		{"URN:NBN:de:101:1-201102033592", PID{URN, "urn:nbn:de:101:1-201102033592"}},
+		{"https://example.org/datasets/1", PID{URL, "https://example.org/datasets/1"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.raw, func(t *testing.T) {
+			got, err := Parse(test.raw)
+			if err != nil {
+				t.Fatalf("Parse(%q) returned %v", test.raw, err)
+			}
+			if got != test.want {
+				t.Errorf("Parse(%q) = %+v, want %+v", test.raw, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseIsStable(t *testing.T) {
+	// Stored identifiers are parsed again for reports so must keep their type
+	for _, raw := range []string{"https://doi.org/10.5072/ABC", "hdl:20.500.1/x", "https://n2t.net/ark:/13030/x", "URN:ISBN:0451450523"} {
+		first, _ := Parse(raw)
+		if second, _ := Parse(first.Value); second != first {
+			t.Errorf("Parsing %q again gave %+v, want %+v", first.Value, second, first)
+		}
+	}
+}
+
+func TestParseRejectsInvalidDOIs(t *testing.T) {
+	for _, raw := range []string{
+		"10.5072",
+		"10.5072/",
+		"10.12/abc",
+		"10.abcd/abc",
+		"doi:abc",
+		"https://doi.org/",
+		"10.5072%2",
+		"10.5072/abc def",
+		"https://hdl.handle.net/10.5072/",
+	} {
+		if _, err := Parse(raw); !errors.Is(err, ErrInvalidDOI) {
+			t.Errorf("Parse(%q) should return ErrInvalidDOI but got %v", raw, err)
+		}
+	}
+}
+
+func TestCounterType(t *testing.T) {
+	tests := map[Type]string{DOI: "DOI", Handle: "Handle", ARK: "ARK", URN: "URN", URL: "URI"}
+
+	for pidType, want := range tests {
+		if got := pidType.CounterType(); got != want {
+			t.Errorf("CounterType of %s = %s, want %s", pidType, got, want)
+		}
+	}
+}
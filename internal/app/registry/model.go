@@ -0,0 +1,21 @@
+package registry
+
+import "time"
+
+// Repository is a repository registered to track usage. The client-id is the
+// DataCite client of the repository and is reported as the publisher id.
+type Repository struct {
+	RepoId    string `json:"repo_id"`
+	ClientId  string `json:"client_id"`
+	Publisher string `json:"publisher"` // Name of the repository in reports
+	Platform  string `json:"platform"`
+	// Domains events may be recorded at including their subdomains, any
+	// domain is allowed when empty
+	AllowedDomains []string `json:"allowed_domains" gorm:"type:Array(String)"`
+	// Validation settings, the configured default is used when null
+	ValidateDoiExistence *bool     `json:"validate_doi_existence"`
+	ValidateDoiUrl       *bool     `json:"validate_doi_url"`
+	ReportingEnabled     bool      `json:"reporting_enabled"`
+	Updated              time.Time `json:"updated"`
+	Deleted              bool      `json:"-"`
+}
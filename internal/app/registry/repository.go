@@ -0,0 +1,57 @@
+package registry
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+type RegistryRepositoryReader interface {
+	Save(repository *Repository) error
+	Get(repoId string) (Repository, error)
+	List() ([]Repository, error)
+}
+
+type RegistryRepository struct {
+	db *gorm.DB
+}
+
+func NewRegistryRepository(db *gorm.DB) *RegistryRepository {
+	return &RegistryRepository{
+		db: db,
+	}
+}
+
+// Save inserts a new version of the repository, the latest version replaces
+// the earlier ones
+func (repository *RegistryRepository) Save(registered *Repository) error {
+	return repository.db.Create(registered).Error
+}
+
+// Get returns the latest version of a repository, ErrNotFound is returned
+// when it is not registered or was deleted
+func (repository *RegistryRepository) Get(repoId string) (Repository, error) {
+	var registered Repository
+	err := repository.db.
+		Table("repositories FINAL").
+		Where("repo_id = ?", repoId).
+		Where("NOT deleted").
+		Take(&registered).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return Repository{}, ErrNotFound
+	}
+
+	return registered, err
+}
+
+// List returns the latest version of every registered repository by repo id
+func (repository *RegistryRepository) List() ([]Repository, error) {
+	var registered []Repository
+	err := repository.db.
+		Table("repositories FINAL").
+		Where("NOT deleted").
+		Order("repo_id").
+		Find(&registered).Error
+	return registered, err
+}
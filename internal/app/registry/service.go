@@ -0,0 +1,266 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/datacite/keeshond/internal/app"
+	"github.com/datacite/keeshond/internal/app/event"
+	"github.com/datacite/keeshond/internal/app/reports"
+)
+
+var ErrNotFound = errors.New("repository is not registered")
+
+var ErrExists = errors.New("repository is already registered")
+
+var ErrInvalid = errors.New("repository is not valid")
+
+var ErrReportingDisabled = errors.New("reporting is not enabled for the repository")
+
+// RegistryService manages the registered repositories. The settings events
+// are checked with are kept in memory, see Load.
+type RegistryService struct {
+	repository     RegistryRepositoryReader
+	reloadInterval time.Duration
+	now            func() time.Time
+
+	// Registered repositories by repo id, nil until loaded
+	repositories atomic.Pointer[map[string]Repository]
+}
+
+func NewRegistryService(repository RegistryRepositoryReader, config *app.Config) *RegistryService {
+	return &RegistryService{
+		repository:     repository,
+		reloadInterval: config.Registry.ReloadInterval,
+		now:            time.Now,
+	}
+}
+
+// Create registers a new repository
+func (service *RegistryService) Create(repository Repository) (Repository, error) {
+	if _, err := service.repository.Get(repository.RepoId); err == nil {
+		return Repository{}, fmt.Errorf("%w: %s", ErrExists, repository.RepoId)
+	} else if !errors.Is(err, ErrNotFound) {
+		return Repository{}, err
+	}
+
+	return service.save(repository)
+}
+
+// Update replaces the details and settings of a registered repository
+func (service *RegistryService) Update(repository Repository) (Repository, error) {
+	if _, err := service.Get(repository.RepoId); err != nil {
+		return Repository{}, err
+	}
+
+	return service.save(repository)
+}
+
+// Get returns a registered repository
+func (service *RegistryService) Get(repoId string) (Repository, error) {
+	repository, err := service.repository.Get(repoId)
+	if errors.Is(err, ErrNotFound) {
+		return Repository{}, fmt.Errorf("%w: %s", ErrNotFound, repoId)
+	}
+	return repository, err
+}
+
+// List returns every registered repository
+func (service *RegistryService) List() ([]Repository, error) {
+	return service.repository.List()
+}
+
+// Delete removes a registered repository, its usage is kept
+func (service *RegistryService) Delete(repoId string) error {
+	repository, err := service.Get(repoId)
+	if err != nil {
+		return err
+	}
+
+	repository.Deleted = true
+	repository.Updated = service.now()
+
+	if err := service.repository.Save(&repository); err != nil {
+		return err
+	}
+
+	service.cache(repository)
+
+	return nil
+}
+
+func (service *RegistryService) save(repository Repository) (Repository, error) {
+	if err := normalise(&repository); err != nil {
+		return Repository{}, err
+	}
+
+	repository.Deleted = false
+	repository.Updated = service.now()
+
+	if err := service.repository.Save(&repository); err != nil {
+		return Repository{}, err
+	}
+
+	service.cache(repository)
+
+	return repository, nil
+}
+
+// normalise checks the repository can be registered and puts the allowed
+// domains in the form events are matched against
+func normalise(repository *Repository) error {
+	if repository.RepoId == "" {
+		return fmt.Errorf("%w: repo_id is required", ErrInvalid)
+	}
+
+	if repository.ClientId == "" {
+		return fmt.Errorf("%w: client_id is required", ErrInvalid)
+	}
+
+	// Reports can not be sent without them
+	if repository.ReportingEnabled && (repository.Publisher == "" || repository.Platform == "") {
+		return fmt.Errorf("%w: publisher and platform are required when reporting is enabled", ErrInvalid)
+	}
+
+	domains := []string{}
+	seen := make(map[string]bool)
+	for _, domain := range repository.AllowedDomains {
+		domain = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(domain)), "www.")
+		if domain == "" || strings.ContainsAny(domain, "/: ") {
+			return fmt.Errorf("%w: allowed domain %q is not a domain name", ErrInvalid, domain)
+		}
+
+		if !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+	repository.AllowedDomains = domains
+
+	return nil
+}
+
+// SharedData returns the details of a repository used in its reports, fields
+// set in the override are used instead of the registered ones. A repository
+// that is not registered can still be reported on when every field is given.
+func (service *RegistryService) SharedData(repoId string, override reports.SharedData) (reports.SharedData, error) {
+	repository, err := service.Get(repoId)
+
+	if errors.Is(err, ErrNotFound) {
+		if override.Platform != "" && override.Publisher != "" && override.PublisherId != "" {
+			return override, nil
+		}
+		return reports.SharedData{}, err
+	}
+	if err != nil {
+		return reports.SharedData{}, err
+	}
+
+	if !repository.ReportingEnabled {
+		return reports.SharedData{}, fmt.Errorf("%w: %s", ErrReportingDisabled, repoId)
+	}
+
+	sharedData := reports.SharedData{
+		Platform:    repository.Platform,
+		Publisher:   repository.Publisher,
+		PublisherId: repository.ClientId,
+	}
+
+	if override.Platform != "" {
+		sharedData.Platform = override.Platform
+	}
+	if override.Publisher != "" {
+		sharedData.Publisher = override.Publisher
+	}
+	if override.PublisherId != "" {
+		sharedData.PublisherId = override.PublisherId
+	}
+
+	return sharedData, nil
+}
+
+// Load reads every registered repository into memory for Settings, on
+// failure the previously loaded repositories are kept in use.
+func (service *RegistryService) Load() error {
+	registered, err := service.repository.List()
+	if err != nil {
+		return err
+	}
+
+	repositories := make(map[string]Repository, len(registered))
+	for _, repository := range registered {
+		repositories[repository.RepoId] = repository
+	}
+	service.repositories.Store(&repositories)
+
+	return nil
+}
+
+// Run reloads the registered repositories every reload interval so changes
+// made by other replicas are picked up, it blocks until the context is done.
+func (service *RegistryService) Run(ctx context.Context) {
+	if service.reloadInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(service.reloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := service.Load(); err != nil {
+				log.Printf("Failed to reload registered repositories: %v", err)
+			}
+		}
+	}
+}
+
+// cache keeps a change made by this replica in memory without waiting for
+// the next reload
+func (service *RegistryService) cache(repository Repository) {
+	current := service.repositories.Load()
+	if current == nil {
+		return
+	}
+
+	repositories := make(map[string]Repository, len(*current)+1)
+	for repoId, registered := range *current {
+		repositories[repoId] = registered
+	}
+
+	if repository.Deleted {
+		delete(repositories, repository.RepoId)
+	} else {
+		repositories[repository.RepoId] = repository
+	}
+
+	service.repositories.Store(&repositories)
+}
+
+// Settings returns the settings events of a repository are checked with,
+// ok is false when the repository is not registered or Load was not called.
+func (service *RegistryService) Settings(repoId string) (event.RepositorySettings, bool) {
+	repositories := service.repositories.Load()
+	if repositories == nil {
+		return event.RepositorySettings{}, false
+	}
+
+	repository, ok := (*repositories)[repoId]
+	if !ok {
+		return event.RepositorySettings{}, false
+	}
+
+	return event.RepositorySettings{
+		AllowedDomains:       repository.AllowedDomains,
+		ValidateDoiExistence: repository.ValidateDoiExistence,
+		ValidateDoiUrl:       repository.ValidateDoiUrl,
+	}, true
+}
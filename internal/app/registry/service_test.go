@@ -0,0 +1,233 @@
+package registry
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/datacite/keeshond/internal/app"
+	"github.com/datacite/keeshond/internal/app/reports"
+)
+
+// In memory repository keeping only the latest version of each repository
+type MockRegistryRepositoryReader struct {
+	repositories map[string]Repository
+	saves        int
+}
+
+func (m *MockRegistryRepositoryReader) Save(repository *Repository) error {
+	if m.repositories == nil {
+		m.repositories = make(map[string]Repository)
+	}
+	m.repositories[repository.RepoId] = *repository
+	m.saves++
+	return nil
+}
+
+func (m *MockRegistryRepositoryReader) Get(repoId string) (Repository, error) {
+	repository, ok := m.repositories[repoId]
+	if !ok || repository.Deleted {
+		return Repository{}, ErrNotFound
+	}
+	return repository, nil
+}
+
+func (m *MockRegistryRepositoryReader) List() ([]Repository, error) {
+	var repositories []Repository
+	for _, repository := range m.repositories {
+		if !repository.Deleted {
+			repositories = append(repositories, repository)
+		}
+	}
+	sort.Slice(repositories, func(i, j int) bool { return repositories[i].RepoId < repositories[j].RepoId })
+	return repositories, nil
+}
+
+func buildRegistryService() (*RegistryService, *MockRegistryRepositoryReader) {
+	repository := &MockRegistryRepositoryReader{}
+	service := NewRegistryService(repository, &app.Config{})
+	service.now = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+	return service, repository
+}
+
+func exampleRepository() Repository {
+	return Repository{
+		RepoId:           "datacite.demo",
+		ClientId:         "datacite.demo",
+		Publisher:        "Demo Repository",
+		Platform:         "datacite",
+		AllowedDomains:   []string{" Example.org", "www.example.org", "data.example.com"},
+		ReportingEnabled: true,
+	}
+}
+
+func TestRegistryServiceCreateUpdateDelete(t *testing.T) {
+	service, _ := buildRegistryService()
+
+	created, err := service.Create(exampleRepository())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(created.AllowedDomains, []string{"example.org", "data.example.com"}) {
+		t.Errorf("Allowed domains should be normalised and deduplicated but got %v", created.AllowedDomains)
+	}
+	if created.Updated.IsZero() {
+		t.Errorf("Updated should be set when saved")
+	}
+
+	if _, err := service.Create(exampleRepository()); !errors.Is(err, ErrExists) {
+		t.Errorf("Registering the repository twice should fail but got %v", err)
+	}
+
+	changed := exampleRepository()
+	changed.Publisher = "Renamed Repository"
+	if _, err := service.Update(changed); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := service.Get("datacite.demo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Publisher != "Renamed Repository" {
+		t.Errorf("Update should replace the publisher but got %q", got.Publisher)
+	}
+
+	if err := service.Delete("datacite.demo"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := service.Get("datacite.demo"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Deleted repository should not be found but got %v", err)
+	}
+	if _, err := service.Update(changed); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Deleted repository should not be updated but got %v", err)
+	}
+
+	// A deleted repository can be registered again
+	if _, err := service.Create(exampleRepository()); err != nil {
+		t.Errorf("Deleted repository should be registered again but got %v", err)
+	}
+}
+
+func TestRegistryServiceRejectsInvalidRepositories(t *testing.T) {
+	service, repository := buildRegistryService()
+
+	tests := map[string]func(*Repository){
+		"missing repo id":             func(r *Repository) { r.RepoId = "" },
+		"missing client id":           func(r *Repository) { r.ClientId = "" },
+		"reporting without publisher": func(r *Repository) { r.Publisher = "" },
+		"url as domain":               func(r *Repository) { r.AllowedDomains = []string{"https://example.org/"} },
+		"empty domain":                func(r *Repository) { r.AllowedDomains = []string{""} },
+	}
+
+	for name, change := range tests {
+		invalid := exampleRepository()
+		change(&invalid)
+
+		if _, err := service.Create(invalid); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: Create should fail as invalid but got %v", name, err)
+		}
+	}
+
+	if repository.saves != 0 {
+		t.Errorf("Invalid repositories should not be saved but %d were", repository.saves)
+	}
+
+	// Publisher and platform are only needed for reporting
+	unreported := exampleRepository()
+	unreported.Publisher = ""
+	unreported.ReportingEnabled = false
+	if _, err := service.Create(unreported); err != nil {
+		t.Errorf("Repository without reporting should not need a publisher but got %v", err)
+	}
+}
+
+func TestRegistryServiceSharedData(t *testing.T) {
+	service, _ := buildRegistryService()
+
+	if _, err := service.Create(exampleRepository()); err != nil {
+		t.Fatal(err)
+	}
+
+	sharedData, err := service.SharedData("datacite.demo", reports.SharedData{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := reports.SharedData{Platform: "datacite", Publisher: "Demo Repository", PublisherId: "datacite.demo"}
+	if sharedData != expected {
+		t.Errorf("Expected %+v but got %+v", expected, sharedData)
+	}
+
+	// Given fields are used instead of the registered ones
+	sharedData, err = service.SharedData("datacite.demo", reports.SharedData{Publisher: "Other Name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sharedData.Publisher != "Other Name" || sharedData.Platform != "datacite" {
+		t.Errorf("Publisher should be overridden but got %+v", sharedData)
+	}
+
+	// Unregistered repositories need every field
+	if _, err := service.SharedData("unknown", reports.SharedData{Platform: "datacite"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Unregistered repository should not be found but got %v", err)
+	}
+	complete := reports.SharedData{Platform: "datacite", Publisher: "Unknown", PublisherId: "unknown"}
+	if sharedData, err := service.SharedData("unknown", complete); err != nil || sharedData != complete {
+		t.Errorf("Unregistered repository with every field should be reported but got %+v, %v", sharedData, err)
+	}
+
+	disabled := exampleRepository()
+	disabled.ReportingEnabled = false
+	if _, err := service.Update(disabled); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.SharedData("datacite.demo", complete); !errors.Is(err, ErrReportingDisabled) {
+		t.Errorf("Repository with reporting disabled should not be reported but got %v", err)
+	}
+}
+
+func TestRegistryServiceSettings(t *testing.T) {
+	service, repository := buildRegistryService()
+
+	checkUrl := true
+	registered := exampleRepository()
+	registered.ValidateDoiUrl = &checkUrl
+	repository.Save(&registered)
+
+	if _, ok := service.Settings("datacite.demo"); ok {
+		t.Errorf("Settings should not be found before loading")
+	}
+
+	if err := service.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, ok := service.Settings("datacite.demo")
+	if !ok {
+		t.Fatal("Settings should be found once loaded")
+	}
+	if settings.ValidateDoiUrl == nil || !*settings.ValidateDoiUrl || settings.ValidateDoiExistence != nil {
+		t.Errorf("Validation settings should be those registered but got %+v", settings)
+	}
+
+	// Changes made through the service are seen without reloading
+	other := exampleRepository()
+	other.RepoId = "datacite.other"
+	if _, err := service.Create(other); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := service.Settings("datacite.other"); !ok {
+		t.Errorf("Created repository should have settings")
+	}
+
+	if err := service.Delete("datacite.demo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := service.Settings("datacite.demo"); ok {
+		t.Errorf("Deleted repository should not have settings")
+	}
+}
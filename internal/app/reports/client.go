@@ -0,0 +1,233 @@
+package reports
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/datacite/keeshond/internal/app"
+)
+
+// errReportNotFound is returned when the report to update is not in the
+// Reports API
+var errReportNotFound = errors.New("report not found in Reports API")
+
+// ErrMaybeCreated is returned when creating a report failed after the request
+// may have reached the Reports API, sending it again could create a duplicate.
+var ErrMaybeCreated = errors.New("report may have been created in the Reports API")
+
+// ReportsClient sends gzipped reports to the DataCite Reports API. Failures
+// that may pass are retried with an exponential backoff. Updates are retried
+// after network errors, timeouts and 5xx responses, creates only when the
+// request can not have reached the Reports API so no duplicate is made.
+type ReportsClient struct {
+	endpoint   string
+	jwt        string
+	client     *http.Client
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	sleep      func(time.Duration)
+}
+
+func NewReportsClient(config *app.Config) *ReportsClient {
+	retries := config.ReportsAPI.Retries
+	if retries < 0 {
+		retries = 0
+	}
+
+	return &ReportsClient{
+		// config contains the datacite URL, construct reports API URL
+		endpoint: config.DataCite.Url + "/reports",
+		jwt:      config.DataCite.JWT,
+		client: &http.Client{
+			Timeout: config.ReportsAPI.Timeout,
+			Transport: &http.Transport{
+				DisableCompression: true,
+			},
+		},
+		retries:    retries,
+		backoff:    config.ReportsAPI.Backoff,
+		maxBackoff: config.ReportsAPI.MaxBackoff,
+		sleep:      time.Sleep,
+	}
+}
+
+// Submit sends a report and returns the id the Reports API gave it. Without a
+// report id the report is created, with one the existing report is updated in
+// place, or created again when the Reports API no longer has it.
+func (c *ReportsClient) Submit(compressedJson []byte, reportId string) (string, error) {
+	if reportId != "" {
+		id, err := c.send(http.MethodPut, c.endpoint+"/"+url.PathEscape(reportId), compressedJson)
+		if !errors.Is(err, errReportNotFound) {
+			if err == nil && id == "" {
+				id = reportId
+			}
+			return id, err
+		}
+
+		log.Printf("Report %s is not in the Reports API, creating it again", reportId)
+	}
+
+	return c.send(http.MethodPost, c.endpoint, compressedJson)
+}
+
+// send makes the request until it succeeds, fails in a way retrying won't
+// fix, or the retries run out
+func (c *ReportsClient) send(method string, requestUrl string, compressedJson []byte) (string, error) {
+	var id string
+	var err error
+
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		var retry bool
+		var retryAfter time.Duration
+
+		id, retry, retryAfter, err = c.do(method, requestUrl, compressedJson)
+		if !retry || attempt == c.retries {
+			break
+		}
+
+		delay := c.delay(attempt, retryAfter)
+		log.Printf("Sending report to Reports API failed, retrying in %s: %v", delay, err)
+		c.sleep(delay)
+	}
+
+	return id, err
+}
+
+// delay returns how long to wait before the retry after the attempt, doubling
+// each time up to the maximum. A delay asked for by the Reports API is used
+// when it is longer.
+func (c *ReportsClient) delay(attempt int, retryAfter time.Duration) time.Duration {
+	delay := c.backoff
+	for i := 0; i < attempt && (c.maxBackoff <= 0 || delay < c.maxBackoff); i++ {
+		delay *= 2
+	}
+
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	if c.maxBackoff > 0 && delay > c.maxBackoff {
+		delay = c.maxBackoff
+	}
+
+	return delay
+}
+
+// do makes a single request, it reports whether a failure is worth retrying
+// and any delay the Reports API asked for
+func (c *ReportsClient) do(method string, requestUrl string, compressedJson []byte) (string, bool, time.Duration, error) {
+	req, err := http.NewRequest(method, requestUrl, bytes.NewReader(compressedJson))
+	if err != nil {
+		return "", false, 0, err
+	}
+
+	// Set content type to be gzip as report will be compressed
+	req.Header.Set("Content-Type", "application/gzip")
+	// Set content encoding to gzip
+	req.Header.Set("Content-Encoding", "gzip")
+
+	// Add JWT token to request
+	req.Header.Set("Authorization", "Bearer "+c.jwt)
+
+	// Updates replace the same report however often they are sent
+	idempotent := method == http.MethodPut
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		if idempotent || notSent(err) {
+			return "", true, 0, err
+		}
+		return "", false, 0, fmt.Errorf("%w: %v", ErrMaybeCreated, err)
+	}
+
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		log.Printf("Failed to read Reports API response: %v", err)
+	}
+
+	// Check response code
+	switch {
+	case res.StatusCode == http.StatusCreated || res.StatusCode == http.StatusOK:
+		id := reportIdFromResponse(body)
+		if id == "" && !idempotent {
+			// Without an id the report can not be updated later
+			return "", false, 0, errors.New("report created but the Reports API returned no report id")
+		}
+		return id, false, 0, nil
+	case res.StatusCode == http.StatusUnauthorized:
+		return "", false, 0, errors.New("unauthorized, JWT token is missing or invalid")
+	case res.StatusCode == http.StatusForbidden:
+		return "", false, 0, errors.New("forbidden, JWT is expired or invalid")
+	case res.StatusCode == http.StatusNotFound && method == http.MethodPut:
+		return "", false, 0, errReportNotFound
+	case res.StatusCode == http.StatusUnsupportedMediaType:
+		return "", false, 0, errors.New("did not include correct Content-Type header")
+	case res.StatusCode == http.StatusUnprocessableEntity:
+		return "", false, 0, errors.New("invalid report provided")
+	case res.StatusCode == http.StatusTooManyRequests:
+		// Rate limited requests are not processed
+		return "", true, retryAfter(res.Header.Get("Retry-After")), fmt.Errorf("Error sending report to Reports API: %s", res.Status)
+	case res.StatusCode == http.StatusRequestTimeout || res.StatusCode >= 500:
+		if !idempotent {
+			return "", false, 0, fmt.Errorf("%w: %s", ErrMaybeCreated, res.Status)
+		}
+		return "", true, retryAfter(res.Header.Get("Retry-After")), fmt.Errorf("Error sending report to Reports API: %s", res.Status)
+	default:
+		return "", false, 0, fmt.Errorf("Error sending report to Reports API: %s", res.Status)
+	}
+}
+
+// notSent tells whether a request failed before it could reach the Reports
+// API, such as when the connection could not be made
+func notSent(err error) bool {
+	var opError *net.OpError
+	if errors.As(err, &opError) && opError.Op == "dial" {
+		return true
+	}
+
+	var dnsError *net.DNSError
+	return errors.As(err, &dnsError)
+}
+
+// reportIdFromResponse returns the id of the report in the Reports API
+// response, which is either the report or the report wrapped in "report"
+func reportIdFromResponse(body []byte) string {
+	var response struct {
+		Id     string `json:"id"`
+		Report struct {
+			Id string `json:"id"`
+		} `json:"report"`
+	}
+
+	if err := json.Unmarshal(body, &response); err != nil {
+		log.Printf("Reports API response has no report id: %v", err)
+		return ""
+	}
+
+	if response.Report.Id != "" {
+		return response.Report.Id
+	}
+
+	return response.Id
+}
+
+// retryAfter parses a Retry-After header given in seconds, dates are ignored
+func retryAfter(header string) time.Duration {
+	seconds, err := strconv.Atoi(header)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+
+	return time.Duration(seconds) * time.Second
+}
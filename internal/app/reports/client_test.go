@@ -0,0 +1,298 @@
+package reports
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/datacite/keeshond/internal/app"
+)
+
+// Fake Reports API keeping reports in memory. Requests can be made to fail
+// with a status before they are handled.
+type fakeReportsAPI struct {
+	mu       sync.Mutex
+	reports  map[string]string
+	requests []string
+	failures []int
+	header   http.Header
+	// Respond without the id of the report
+	noId bool
+}
+
+func (f *fakeReportsAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	f.header = r.Header.Clone()
+
+	if len(f.failures) > 0 {
+		status := f.failures[0]
+		f.failures = f.failures[1:]
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "30")
+		}
+		w.WriteHeader(status)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	id := strings.TrimPrefix(r.URL.Path, "/reports/")
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/reports":
+		id = fmt.Sprintf("report-%d", len(f.reports)+1)
+		f.reports[id] = string(body)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && f.reports[id] != "":
+		f.reports[id] = string(body)
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if f.noId {
+		id = ""
+	}
+	json.NewEncoder(w).Encode(map[string]any{"report": map[string]string{"id": id}})
+}
+
+// buildReportsClient returns a client of a fake Reports API, the delays it
+// would have waited are recorded instead
+func buildReportsClient(t *testing.T) (*ReportsClient, *fakeReportsAPI, *[]time.Duration) {
+	api := &fakeReportsAPI{reports: make(map[string]string)}
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	config := &app.Config{}
+	config.DataCite.Url = server.URL
+	config.DataCite.JWT = "token"
+	config.ReportsAPI.Timeout = 5 * time.Second
+	config.ReportsAPI.Retries = 3
+	config.ReportsAPI.Backoff = time.Second
+	config.ReportsAPI.MaxBackoff = 10 * time.Second
+
+	var delays []time.Duration
+	client := NewReportsClient(config)
+	client.sleep = func(delay time.Duration) { delays = append(delays, delay) }
+
+	return client, api, &delays
+}
+
+func TestReportsClientCreatesThenUpdates(t *testing.T) {
+	client, api, _ := buildReportsClient(t)
+
+	id, err := client.Submit([]byte("first"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "report-1" {
+		t.Errorf("Expected the id of the created report but got %q", id)
+	}
+
+	if api.header.Get("Authorization") != "Bearer token" || api.header.Get("Content-Encoding") != "gzip" || api.header.Get("Content-Type") != "application/gzip" {
+		t.Errorf("Report sent with unexpected headers %v", api.header)
+	}
+
+	// Sending the report again with its id replaces it
+	id, err = client.Submit([]byte("second"), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "report-1" {
+		t.Errorf("Updated report should keep its id but got %q", id)
+	}
+
+	if !reflect.DeepEqual(api.reports, map[string]string{"report-1": "second"}) {
+		t.Errorf("Report should be updated in place but got %v", api.reports)
+	}
+	if expected := []string{"POST /reports", "PUT /reports/report-1"}; !reflect.DeepEqual(api.requests, expected) {
+		t.Errorf("Expected requests %v but got %v", expected, api.requests)
+	}
+}
+
+func TestReportsClientRetriesTransientFailures(t *testing.T) {
+	client, api, delays := buildReportsClient(t)
+
+	id, err := client.Submit([]byte("first"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api.failures = []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusInternalServerError}
+
+	if _, err := client.Submit([]byte("second"), id); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(api.reports, map[string]string{"report-1": "second"}) {
+		t.Errorf("Report should be updated once after the failures but got %v", api.reports)
+	}
+	if expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}; !reflect.DeepEqual(*delays, expected) {
+		t.Errorf("Expected backoff %v but got %v", expected, *delays)
+	}
+}
+
+func TestReportsClientBackoff(t *testing.T) {
+	client, api, delays := buildReportsClient(t)
+
+	// Rate limited creates are not processed so they are retried, the delay
+	// asked for is used but capped at the maximum backoff
+	api.failures = []int{http.StatusTooManyRequests}
+	id, err := client.Submit([]byte("report"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []time.Duration{10 * time.Second}; !reflect.DeepEqual(*delays, expected) {
+		t.Errorf("Expected backoff %v but got %v", expected, *delays)
+	}
+
+	// Retries run out
+	*delays = nil
+	api.failures = []int{503, 503, 503, 503, 503}
+	if _, err := client.Submit([]byte("report"), id); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("Submission should fail once retries run out but got %v", err)
+	}
+	if len(*delays) != 3 || len(api.failures) != 1 {
+		t.Errorf("Expected 3 retries but waited %v", *delays)
+	}
+}
+
+func TestReportsClientDoesNotRetryCreatesThatMayHaveReachedTheAPI(t *testing.T) {
+	for _, status := range []int{http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusRequestTimeout} {
+		client, api, delays := buildReportsClient(t)
+		api.failures = []int{status}
+
+		if _, err := client.Submit([]byte("report"), ""); !errors.Is(err, ErrMaybeCreated) {
+			t.Errorf("%d: expected ErrMaybeCreated but got %v", status, err)
+		}
+		if len(api.requests) != 1 || len(*delays) != 0 {
+			t.Errorf("%d: create should not be retried but %d requests were made", status, len(api.requests))
+		}
+	}
+}
+
+func TestReportsClientRetriesCreatesThatWereNotSent(t *testing.T) {
+	client, _, delays := buildReportsClient(t)
+
+	// Nothing listens on the address of a closed server
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	client.endpoint = closed.URL + "/reports"
+
+	_, err := client.Submit([]byte("report"), "")
+	if err == nil || errors.Is(err, ErrMaybeCreated) {
+		t.Errorf("Expected a connection error but got %v", err)
+	}
+	if len(*delays) != 3 {
+		t.Errorf("Create that was not sent should be retried 3 times but waited %v", *delays)
+	}
+}
+
+func TestReportsClientNeedsTheIdOfCreatedReports(t *testing.T) {
+	client, api, _ := buildReportsClient(t)
+
+	id, err := client.Submit([]byte("first"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api.noId = true
+
+	// The id given is kept when an update does not return one
+	if updated, err := client.Submit([]byte("second"), id); err != nil || updated != id {
+		t.Errorf("Update should keep the id %s but got %q, %v", id, updated, err)
+	}
+
+	if _, err := client.Submit([]byte("third"), ""); err == nil {
+		t.Errorf("Create without a report id in the response should fail")
+	}
+}
+
+func TestReportsClientDoesNotRetryRejectedReports(t *testing.T) {
+	tests := map[int]string{
+		http.StatusUnauthorized:         "unauthorized",
+		http.StatusForbidden:            "forbidden",
+		http.StatusUnsupportedMediaType: "Content-Type",
+		http.StatusUnprocessableEntity:  "invalid report",
+		http.StatusBadRequest:           "400",
+	}
+
+	for status, message := range tests {
+		client, api, delays := buildReportsClient(t)
+		api.failures = []int{status}
+
+		if _, err := client.Submit([]byte("report"), ""); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%d: expected an error with %q but got %v", status, message, err)
+		}
+		if len(api.requests) != 1 || len(*delays) != 0 {
+			t.Errorf("%d: should not be retried but %d requests were made", status, len(api.requests))
+		}
+	}
+}
+
+func TestReportsClientRecreatesMissingReports(t *testing.T) {
+	client, api, _ := buildReportsClient(t)
+
+	id, err := client.Submit([]byte("report"), "deleted")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id != "report-1" {
+		t.Errorf("Missing report should be created again but got %q", id)
+	}
+	if expected := []string{"PUT /reports/deleted", "POST /reports"}; !reflect.DeepEqual(api.requests, expected) {
+		t.Errorf("Expected requests %v but got %v", expected, api.requests)
+	}
+}
+
+func TestResubmittedReportsAreUpdated(t *testing.T) {
+	client, api, _ := buildReportsClient(t)
+	service := NewSubmissionService(&MockReportsRepositoryReader{})
+
+	report := ReportSubmission{
+		RepoId:      "datacite",
+		BeginDate:   time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:     time.Date(2018, 1, 31, 0, 0, 0, 0, time.UTC),
+		Format:      FormatRD1,
+		Granularity: GranularityTotals,
+	}
+
+	// Each run sends both parts as the worker does when resubmitting
+	for run := 0; run < 2; run++ {
+		reportIds, err := service.ReportIds(report)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for part := 1; part <= 2; part++ {
+			id, err := client.Submit([]byte(fmt.Sprintf("run %d part %d", run, part)), reportIds[part])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := service.Acknowledge(report, part, id); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	expected := map[string]string{"report-1": "run 1 part 1", "report-2": "run 1 part 2"}
+	if !reflect.DeepEqual(api.reports, expected) {
+		t.Errorf("Expected %v but got %v", expected, api.reports)
+	}
+
+	if reportIds, _ := service.ReportIds(report); !reflect.DeepEqual(reportIds, map[int]string{1: "report-1", 2: "report-2"}) {
+		t.Errorf("Report ids should be recorded but got %v", reportIds)
+	}
+}
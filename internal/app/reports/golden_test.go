@@ -0,0 +1,105 @@
+package reports
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Regenerate the golden files with go test ./internal/app/reports -update
+var update = flag.Bool("update", false, "update golden files")
+
+func assertGolden(t *testing.T, name string, report any) {
+	t.Helper()
+
+	got, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+
+	path := filepath.Join("testdata", name+".golden.json")
+
+	if *update {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != string(want) {
+		t.Errorf("Report does not match %s, run with -update if the change is expected\ngot:\n%s", path, got)
+	}
+}
+
+func TestReportFormatsGolden(t *testing.T) {
+	tests := []struct {
+		name        string
+		format      string
+		sharedData  SharedData
+		compressed  bool
+		granularity string
+	}{
+		{"rd1", FormatRD1, SharedData{Platform: "datacite", Publisher: "datacite", PublisherId: "datacite.test"}, false, GranularityTotals},
+		{"rd1_missing_data", FormatRD1, SharedData{}, true, GranularityTotals},
+		{"rd1_month", FormatRD1, SharedData{Platform: "datacite", Publisher: "datacite", PublisherId: "datacite.test"}, false, GranularityMonth},
+		{"r51", FormatR51, SharedData{Platform: "datacite", Publisher: "datacite", PublisherId: "datacite.test"}, false, GranularityTotals},
+		{"r51_missing_data", FormatR51, SharedData{}, true, GranularityTotals},
+		{"r51_month", FormatR51, SharedData{Platform: "datacite", Publisher: "datacite", PublisherId: "datacite.test"}, false, GranularityMonth},
+	}
+
+	beginDate := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	endDate := time.Date(2018, 12, 31, 0, 0, 0, 0, time.UTC)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := NewReportsService(&MockStatsService{})
+			service.now = func() time.Time { return time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+			iterator, err := service.GenerateReport(test.format, "datacite", beginDate, endDate, test.sharedData, test.compressed, test.granularity)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			part, ok, err := iterator.Next()
+			if err != nil || !ok {
+				t.Fatalf("Report should have a first part but got %v", err)
+			}
+
+			assertGolden(t, test.name, part.Report)
+		})
+	}
+}
+
+func TestGenerateReportUnknownFormat(t *testing.T) {
+	service := NewReportsService(&MockStatsService{})
+
+	if _, err := service.GenerateReport("rd2", "datacite", time.Now(), time.Now(), SharedData{}, false, GranularityTotals); err == nil {
+		t.Errorf("Unknown format should return an error")
+	}
+}
+
+func TestGenerateR51ItemId(t *testing.T) {
+	tests := map[string]map[string]string{
+		"10.1234/1":                     {"DOI": "10.1234/1"},
+		"20.500.12345/item-1":           {"Proprietary": "hdl:20.500.12345/item-1"},
+		"ark:/13030/tf5p30086k":         {"URI": "ark:/13030/tf5p30086k"},
+		"https://example.org/dataset/1": {"URI": "https://example.org/dataset/1"},
+	}
+
+	for value, want := range tests {
+		got := generateR51ItemId(value)
+		for key, wantValue := range want {
+			if len(got) != 1 || got[key] != wantValue {
+				t.Errorf("Item_ID for %s should be %v but got %v", value, want, got)
+			}
+		}
+	}
+}
@@ -20,10 +20,13 @@ type CounterIdentifier struct {
 	Value string `json:"value"`
 }
 
+// Country counts are keyed by lower case ISO 3166-1 alpha-2 code, usage
+// without a known country is only in the count
 type CounterDatasetInstance struct {
-	MetricType   string `json:"metric-type"`
-	Count        int    `json:"count"`
-	AccessMethod string `json:"access-method"`
+	MetricType    string         `json:"metric-type"`
+	Count         int            `json:"count"`
+	AccessMethod  string         `json:"access-method"`
+	CountryCounts map[string]int `json:"country-counts,omitempty"`
 }
 
 type CounterDatasetPerformance struct {
@@ -59,3 +62,88 @@ type CounterDatasetReport struct {
 	ReportHeader   ReportHeader          `json:"report-header"`
 	ReportDatasets []CounterDatasetUsage `json:"report-datasets"`
 }
+
+// COUNTER R5.1 report filters, dates are formatted YYYY-MM-DD
+type R51ReportFilters struct {
+	BeginDate    string   `json:"Begin_Date"`
+	EndDate      string   `json:"End_Date"`
+	DataType     []string `json:"Data_Type,omitempty"`
+	AccessMethod []string `json:"Access_Method,omitempty"`
+}
+
+type R51ReportAttributes struct {
+	AttributesToShow []string `json:"Attributes_To_Show,omitempty"`
+	Granularity      string   `json:"Granularity,omitempty"`
+}
+
+type R51Exception struct {
+	Code    int    `json:"Code"`
+	Message string `json:"Message"`
+	HelpUrl string `json:"Help_URL,omitempty"`
+	Data    string `json:"Data,omitempty"`
+}
+
+// COUNTER R5.1 report header
+type R51ReportHeader struct {
+	ReportName       string              `json:"Report_Name"`
+	ReportId         string              `json:"Report_ID"`
+	Release          string              `json:"Release"`
+	InstitutionName  string              `json:"Institution_Name"`
+	InstitutionId    map[string][]string `json:"Institution_ID,omitempty"`
+	ReportFilters    R51ReportFilters    `json:"Report_Filters"`
+	ReportAttributes R51ReportAttributes `json:"Report_Attributes"`
+	Exceptions       []R51Exception      `json:"Exceptions,omitempty"`
+	Created          string              `json:"Created"`
+	CreatedBy        string              `json:"Created_By"`
+	RegistryRecord   string              `json:"Registry_Record,omitempty"`
+}
+
+// Counts of each metric type, a single total with Totals granularity or a
+// count per YYYY-MM month with Month granularity
+type R51Performance map[string]any
+
+type R51AttributePerformance struct {
+	DataType     string         `json:"Data_Type"`
+	AccessMethod string         `json:"Access_Method"`
+	Performance  R51Performance `json:"Performance"`
+}
+
+// COUNTER R5.1 report item, one per dataset
+type R51ReportItem struct {
+	Item                 string                    `json:"Item"`
+	ItemId               map[string]string         `json:"Item_ID"`
+	Platform             string                    `json:"Platform"`
+	Publisher            string                    `json:"Publisher"`
+	PublisherId          map[string][]string       `json:"Publisher_ID,omitempty"`
+	AttributePerformance []R51AttributePerformance `json:"Attribute_Performance"`
+}
+
+type R51DatasetReport struct {
+	ReportHeader R51ReportHeader `json:"Report_Header"`
+	ReportItems  []R51ReportItem `json:"Report_Items"`
+}
+
+// Status of a submitted part
+const (
+	SubmissionAcknowledged = "acknowledged"
+	// Creating the part failed after it may have reached the Reports API
+	SubmissionUncertain = "uncertain"
+	// An operator found an uncertain part was not created, it is sent again
+	SubmissionNotCreated = "not_created"
+)
+
+// ReportSubmission records a part of a report sent to the Reports API.
+// Reports are identified by the repository, reporting period, format and
+// granularity.
+type ReportSubmission struct {
+	RepoId      string
+	BeginDate   time.Time `gorm:"type:Date"`
+	EndDate     time.Time `gorm:"type:Date"`
+	Format      string
+	Granularity string
+	Part        uint32
+	// Id of the part in the Reports API, empty when none was returned
+	ReportId  string
+	Status    string
+	Submitted time.Time
+}
@@ -0,0 +1,225 @@
+package reports
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/datacite/keeshond/internal/app/event"
+	"github.com/datacite/keeshond/internal/app/pid"
+	"github.com/datacite/keeshond/internal/app/stats"
+)
+
+// GenerateR51DatasetReport generates a COUNTER R5.1 Dataset report, parts are
+// generated and numbered the same way as GenerateDatasetUsageReport. R5.1 only has Totals
+// and Month granularity.
+func (service *ReportsService) GenerateR51DatasetReport(repoId string, startDate time.Time, endDate time.Time, sharedData SharedData, addCompressedHeader bool, granularity string) (func() (*R51DatasetReport, error), error) {
+	var interval, headerGranularity string
+	switch granularity {
+	case GranularityTotals, "":
+		headerGranularity = "Totals"
+	case GranularityMonth:
+		interval = granularity
+		headerGranularity = "Month"
+	default:
+		return nil, fmt.Errorf("unsupported granularity %q for %s reports, expected %s or %s", granularity, FormatR51, GranularityTotals, GranularityMonth)
+	}
+
+	nextResults := service.datasetPages(repoId, startDate, endDate, interval, false)
+
+	part := 0
+
+	generateReportFunc := func() (*R51DatasetReport, error) {
+		results, more := nextResults()
+
+		var items []R51ReportItem
+		for _, result := range results {
+			items = append(items, generateR51ReportItem(result, sharedData))
+		}
+
+		if len(items) == 0 {
+			// Every part has been generated
+			if part > 0 {
+				return nil, nil
+			}
+			return nil, ErrNoResults
+		}
+		part++
+
+		exceptions := generateR51Exceptions(sharedData, addCompressedHeader)
+		if part > 1 || more {
+			exceptions = append(exceptions, R51Exception{
+				Code:    3040,
+				Message: "Partial Data Returned",
+				Data:    partData(part, more),
+			})
+		}
+
+		report := R51DatasetReport{
+			ReportHeader: generateR51ReportHeader(startDate, endDate, service.now(), headerGranularity, sharedData, exceptions),
+			ReportItems:  items,
+		}
+
+		return &report, nil
+	}
+
+	return generateReportFunc, nil
+}
+
+func generateR51ReportHeader(beginDate time.Time, endDate time.Time, created time.Time, granularity string, sharedData SharedData, exceptions []R51Exception) R51ReportHeader {
+	header := R51ReportHeader{
+		ReportName: "Dataset Report",
+		ReportId:   "DSR",
+		Release:    "5.1",
+		// Usage is not attributed to institutions
+		InstitutionName: "The World",
+		ReportFilters: R51ReportFilters{
+			BeginDate:    beginDate.Format("2006-01-02"),
+			EndDate:      endDate.Format("2006-01-02"),
+			DataType:     []string{"Dataset"},
+			AccessMethod: []string{"Regular", "TDM"},
+		},
+		ReportAttributes: R51ReportAttributes{
+			AttributesToShow: []string{"Data_Type", "Access_Method"},
+			Granularity:      granularity,
+		},
+		Exceptions: exceptions,
+		Created:    created.UTC().Format(time.RFC3339),
+		CreatedBy:  "datacite-analytics",
+	}
+
+	if sharedData.PublisherId != "" {
+		header.CreatedBy = "da_" + sharedData.PublisherId
+	}
+
+	return header
+}
+
+// Generate the warnings for data missing from the report, using the R5.1 names
+// of the missing elements
+func generateR51Exceptions(sharedData SharedData, addCompressedHeader bool) []R51Exception {
+	exceptions := []R51Exception{{
+		Code:    3071,
+		Message: "Item",
+		Data:    "Item is unavailable in this report, can be obtained from metadata lookup based on Item_ID",
+	}}
+
+	if sharedData.Platform == "" {
+		exceptions = append(exceptions, R51Exception{Code: 3071, Message: "Platform"})
+	}
+	if sharedData.Publisher == "" {
+		exceptions = append(exceptions, R51Exception{
+			Code:    3071,
+			Message: "Publisher",
+			Data:    "Publisher is unavailable in this report, can be obtained from metadata lookup based on Item_ID",
+		})
+	}
+	if sharedData.PublisherId == "" {
+		exceptions = append(exceptions, R51Exception{
+			Code:    3071,
+			Message: "Publisher_ID",
+			Data:    "Publisher_ID is unavailable in this report, can be obtained from metadata lookup based on Item_ID",
+		})
+	}
+
+	if addCompressedHeader {
+		exceptions = append(exceptions, R51Exception{
+			Code:    69,
+			Message: "Report is compressed using gzip",
+			HelpUrl: "https://github.com/datacite/sashimi",
+			Data:    "usage data needs to be uncompressed",
+		})
+	}
+
+	return exceptions
+}
+
+// R5.1 calls machine access TDM, text and data mining
+var r51AccessMethods = map[string]string{
+	event.AccessRegular: "Regular",
+	event.AccessMachine: "TDM",
+}
+
+// generateR51ReportItem gives the performance of each access method with
+// usage. With Month granularity each metric has a count per YYYY-MM month
+// and months without usage are left out.
+func generateR51ReportItem(result datasetResult, sharedData SharedData) R51ReportItem {
+	item := R51ReportItem{
+		Item:                 "",
+		ItemId:               generateR51ItemId(result.Pid),
+		Platform:             sharedData.Platform,
+		Publisher:            sharedData.Publisher,
+		AttributePerformance: []R51AttributePerformance{},
+	}
+
+	for _, accessMethod := range []string{event.AccessRegular, event.AccessMachine} {
+		var usage []stats.PidAccessMethodResult
+		for _, row := range result.Usage {
+			if row.AccessMethod == accessMethod {
+				usage = append(usage, row)
+			}
+		}
+
+		if len(usage) == 0 {
+			continue
+		}
+
+		item.AttributePerformance = append(item.AttributePerformance, R51AttributePerformance{
+			DataType:     "Dataset",
+			AccessMethod: r51AccessMethods[accessMethod],
+			Performance:  generateR51Performance(usage),
+		})
+	}
+
+	if sharedData.PublisherId != "" {
+		item.PublisherId = map[string][]string{
+			"Proprietary": {"datacite:" + sharedData.PublisherId},
+		}
+	}
+
+	return item
+}
+
+func generateR51Performance(usage []stats.PidAccessMethodResult) R51Performance {
+	// Usage that is not split into periods is a single total
+	if len(usage) == 1 && usage[0].Period.IsZero() {
+		return R51Performance{
+			"Total_Item_Investigations":  int(usage[0].TotalViews),
+			"Unique_Item_Investigations": int(usage[0].UniqueViews),
+			"Total_Item_Requests":        int(usage[0].TotalDownloads),
+			"Unique_Item_Requests":       int(usage[0].UniqueDownloads),
+		}
+	}
+
+	totalInvestigations := map[string]int{}
+	uniqueInvestigations := map[string]int{}
+	totalRequests := map[string]int{}
+	uniqueRequests := map[string]int{}
+
+	for _, period := range usage {
+		month := period.Period.Format("2006-01")
+		totalInvestigations[month] = int(period.TotalViews)
+		uniqueInvestigations[month] = int(period.UniqueViews)
+		totalRequests[month] = int(period.TotalDownloads)
+		uniqueRequests[month] = int(period.UniqueDownloads)
+	}
+
+	return R51Performance{
+		"Total_Item_Investigations":  totalInvestigations,
+		"Unique_Item_Investigations": uniqueInvestigations,
+		"Total_Item_Requests":        totalRequests,
+		"Unique_Item_Requests":       uniqueRequests,
+	}
+}
+
+// R5.1 only has DOI and URI item identifiers for datasets, Handles are given
+// as proprietary identifiers and ARKs and URNs are URIs
+func generateR51ItemId(value string) map[string]string {
+	switch pid.Detect(value) {
+	case pid.DOI:
+		return map[string]string{"DOI": value}
+	case pid.Handle:
+		return map[string]string{"Proprietary": "hdl:" + value}
+	default:
+		return map[string]string{"URI": value}
+	}
+}
@@ -0,0 +1,39 @@
+package reports
+
+import (
+	"gorm.io/gorm"
+)
+
+type ReportsRepositoryReader interface {
+	// Latest acknowledgement of each part of the report, in part order
+	Submissions(report ReportSubmission) ([]ReportSubmission, error)
+	// Record that a part of a report was acknowledged
+	CreateSubmission(submission *ReportSubmission) error
+}
+
+type ReportsRepository struct {
+	db *gorm.DB
+}
+
+func NewReportsRepository(db *gorm.DB) *ReportsRepository {
+	return &ReportsRepository{
+		db: db,
+	}
+}
+
+func (repository *ReportsRepository) Submissions(report ReportSubmission) ([]ReportSubmission, error) {
+	var submissions []ReportSubmission
+
+	err := repository.db.
+		Table("report_submissions FINAL").
+		Where("repo_id = ? AND begin_date = ? AND end_date = ?", report.RepoId, report.BeginDate.Format("2006-01-02"), report.EndDate.Format("2006-01-02")).
+		Where("format = ? AND granularity = ?", report.Format, report.Granularity).
+		Order("part").
+		Find(&submissions).Error
+
+	return submissions, err
+}
+
+func (repository *ReportsRepository) CreateSubmission(submission *ReportSubmission) error {
+	return repository.db.Create(submission).Error
+}
@@ -0,0 +1,141 @@
+package reports
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// JSON schemas of the report formats, rd1 follows what the DataCite Reports
+// API accepts and r5.1 the parts of the COUNTER R5.1 Dataset Report generated
+//
+//go:embed schema/*.json
+var schemaFiles embed.FS
+
+var ErrInvalidReport = errors.New("report does not match the COUNTER schema")
+
+var (
+	schemasOnce sync.Once
+	schemas     map[string]*jsonschema.Schema
+	schemasErr  error
+)
+
+// compileSchemas compiles the embedded schema of each format once
+func compileSchemas() (map[string]*jsonschema.Schema, error) {
+	schemasOnce.Do(func() {
+		compiler := jsonschema.NewCompiler()
+		compiler.AssertFormat = true
+
+		compiled := make(map[string]*jsonschema.Schema)
+		for format, file := range map[string]string{FormatRD1: "schema/rd1.json", FormatR51: "schema/r51.json"} {
+			data, err := schemaFiles.ReadFile(file)
+			if err != nil {
+				schemasErr = err
+				return
+			}
+
+			if err := compiler.AddResource(file, bytes.NewReader(data)); err != nil {
+				schemasErr = err
+				return
+			}
+
+			schema, err := compiler.Compile(file)
+			if err != nil {
+				schemasErr = err
+				return
+			}
+			compiled[format] = schema
+		}
+
+		schemas = compiled
+	})
+
+	return schemas, schemasErr
+}
+
+// ValidateReport checks a generated report against the schema of its format
+func ValidateReport(report any) error {
+	reportJson, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	return ValidateReportJSON(reportJson)
+}
+
+// ValidateReportJSON checks a report against the schema of its format, the
+// format is told from the report header. ErrInvalidReport is returned with
+// every problem found.
+func ValidateReportJSON(reportJson []byte) error {
+	schemas, err := compileSchemas()
+	if err != nil {
+		return fmt.Errorf("compiling report schemas: %w", err)
+	}
+
+	// Numbers are kept as they are written so integers can be told apart
+	decoder := json.NewDecoder(bytes.NewReader(reportJson))
+	decoder.UseNumber()
+
+	var document any
+	if err := decoder.Decode(&document); err != nil {
+		return fmt.Errorf("%w: not valid json: %v", ErrInvalidReport, err)
+	}
+
+	format, err := reportFormat(document)
+	if err != nil {
+		return err
+	}
+
+	err = schemas[format].Validate(document)
+
+	var validationError *jsonschema.ValidationError
+	if errors.As(err, &validationError) {
+		return fmt.Errorf("%w: %s", ErrInvalidReport, strings.Join(validationProblems(validationError), "; "))
+	}
+
+	return err
+}
+
+// reportFormat tells the format of a report from its header
+func reportFormat(document any) (string, error) {
+	object, ok := document.(map[string]any)
+	if !ok {
+		return "", fmt.Errorf("%w: expected a json object", ErrInvalidReport)
+	}
+
+	if _, ok := object["report-header"]; ok {
+		return FormatRD1, nil
+	}
+	if _, ok := object["Report_Header"]; ok {
+		return FormatR51, nil
+	}
+
+	return "", fmt.Errorf("%w: no report-header or Report_Header", ErrInvalidReport)
+}
+
+// validationProblems flattens a validation error into the problem at each
+// location of the report, sorted by location
+func validationProblems(validationError *jsonschema.ValidationError) []string {
+	if len(validationError.Causes) == 0 {
+		location := validationError.InstanceLocation
+		if location == "" {
+			location = "/"
+		}
+		return []string{location + ": " + validationError.Message}
+	}
+
+	var problems []string
+	for _, cause := range validationError.Causes {
+		problems = append(problems, validationProblems(cause)...)
+	}
+	sort.Strings(problems)
+
+	return problems
+}
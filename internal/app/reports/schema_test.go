@@ -0,0 +1,71 @@
+package reports
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGoldenReportsMatchSchema(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.golden.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("No golden files found")
+	}
+
+	for _, path := range paths {
+		reportJson, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ValidateReportJSON(reportJson); err != nil {
+			t.Errorf("%s should match the schema but got %v", path, err)
+		}
+	}
+}
+
+func TestValidateReportFindsProblems(t *testing.T) {
+	report := &CounterDatasetReport{
+		ReportHeader: generateReportHeader(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2018, 12, 31, 0, 0, 0, 0, time.UTC), SharedData{}, []Exception{}),
+		ReportDatasets: []CounterDatasetUsage{
+			{
+				DatasetId: []CounterIdentifier{{Type: "DOI", Value: "10.1234/1"}},
+				DataType:  "dataset",
+				Performance: []CounterDatasetPerformance{
+					{
+						Period: ReportingPeriod{BeginDate: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC), EndDate: time.Date(2018, 12, 31, 0, 0, 0, 0, time.UTC)},
+						Instance: []CounterDatasetInstance{
+							{MetricType: "total-dataset-views", Count: 1, AccessMethod: "regular"},
+							{MetricType: "total-dataset-requests", Count: -1, AccessMethod: "regular"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	err := ValidateReport(report)
+	if !errors.Is(err, ErrInvalidReport) {
+		t.Fatalf("Report should be invalid but got %v", err)
+	}
+
+	for _, location := range []string{"/report-datasets/0/performance/0/instance/0/metric-type", "/report-datasets/0/performance/0/instance/1/count"} {
+		if !strings.Contains(err.Error(), location) {
+			t.Errorf("Error should point at %s but got %v", location, err)
+		}
+	}
+}
+
+func TestValidateReportJSONNeedsKnownFormat(t *testing.T) {
+	for _, reportJson := range []string{`{"header": {}}`, `[]`, `not json`} {
+		if err := ValidateReportJSON([]byte(reportJson)); !errors.Is(err, ErrInvalidReport) {
+			t.Errorf("%s should be invalid but got %v", reportJson, err)
+		}
+	}
+}
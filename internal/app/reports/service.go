@@ -1,17 +1,21 @@
 package reports
 
 import (
-	"bytes"
 	"errors"
-	"log"
-	"net/http"
+	"fmt"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/datacite/keeshond/internal/app/event"
+	"github.com/datacite/keeshond/internal/app/pid"
 	"github.com/datacite/keeshond/internal/app/stats"
 )
 
 type ReportsService struct {
 	statsService stats.StatsServiceInterface
+	now          func() time.Time
+	reportSize   int // Datasets in each part of a report
 }
 
 type SharedData struct {
@@ -23,105 +27,238 @@ type SharedData struct {
 func NewReportsService(statsService stats.StatsServiceInterface) *ReportsService {
 	return &ReportsService{
 		statsService: statsService,
+		now:          time.Now,
+		// Hardcoded for now, but possibly configurable in the future.
+		reportSize: 50000,
 	}
 }
 
-// GenerateDatasetUsageReport generates a dataset usage report
-// It returns a function to generate part or the full report depending on number of results
-// A nil pointer is returned when the callback function is called and there are no results
-// If there are more than 50,000 results, the report results should be compressed and an exception is added to the report header to signify this.
-func (service *ReportsService) GenerateDatasetUsageReport(repoId string, startDate time.Time, endDate time.Time, sharedData SharedData, addCompressedHeader bool) (func() (*CounterDatasetReport, error), error) {
-	// Create stats query object
+// Report formats that can be generated
+const (
+	FormatRD1 = "rd1"  // COUNTER Code of Practice for Research Data SUSHI report
+	FormatR51 = "r5.1" // COUNTER R5.1 Dataset report
+)
+
+// Granularities of the performance of each dataset in a report
+const (
+	GranularityTotals = "totals" // A single total for the whole reporting period
+	GranularityMonth  = "month"  // A total per calendar month
+	GranularityDay    = "day"    // A total per day, only for rd1 reports
+	GranularityYear   = "year"   // A total per calendar year, only for rd1 reports
+)
+
+// ErrNoResults is returned for the first part of a report when there is no
+// usage to report
+var ErrNoResults = errors.New("No results found for this query")
+
+// ReportPart is one part of a report, parts are numbered from 1 and each is
+// sent to the Reports API on its own
+type ReportPart struct {
+	Number int
+	Report any // *CounterDatasetReport or *R51DatasetReport
+}
+
+// ReportIterator generates the parts of a report in order, see Next
+type ReportIterator struct {
+	next   func() (any, error)
+	number int
+	done   bool
+}
+
+// Next generates the next part of the report, ok is false once every part has
+// been generated. ErrNoResults is returned when the report has no usage.
+func (iterator *ReportIterator) Next() (part ReportPart, ok bool, err error) {
+	if iterator.done {
+		return ReportPart{}, false, nil
+	}
+
+	report, err := iterator.next()
+	if err != nil || report == nil {
+		iterator.done = true
+		return ReportPart{}, false, err
+	}
+
+	iterator.number++
+	return ReportPart{Number: iterator.number, Report: report}, true, nil
+}
+
+// GenerateReport returns an iterator over the parts of a report in the given
+// format and granularity, see GenerateDatasetUsageReport and
+// GenerateR51DatasetReport.
+func (service *ReportsService) GenerateReport(format string, repoId string, startDate time.Time, endDate time.Time, sharedData SharedData, addCompressedHeader bool, granularity string) (*ReportIterator, error) {
+	switch format {
+	case FormatRD1, "":
+		generateReport, err := service.GenerateDatasetUsageReport(repoId, startDate, endDate, sharedData, addCompressedHeader, granularity)
+		if err != nil {
+			return nil, err
+		}
+		return &ReportIterator{next: func() (any, error) {
+			report, err := generateReport()
+			if report == nil {
+				return nil, err
+			}
+			return report, err
+		}}, nil
+	case FormatR51:
+		generateReport, err := service.GenerateR51DatasetReport(repoId, startDate, endDate, sharedData, addCompressedHeader, granularity)
+		if err != nil {
+			return nil, err
+		}
+		return &ReportIterator{next: func() (any, error) {
+			report, err := generateReport()
+			if report == nil {
+				return nil, err
+			}
+			return report, err
+		}}, nil
+	default:
+		return nil, fmt.Errorf("unknown report format %q, expected %s or %s", format, FormatRD1, FormatR51)
+	}
+}
+
+// partData describes which part of a report split into parts this is
+func partData(part int, more bool) string {
+	if more {
+		return fmt.Sprintf("Part %d of the report, more datasets follow in part %d", part, part+1)
+	}
+	return fmt.Sprintf("Part %d of the report, the final part", part)
+}
+
+// Usage of a dataset split by access method, and by period when the report
+// has a granularity. Countries are split the same way.
+type datasetResult struct {
+	Pid       string
+	Usage     []stats.PidAccessMethodResult
+	Countries []stats.PidCountryResult
+}
+
+// datasetPages returns a function that pages through the datasets of the
+// repository, each call returns the results for the next part of the report
+// and whether there are more parts. Usage is split into periods of the
+// interval unless it is empty, countries are only read when they are needed
+// and for the same page of pids.
+func (service *ReportsService) datasetPages(repoId string, startDate time.Time, endDate time.Time, interval string, withCountries bool) func() ([]datasetResult, bool) {
+	// The reporting period includes its last day but stats queries end before
+	// their end, so they end at the start of the next day
 	query := stats.Query{
-		Start: startDate,
-		End:   endDate,
+		Start:    startDate,
+		End:      endDate.AddDate(0, 0, 1),
+		Interval: interval,
 	}
 
-	// Hardcoded for now, but possibly configurable in the future.
-	reportSize := 50000
+	return reportPages(service.reportSize, func(page int, pageSize int) []datasetResult {
+		countries := make(map[string][]stats.PidCountryResult)
+		if withCountries {
+			for _, country := range service.statsService.BreakdownByPIDAndCountry(repoId, query, page, pageSize) {
+				countries[country.Pid] = append(countries[country.Pid], country)
+			}
+		}
 
+		// Rows are ordered by pid so each dataset's rows are next to each other
+		var results []datasetResult
+		for _, row := range service.statsService.BreakdownByPIDAndAccessMethod(repoId, query, page, pageSize) {
+			if len(results) == 0 || results[len(results)-1].Pid != row.Pid {
+				results = append(results, datasetResult{Pid: row.Pid, Countries: countries[row.Pid]})
+			}
+			last := &results[len(results)-1]
+			last.Usage = append(last.Usage, row)
+		}
+
+		return results
+	})
+}
+
+// reportPages returns a function that fetches pages until it has enough
+// results for a part of the report or there are no more results. The first
+// page of the next part is fetched ahead so it is known whether there is one.
+func reportPages[T any](reportSize int, fetch func(page int, pageSize int) []T) func() ([]T, bool) {
 	page := 1
 	pageSize := 1000
 
-	generateReportFunc := func() (*CounterDatasetReport, error) {
+	var ahead []T
+	fetchedAhead := false
+
+	return func() ([]T, bool) {
 		// Loop through all pages of results until we get empty results
-		var results []CounterDatasetUsage
+		var results []T
 		for {
 			// Get results
-			breakdownResults := service.statsService.BreakdownByPID(repoId, query, page, pageSize)
-
-			// If we have no results, break
-			if len(breakdownResults) == 0 {
-				break
+			var pageResults []T
+			if fetchedAhead {
+				pageResults, fetchedAhead = ahead, false
+			} else {
+				pageResults = fetch(page, pageSize)
+				page++
 			}
 
-			// Loop through results and generate report datasets
-			for _, result := range breakdownResults {
-				// Generate dataset usage
-				datasetUsage := generateDatasetUsage(startDate, endDate, result, sharedData)
-
-				// Add to results
-				results = append(results, datasetUsage)
+			// If we have no results, this is the last part
+			if len(pageResults) == 0 {
+				return results, false
 			}
 
-			// Increment page
-			page++
+			results = append(results, pageResults...)
 
-			// If we have more than the max number of records, break
+			// If we have more than the max number of records, the rest are
+			// in the next part if there are any
 			if len(results) >= reportSize {
-				break
+				ahead = fetch(page, pageSize)
+				page++
+				fetchedAhead = true
+				return results, len(ahead) > 0
 			}
 		}
+	}
+}
 
-		var exceptions = []Exception{}
-		if len(results) == 0 {
-			// return error
-			return nil, errors.New("No results found for this query")
-		}
+// GenerateDatasetUsageReport generates a dataset usage report
+// It returns a function to generate part or the full report depending on number of results
+// A nil pointer is returned once every part has been generated, ErrNoResults when the first part has no results
+// If there are more than 50,000 results, the report results should be compressed and an exception is added to the report header to signify this.
+// Reports in more than one part have a Partial Data Returned exception with the number of the part.
+// The performance of each dataset is a single total unless the granularity splits it into days, months or years.
+func (service *ReportsService) GenerateDatasetUsageReport(repoId string, startDate time.Time, endDate time.Time, sharedData SharedData, addCompressedHeader bool, granularity string) (func() (*CounterDatasetReport, error), error) {
+	var interval string
+	switch granularity {
+	case GranularityTotals, "":
+	case GranularityDay, GranularityMonth, GranularityYear:
+		interval = granularity
+	default:
+		return nil, fmt.Errorf("unknown report granularity %q, expected %s, %s, %s or %s", granularity, GranularityTotals, GranularityDay, GranularityMonth, GranularityYear)
+	}
 
-		// We never know the dataset-title so we explicitly add an exception for this
-		// This information would need to come from our API which would require a lookup based on dataset-id
-		// This could provide too much of an overhead for report generation.
-		exceptions = append(exceptions, Exception{
-			Code:     3071,
-			Severity: "warning",
-			Message:  "dataset-title",
-			Data:     "dataset-title is unavailable in this report, can be obtained from metadata lookup based on dataset-id",
-		})
+	nextResults := service.datasetPages(repoId, startDate, endDate, interval, true)
 
-		// Add missing attribute exceptions for potentially missing data
-		if sharedData.Platform == "" {
-			exceptions = append(exceptions, Exception{
-				Code:     3071,
-				Severity: "warning",
-				Message:  "platform",
-			})
-		}
-		if sharedData.Publisher == "" {
-			exceptions = append(exceptions, Exception{
-				Code:     3071,
-				Severity: "warning",
-				Message:  "publisher",
-				Data:     "publisher is unavailable in this report, can be obtained from metadata lookup based on dataset-id",
-			})
+	part := 0
+
+	generateReportFunc := func() (*CounterDatasetReport, error) {
+		datasets, more := nextResults()
+
+		// Loop through results and generate report datasets
+		var results []CounterDatasetUsage
+		for _, result := range datasets {
+			// Generate dataset usage
+			datasetUsage := generateDatasetUsage(startDate, endDate, granularity, result, sharedData)
+
+			// Add to results
+			results = append(results, datasetUsage)
 		}
-		if sharedData.PublisherId == "" {
-			exceptions = append(exceptions, Exception{
-				Code:     3071,
-				Severity: "warning",
-				Message:  "publisher-id",
-				Data:     "publisher-id is unavailable in this report, can be obtained from metadata lookup based on dataset-id",
-			})
+
+		if len(results) == 0 {
+			// Every part has been generated
+			if part > 0 {
+				return nil, nil
+			}
+			return nil, ErrNoResults
 		}
+		part++
 
-		if addCompressedHeader {
-			// Add exception that this will be compressed report
+		exceptions := generateExceptions(sharedData, addCompressedHeader)
+		if part > 1 || more {
 			exceptions = append(exceptions, Exception{
-				Code:     69,
-				Message:  "Report is compressed using gzip",
+				Code:     3040,
 				Severity: "warning",
-				HelpUrl:  "https://github.com/datacite/sashimi",
-				Data:     "usage data needs to be uncompressed",
+				Message:  "Partial Data Returned",
+				Data:     partData(part, more),
 			})
 		}
 
@@ -140,6 +277,59 @@ func (service *ReportsService) GenerateDatasetUsageReport(repoId string, startDa
 	return generateReportFunc, nil
 }
 
+// Generate the warnings for data missing from the report
+func generateExceptions(sharedData SharedData, addCompressedHeader bool) []Exception {
+	var exceptions = []Exception{}
+
+	// We never know the dataset-title so we explicitly add an exception for this
+	// This information would need to come from our API which would require a lookup based on dataset-id
+	// This could provide too much of an overhead for report generation.
+	exceptions = append(exceptions, Exception{
+		Code:     3071,
+		Severity: "warning",
+		Message:  "dataset-title",
+		Data:     "dataset-title is unavailable in this report, can be obtained from metadata lookup based on dataset-id",
+	})
+
+	// Add missing attribute exceptions for potentially missing data
+	if sharedData.Platform == "" {
+		exceptions = append(exceptions, Exception{
+			Code:     3071,
+			Severity: "warning",
+			Message:  "platform",
+		})
+	}
+	if sharedData.Publisher == "" {
+		exceptions = append(exceptions, Exception{
+			Code:     3071,
+			Severity: "warning",
+			Message:  "publisher",
+			Data:     "publisher is unavailable in this report, can be obtained from metadata lookup based on dataset-id",
+		})
+	}
+	if sharedData.PublisherId == "" {
+		exceptions = append(exceptions, Exception{
+			Code:     3071,
+			Severity: "warning",
+			Message:  "publisher-id",
+			Data:     "publisher-id is unavailable in this report, can be obtained from metadata lookup based on dataset-id",
+		})
+	}
+
+	if addCompressedHeader {
+		// Add exception that this will be compressed report
+		exceptions = append(exceptions, Exception{
+			Code:     69,
+			Message:  "Report is compressed using gzip",
+			Severity: "warning",
+			HelpUrl:  "https://github.com/datacite/sashimi",
+			Data:     "usage data needs to be uncompressed",
+		})
+	}
+
+	return exceptions
+}
+
 // Generate report header
 func generateReportHeader(beginDate time.Time, endDate time.Time, sharedData SharedData, exceptions []Exception) ReportHeader {
 	var reportHeader ReportHeader
@@ -166,14 +356,95 @@ func generateReportHeader(beginDate time.Time, endDate time.Time, sharedData Sha
 	return reportHeader
 }
 
-func generateDatasetUsage(beginDate time.Time, endDate time.Time, result stats.BreakdownResult, sharedData SharedData) CounterDatasetUsage {
+// generateDatasetUsage gives a performance entry for each period with usage,
+// the first and last periods are clipped to the reporting period. Regular
+// and machine usage are separate instances.
+func generateDatasetUsage(beginDate time.Time, endDate time.Time, granularity string, result datasetResult, sharedData SharedData) CounterDatasetUsage {
+	datasetUsage := generateDatasetUsageDetails(result.Pid, sharedData)
+
+	datasetUsage.Performance = []CounterDatasetPerformance{}
+	for _, period := range usagePeriods(result.Usage) {
+		periodBegin, periodEnd := periodDates(beginDate, endDate, granularity, period)
+
+		performance := CounterDatasetPerformance{
+			Period: ReportingPeriod{
+				BeginDate: periodBegin,
+				EndDate:   periodEnd,
+			},
+			Instance: []CounterDatasetInstance{},
+		}
+
+		for _, accessMethod := range []string{event.AccessRegular, event.AccessMachine} {
+			for _, usage := range result.Usage {
+				if usage.AccessMethod == accessMethod && usage.Period.Equal(period) {
+					performance.Instance = append(performance.Instance, generateDatasetInstances(accessMethod, usage.BreakdownResult)...)
+				}
+			}
+		}
+
+		addCountryCounts(&performance, result.Countries, period)
+
+		datasetUsage.Performance = append(datasetUsage.Performance, performance)
+	}
+
+	return datasetUsage
+}
+
+// usagePeriods returns the start of each period with usage in order, a single
+// zero time when the usage is not split into periods
+func usagePeriods(usage []stats.PidAccessMethodResult) []time.Time {
+	var periods []time.Time
+	for _, row := range usage {
+		if !slices.ContainsFunc(periods, row.Period.Equal) {
+			periods = append(periods, row.Period)
+		}
+	}
+
+	slices.SortFunc(periods, func(a, b time.Time) int {
+		return a.Compare(b)
+	})
+
+	return periods
+}
+
+// periodDates returns the first and last day of the period clipped to the
+// reporting period, a zero period is the whole reporting period
+func periodDates(beginDate time.Time, endDate time.Time, granularity string, period time.Time) (time.Time, time.Time) {
+	if period.IsZero() {
+		return beginDate, endDate
+	}
+
+	periodBegin := period
+	var periodEnd time.Time
+	switch granularity {
+	case GranularityDay:
+		periodEnd = periodBegin
+	case GranularityYear:
+		periodEnd = periodBegin.AddDate(1, 0, -1)
+	default:
+		periodEnd = periodBegin.AddDate(0, 1, -1)
+	}
+
+	if periodBegin.Before(beginDate) {
+		periodBegin = beginDate
+	}
+	if periodEnd.After(endDate) {
+		periodEnd = endDate
+	}
+
+	return periodBegin, periodEnd
+}
+
+// Generate the details of a dataset that don't depend on its usage
+func generateDatasetUsageDetails(value string, sharedData SharedData) CounterDatasetUsage {
 	var datasetUsage CounterDatasetUsage
 
 	datasetUsage.DatasetTitle = ""
 
+	// Pids are stored normalised so their type can be detected again
 	datasetUsage.DatasetId = []CounterIdentifier{{
-		Type:  "DOI",
-		Value: result.Pid,
+		Type:  pid.Detect(value).CounterType(),
+		Value: value,
 	}}
 
 	datasetUsage.Platform = sharedData.Platform
@@ -189,83 +460,63 @@ func generateDatasetUsage(beginDate time.Time, endDate time.Time, result stats.B
 	}
 
 	datasetUsage.DataType = "dataset"
-	datasetUsage.Performance = []CounterDatasetPerformance{
-		{
-			Period: ReportingPeriod{
-				BeginDate: beginDate,
-				EndDate:   endDate,
-			},
-			Instance: []CounterDatasetInstance{
-				{
-					MetricType:   "total-dataset-requests",
-					Count:        int(result.TotalDownloads),
-					AccessMethod: "regular",
-				},
-				{
-					MetricType:   "unique-dataset-requests",
-					Count:        int(result.UniqueDownloads),
-					AccessMethod: "regular",
-				},
-				{
-					MetricType:   "total-dataset-investigations",
-					Count:        int(result.TotalViews),
-					AccessMethod: "regular",
-				},
-				{
-					MetricType:   "unique-dataset-investigations",
-					Count:        int(result.UniqueViews),
-					AccessMethod: "regular",
-				},
-			},
-		},
-	}
 
 	return datasetUsage
 }
 
-func SendReportToAPI(reportsAPIEndpoint string, compressedJson []byte, jwt string) error {
-	// Make a POST request to Reports API
-	bodyReader := bytes.NewReader(compressedJson)
-	req, err := http.NewRequest(http.MethodPost, reportsAPIEndpoint, bodyReader)
-	if err != nil {
-		return err
-	}
-
-	// Set content type to be gzip as report will be compressed
-	req.Header.Set("Content-Type", "application/gzip")
-	// Set content encoding to gzip
-	req.Header.Set("Content-Encoding", "gzip")
-
-	// Add JWT token to request
-	req.Header.Set("Authorization", "Bearer "+jwt)
+// addCountryCounts adds the counts of each country within the period to the
+// instances of the performance with the same access method
+func addCountryCounts(performance *CounterDatasetPerformance, countries []stats.PidCountryResult, period time.Time) {
+	for _, country := range countries {
+		if country.Country == "" || !country.Period.Equal(period) {
+			continue
+		}
 
-	client := http.Client{
-		Timeout: 100 * time.Second,
-		Transport: &http.Transport{
-			DisableCompression: true,
-		},
-	}
+		code := strings.ToLower(country.Country)
+		counts := map[string]int64{
+			"total-dataset-requests":        country.TotalDownloads,
+			"unique-dataset-requests":       country.UniqueDownloads,
+			"total-dataset-investigations":  country.TotalViews,
+			"unique-dataset-investigations": country.UniqueViews,
+		}
 
-	res, err := client.Do(req)
-	if err != nil {
-		return err
+		for i := range performance.Instance {
+			if performance.Instance[i].AccessMethod != country.AccessMethod {
+				continue
+			}
+			count := counts[performance.Instance[i].MetricType]
+			if count == 0 {
+				continue
+			}
+			if performance.Instance[i].CountryCounts == nil {
+				performance.Instance[i].CountryCounts = make(map[string]int)
+			}
+			performance.Instance[i].CountryCounts[code] = int(count)
+		}
 	}
+}
 
-	// Check response code
-	switch res.StatusCode {
-	case http.StatusCreated:
-		log.Default().Println("Report sent to Reports API")
-	case http.StatusUnauthorized:
-		return errors.New("unauthorized, JWT token is missing or invalid")
-	case http.StatusForbidden:
-		return errors.New("forbidden, JWT is expired or invalid")
-	case http.StatusUnsupportedMediaType:
-		return errors.New("did not include correct Content-Type header")
-	case http.StatusUnprocessableEntity:
-		return errors.New("invalid report provided")
-	default:
-		return errors.New("Error sending report to Reports API: " + res.Status)
+func generateDatasetInstances(accessMethod string, result stats.BreakdownResult) []CounterDatasetInstance {
+	return []CounterDatasetInstance{
+		{
+			MetricType:   "total-dataset-requests",
+			Count:        int(result.TotalDownloads),
+			AccessMethod: accessMethod,
+		},
+		{
+			MetricType:   "unique-dataset-requests",
+			Count:        int(result.UniqueDownloads),
+			AccessMethod: accessMethod,
+		},
+		{
+			MetricType:   "total-dataset-investigations",
+			Count:        int(result.TotalViews),
+			AccessMethod: accessMethod,
+		},
+		{
+			MetricType:   "unique-dataset-investigations",
+			Count:        int(result.UniqueViews),
+			AccessMethod: accessMethod,
+		},
 	}
-
-	return nil
 }
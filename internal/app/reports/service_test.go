@@ -1,6 +1,9 @@
 package reports
 
 import (
+	"errors"
+	"reflect"
+	"slices"
 	"testing"
 	"time"
 
@@ -8,7 +11,32 @@ import (
 	"github.com/datacite/keeshond/internal/app/stats"
 )
 
+// Mock reports repository keeping submissions in memory
 type MockReportsRepositoryReader struct {
+	submissions []ReportSubmission
+}
+
+// Latest submission of each part, later submissions replace earlier ones
+func (m *MockReportsRepositoryReader) Submissions(report ReportSubmission) ([]ReportSubmission, error) {
+	latest := make(map[uint32]ReportSubmission)
+	for _, submission := range m.submissions {
+		if submission.RepoId == report.RepoId && submission.Format == report.Format && submission.Granularity == report.Granularity &&
+			submission.BeginDate.Equal(report.BeginDate) && submission.EndDate.Equal(report.EndDate) {
+			latest[submission.Part] = submission
+		}
+	}
+
+	var submissions []ReportSubmission
+	for _, submission := range latest {
+		submissions = append(submissions, submission)
+	}
+	slices.SortFunc(submissions, func(a, b ReportSubmission) int { return int(a.Part) - int(b.Part) })
+	return submissions, nil
+}
+
+func (m *MockReportsRepositoryReader) CreateSubmission(submission *ReportSubmission) error {
+	m.submissions = append(m.submissions, *submission)
+	return nil
 }
 
 type MockStatsService struct {
@@ -56,6 +84,96 @@ func (m *MockStatsService) BreakdownByPID(repoId string, query stats.Query, page
 	}
 }
 
+// Mock breakdown by access method, pages through the same pids as the
+// breakdown. By period the first pid has usage in two months and the second
+// only in one. The second pid also has machine usage.
+func (m *MockStatsService) BreakdownByPIDAndAccessMethod(repoId string, query stats.Query, page int, pageSize int) []stats.PidAccessMethodResult {
+	var result []stats.PidAccessMethodResult
+
+	if query.Interval != "" {
+		if page != 1 {
+			return result
+		}
+
+		return []stats.PidAccessMethodResult{
+			{
+				Period:          time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+				AccessMethod:    event.AccessRegular,
+				BreakdownResult: stats.BreakdownResult{Pid: "10.1234/1", TotalViews: 60, UniqueViews: 30, TotalDownloads: 20, UniqueDownloads: 10},
+			},
+			{
+				Period:          time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC),
+				AccessMethod:    event.AccessRegular,
+				BreakdownResult: stats.BreakdownResult{Pid: "10.1234/1", TotalViews: 40, UniqueViews: 20, TotalDownloads: 30, UniqueDownloads: 15},
+			},
+			{
+				Period:          time.Date(2018, 12, 1, 0, 0, 0, 0, time.UTC),
+				AccessMethod:    event.AccessRegular,
+				BreakdownResult: stats.BreakdownResult{Pid: "10.1234/2", TotalViews: 100, UniqueViews: 50, TotalDownloads: 50, UniqueDownloads: 25},
+			},
+			{
+				Period:          time.Date(2018, 12, 1, 0, 0, 0, 0, time.UTC),
+				AccessMethod:    event.AccessMachine,
+				BreakdownResult: stats.BreakdownResult{Pid: "10.1234/2", TotalViews: 10, UniqueViews: 5, TotalDownloads: 40, UniqueDownloads: 20},
+			},
+		}
+	}
+
+	for _, breakdown := range m.BreakdownByPID(repoId, query, page, pageSize) {
+		result = append(result, stats.PidAccessMethodResult{AccessMethod: event.AccessRegular, BreakdownResult: breakdown})
+		if breakdown.Pid == "10.1234/2" {
+			result = append(result, stats.PidAccessMethodResult{
+				AccessMethod:    event.AccessMachine,
+				BreakdownResult: stats.BreakdownResult{Pid: "10.1234/2", TotalViews: 10, UniqueViews: 5, TotalDownloads: 40, UniqueDownloads: 20},
+			})
+		}
+	}
+
+	return result
+}
+
+// Mock breakdown by pid and country, only the first pid has usage with a
+// known country, the rest of its usage has no country
+func (m *MockStatsService) BreakdownByPIDAndCountry(repoId string, query stats.Query, page int, pageSize int) []stats.PidCountryResult {
+	if page != 1 {
+		return []stats.PidCountryResult{}
+	}
+
+	if query.Interval != "" {
+		return []stats.PidCountryResult{
+			{
+				Period:          time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+				Country:         "GB",
+				AccessMethod:    event.AccessRegular,
+				BreakdownResult: stats.BreakdownResult{Pid: "10.1234/1", TotalViews: 60, UniqueViews: 30, TotalDownloads: 20, UniqueDownloads: 10},
+			},
+		}
+	}
+
+	return []stats.PidCountryResult{
+		{
+			Country:         "",
+			AccessMethod:    event.AccessRegular,
+			BreakdownResult: stats.BreakdownResult{Pid: "10.1234/1", TotalViews: 10, UniqueViews: 5, TotalDownloads: 5, UniqueDownloads: 3},
+		},
+		{
+			Country:         "GB",
+			AccessMethod:    event.AccessRegular,
+			BreakdownResult: stats.BreakdownResult{Pid: "10.1234/1", TotalViews: 60, UniqueViews: 30, TotalDownloads: 25, UniqueDownloads: 12},
+		},
+		{
+			Country:         "US",
+			AccessMethod:    event.AccessRegular,
+			BreakdownResult: stats.BreakdownResult{Pid: "10.1234/1", TotalViews: 30, UniqueViews: 15, TotalDownloads: 20, UniqueDownloads: 10},
+		},
+	}
+}
+
+// Mock breakdown by dimensions
+func (m *MockStatsService) Breakdown(repoId string, query stats.Query, breakdown stats.Breakdown, page int, pageSize int) []stats.DimensionBreakdownResult {
+	return []stats.DimensionBreakdownResult{}
+}
+
 // Mock count unique
 func (m *MockStatsService) CountUniquePID(repoId string, query stats.Query) int64 {
 	return 4
@@ -98,6 +216,11 @@ func (m *MockStatsService) LastEvent(repoId string) (event.Event, bool) {
 	return e, true
 }
 
+// Mock traffic
+func (m *MockStatsService) Traffic(repoId string, query stats.Query) stats.TrafficResult {
+	return stats.TrafficResult{}
+}
+
 // Test that the service can generate a dataset usage report
 func TestGenerateDatasetUsageReport(t *testing.T) {
 	// Create a mock stats service
@@ -117,7 +240,7 @@ func TestGenerateDatasetUsageReport(t *testing.T) {
 	}
 
 	// Generate the report, returns a function that can be called to get the report
-	generateReport, err := service.GenerateDatasetUsageReport("datacite", beginDate, endDate, sharedData, false)
+	generateReport, err := service.GenerateDatasetUsageReport("datacite", beginDate, endDate, sharedData, false, GranularityTotals)
 
 	if err != nil {
 		t.Error(err)
@@ -195,3 +318,383 @@ func TestGenerateDatasetUsageReport(t *testing.T) {
 	}
 
 }
+
+func TestGenerateDatasetUsageIdentifierType(t *testing.T) {
+	tests := []struct {
+		pid      string
+		wantType string
+	}{
+		{"10.1234/1", "DOI"},
+		{"20.500.12345/item-1", "Handle"},
+		{"ark:/13030/tf5p30086k", "ARK"},
+		{"urn:nbn:de:101:1-201102033592", "URN"},
+		{"https://example.org/datasets/1", "URI"},
+	}
+
+	for _, test := range tests {
+		usage := generateDatasetUsageDetails(test.pid, SharedData{})
+
+		if usage.DatasetId[0].Type != test.wantType || usage.DatasetId[0].Value != test.pid {
+			t.Errorf("DatasetId for %s should be %s but got %+v", test.pid, test.wantType, usage.DatasetId[0])
+		}
+	}
+}
+
+func TestGenerateDatasetUsageReportByMonth(t *testing.T) {
+	service := NewReportsService(&MockStatsService{})
+
+	// Reporting period starts and ends part way through a month
+	beginDate := time.Date(2018, 1, 15, 0, 0, 0, 0, time.UTC)
+	endDate := time.Date(2018, 12, 20, 0, 0, 0, 0, time.UTC)
+
+	generateReport, err := service.GenerateDatasetUsageReport("datacite", beginDate, endDate, SharedData{}, false, GranularityMonth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := generateReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.ReportDatasets) != 2 {
+		t.Fatalf("ReportDatasets length is not correct got %d", len(report.ReportDatasets))
+	}
+
+	tests := []struct {
+		performance   CounterDatasetPerformance
+		wantBegin     string
+		wantEnd       string
+		wantDownloads int
+	}{
+		{report.ReportDatasets[0].Performance[0], "2018-01-15", "2018-01-31", 20},
+		{report.ReportDatasets[0].Performance[1], "2018-03-01", "2018-03-31", 30},
+		{report.ReportDatasets[1].Performance[0], "2018-12-01", "2018-12-20", 50},
+	}
+
+	for _, test := range tests {
+		begin := test.performance.Period.BeginDate.Format("2006-01-02")
+		end := test.performance.Period.EndDate.Format("2006-01-02")
+		if begin != test.wantBegin || end != test.wantEnd {
+			t.Errorf("Period should be %s to %s but got %s to %s", test.wantBegin, test.wantEnd, begin, end)
+		}
+		if test.performance.Instance[0].Count != test.wantDownloads {
+			t.Errorf("Total Dataset Requests for %s should be %d but got %d", begin, test.wantDownloads, test.performance.Instance[0].Count)
+		}
+	}
+}
+
+func TestGenerateReportUnknownGranularity(t *testing.T) {
+	service := NewReportsService(&MockStatsService{})
+
+	if _, err := service.GenerateReport(FormatRD1, "datacite", time.Now(), time.Now(), SharedData{}, false, "week"); err == nil {
+		t.Errorf("Unknown granularity should return an error")
+	}
+
+	// R5.1 only has Totals and Month granularity
+	if _, err := service.GenerateReport(FormatR51, "datacite", time.Now(), time.Now(), SharedData{}, false, GranularityDay); err == nil {
+		t.Errorf("Day granularity should return an error for R5.1 reports")
+	}
+}
+
+func TestGenerateDatasetUsageReportCountryCounts(t *testing.T) {
+	service := NewReportsService(&MockStatsService{})
+
+	beginDate := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	endDate := time.Date(2018, 12, 31, 0, 0, 0, 0, time.UTC)
+
+	generateReport, err := service.GenerateDatasetUsageReport("datacite", beginDate, endDate, SharedData{}, false, GranularityTotals)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := generateReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Usage without a country is left out of the country counts
+	instances := report.ReportDatasets[0].Performance[0].Instance
+	tests := map[string]map[string]int{
+		"total-dataset-requests":        {"gb": 25, "us": 20},
+		"unique-dataset-requests":       {"gb": 12, "us": 10},
+		"total-dataset-investigations":  {"gb": 60, "us": 30},
+		"unique-dataset-investigations": {"gb": 30, "us": 15},
+	}
+
+	for _, instance := range instances {
+		want := tests[instance.MetricType]
+		if len(instance.CountryCounts) != len(want) {
+			t.Errorf("%s country counts should be %v but got %v", instance.MetricType, want, instance.CountryCounts)
+			continue
+		}
+		for country, count := range want {
+			if instance.CountryCounts[country] != count {
+				t.Errorf("%s country counts should be %v but got %v", instance.MetricType, want, instance.CountryCounts)
+			}
+		}
+	}
+
+	// Datasets without known countries have no country counts
+	for _, instance := range report.ReportDatasets[1].Performance[0].Instance {
+		if instance.CountryCounts != nil {
+			t.Errorf("%s should not have country counts but got %v", instance.MetricType, instance.CountryCounts)
+		}
+	}
+}
+
+func TestGenerateDatasetUsageReportAccessMethods(t *testing.T) {
+	service := NewReportsService(&MockStatsService{})
+
+	beginDate := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	endDate := time.Date(2018, 12, 31, 0, 0, 0, 0, time.UTC)
+
+	generateReport, err := service.GenerateDatasetUsageReport("datacite", beginDate, endDate, SharedData{}, false, GranularityTotals)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := generateReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only regular usage for the first dataset
+	if instances := report.ReportDatasets[0].Performance[0].Instance; len(instances) != 4 {
+		t.Fatalf("Instance length should be 4 but got %d", len(instances))
+	}
+
+	// Regular then machine instances for the second
+	instances := report.ReportDatasets[1].Performance[0].Instance
+	if len(instances) != 8 {
+		t.Fatalf("Instance length should be 8 but got %d", len(instances))
+	}
+
+	tests := []struct {
+		instance         CounterDatasetInstance
+		wantAccessMethod string
+		wantCount        int
+	}{
+		{instances[0], "regular", 50},
+		{instances[3], "regular", 50},
+		{instances[4], "machine", 40},
+		{instances[7], "machine", 5},
+	}
+
+	for _, test := range tests {
+		if test.instance.AccessMethod != test.wantAccessMethod || test.instance.Count != test.wantCount {
+			t.Errorf("%s should be %s with count %d but got %s with count %d", test.instance.MetricType, test.wantAccessMethod, test.wantCount, test.instance.AccessMethod, test.instance.Count)
+		}
+	}
+}
+
+// Mock stats service with a single view at midday on the last day of
+// January 2018, it is only counted when the query includes it
+type MockLastDayStatsService struct {
+	MockStatsService
+}
+
+func (m *MockLastDayStatsService) BreakdownByPIDAndAccessMethod(repoId string, query stats.Query, page int, pageSize int) []stats.PidAccessMethodResult {
+	view := time.Date(2018, 1, 31, 12, 0, 0, 0, time.UTC)
+	if page != 1 || !view.After(query.Start) || !view.Before(query.End) {
+		return []stats.PidAccessMethodResult{}
+	}
+
+	return []stats.PidAccessMethodResult{
+		{AccessMethod: event.AccessRegular, BreakdownResult: stats.BreakdownResult{Pid: "10.1234/1", TotalViews: 1, UniqueViews: 1}},
+	}
+}
+
+func (m *MockLastDayStatsService) BreakdownByPIDAndCountry(repoId string, query stats.Query, page int, pageSize int) []stats.PidCountryResult {
+	return []stats.PidCountryResult{}
+}
+
+func TestGenerateDatasetUsageReportIncludesLastDay(t *testing.T) {
+	service := NewReportsService(&MockLastDayStatsService{})
+
+	beginDate := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	endDate := time.Date(2018, 1, 31, 0, 0, 0, 0, time.UTC)
+
+	generateReport, err := service.GenerateDatasetUsageReport("datacite", beginDate, endDate, SharedData{}, false, GranularityTotals)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := generateReport()
+	if err != nil {
+		t.Fatalf("View on the last day should be reported but got %v", err)
+	}
+
+	if header := report.ReportHeader.ReportingPeriod.EndDate; !header.Equal(endDate) {
+		t.Errorf("Reporting period should end on %s but got %s", endDate, header)
+	}
+	if instance := report.ReportDatasets[0].Performance[0].Instance[2]; instance.MetricType != "total-dataset-investigations" || instance.Count != 1 {
+		t.Errorf("Expected 1 investigation but got %d %s", instance.Count, instance.MetricType)
+	}
+}
+
+func TestGenerateReportParts(t *testing.T) {
+	beginDate := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	endDate := time.Date(2018, 12, 31, 0, 0, 0, 0, time.UTC)
+
+	for _, format := range []string{FormatRD1, FormatR51} {
+		service := NewReportsService(&MockStatsService{})
+		// Each page of the mock breakdown is a part of its own
+		service.reportSize = 2
+
+		iterator, err := service.GenerateReport(format, "datacite", beginDate, endDate, SharedData{}, false, GranularityTotals)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wantData := []string{
+			"Part 1 of the report, more datasets follow in part 2",
+			"Part 2 of the report, the final part",
+		}
+
+		for i, want := range wantData {
+			part, ok, err := iterator.Next()
+			if err != nil || !ok {
+				t.Fatalf("%s report should have part %d but got %v", format, i+1, err)
+			}
+			if part.Number != i+1 {
+				t.Errorf("%s part should be number %d but got %d", format, i+1, part.Number)
+			}
+
+			var code int
+			var data string
+			switch report := part.Report.(type) {
+			case *CounterDatasetReport:
+				last := report.ReportHeader.Exceptions[len(report.ReportHeader.Exceptions)-1]
+				code, data = last.Code, last.Data
+			case *R51DatasetReport:
+				last := report.ReportHeader.Exceptions[len(report.ReportHeader.Exceptions)-1]
+				code, data = last.Code, last.Data
+			}
+			if code != 3040 || data != want {
+				t.Errorf("%s part %d should have exception 3040 %q but got %d %q", format, i+1, want, code, data)
+			}
+		}
+
+		// The end of the report is not an error, and stays the end
+		for i := 0; i < 2; i++ {
+			if _, ok, err := iterator.Next(); ok || err != nil {
+				t.Errorf("%s report should have ended but got %t %v", format, ok, err)
+			}
+		}
+	}
+}
+
+func TestGenerateReportSinglePart(t *testing.T) {
+	service := NewReportsService(&MockStatsService{})
+
+	generateReport, err := service.GenerateDatasetUsageReport("datacite", time.Now(), time.Now(), SharedData{}, false, GranularityTotals)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := generateReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, exception := range report.ReportHeader.Exceptions {
+		if exception.Code == 3040 {
+			t.Errorf("Report in a single part should not be partial")
+		}
+	}
+
+	if report, err := generateReport(); report != nil || err != nil {
+		t.Errorf("Report should have ended but got %v %v", report, err)
+	}
+}
+
+func TestSubmissionServiceResumes(t *testing.T) {
+	repository := &MockReportsRepositoryReader{}
+	service := NewSubmissionService(repository)
+
+	report := ReportSubmission{
+		RepoId:      "datacite",
+		BeginDate:   time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:     time.Date(2018, 1, 31, 0, 0, 0, 0, time.UTC),
+		Format:      FormatRD1,
+		Granularity: GranularityTotals,
+	}
+
+	if last, err := service.LastAcknowledgedPart(report); err != nil || last != 0 {
+		t.Errorf("No parts should be acknowledged but got %d %v", last, err)
+	}
+
+	// Part 3 was acknowledged by a run that failed on part 2
+	for _, part := range []int{1, 3, 1} {
+		if err := service.Acknowledge(report, part, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if last, _ := service.LastAcknowledgedPart(report); last != 1 {
+		t.Errorf("Parts after a missing part should be sent again, expected 1 but got %d", last)
+	}
+
+	service.Acknowledge(report, 2, "")
+	if last, _ := service.LastAcknowledgedPart(report); last != 3 {
+		t.Errorf("Last acknowledged part should be 3 but got %d", last)
+	}
+
+	// Other reports of the same repository are separate
+	report.Format = FormatR51
+	if last, _ := service.LastAcknowledgedPart(report); last != 0 {
+		t.Errorf("No parts of another format should be acknowledged but got %d", last)
+	}
+}
+
+func TestSubmissionServiceUncertainParts(t *testing.T) {
+	repository := &MockReportsRepositoryReader{}
+	service := NewSubmissionService(repository)
+
+	report := ReportSubmission{
+		RepoId:      "datacite",
+		BeginDate:   time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:     time.Date(2018, 1, 31, 0, 0, 0, 0, time.UTC),
+		Format:      FormatRD1,
+		Granularity: GranularityTotals,
+	}
+
+	service.Acknowledge(report, 1, "report-1")
+	service.MarkUncertain(report, 2)
+
+	if last, _ := service.LastAcknowledgedPart(report); last != 1 {
+		t.Errorf("An uncertain part is not acknowledged, expected 1 but got %d", last)
+	}
+
+	if ids, _ := service.ReportIds(report); !reflect.DeepEqual(ids, map[int]string{1: "report-1"}) {
+		t.Errorf("Only the acknowledged part should have an id but got %v", ids)
+	}
+
+	if err := service.CheckUncertain(report, 2); !errors.Is(err, ErrUncertainSubmission) {
+		t.Errorf("The part should not be created again but got %v", err)
+	}
+
+	if err := service.CheckUncertain(report, 1); err != nil {
+		t.Errorf("An acknowledged part is not uncertain but got %v", err)
+	}
+
+	// Not in the Reports API, it is sent again
+	service.Resolve(report, 2, "")
+	if err := service.CheckUncertain(report, 2); err != nil {
+		t.Errorf("A part that was not created should be sent again but got %v", err)
+	}
+	if last, _ := service.LastAcknowledgedPart(report); last != 1 {
+		t.Errorf("A part that was not created is not acknowledged, expected 1 but got %d", last)
+	}
+
+	// Found in the Reports API, it is updated from now on
+	service.MarkUncertain(report, 2)
+	service.Resolve(report, 2, "report-2")
+	if last, _ := service.LastAcknowledgedPart(report); last != 2 {
+		t.Errorf("A part found in the Reports API is acknowledged, expected 2 but got %d", last)
+	}
+	if ids, _ := service.ReportIds(report); ids[2] != "report-2" {
+		t.Errorf("The part should be updated as report-2 but got %v", ids)
+	}
+}
@@ -0,0 +1,118 @@
+package reports
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrUncertainSubmission is returned for a part that an earlier run may have
+// created in the Reports API without learning its id. It is not sent again
+// until an operator has checked the Reports API and resolved it.
+var ErrUncertainSubmission = errors.New("part may already have been created in the Reports API")
+
+// SubmissionService keeps track of the parts of a report the Reports API has
+// acknowledged, so a failed run can resume instead of sending every part
+// again. Parts are only the same between runs when the usage of the reporting
+// period doesn't change, which holds once the period is over. The id each part
+// was given is kept too, so sending the part again updates it. Parts that may
+// have been created without their id reaching the worker are recorded as
+// uncertain, and hold back the report until an operator resolves them.
+type SubmissionService struct {
+	repository ReportsRepositoryReader
+	now        func() time.Time
+}
+
+func NewSubmissionService(repository ReportsRepositoryReader) *SubmissionService {
+	return &SubmissionService{
+		repository: repository,
+		now:        time.Now,
+	}
+}
+
+// LastAcknowledgedPart returns the number of parts of the report from the
+// first that have all been acknowledged, parts after a missing part are sent
+// again.
+func (service *SubmissionService) LastAcknowledgedPart(report ReportSubmission) (int, error) {
+	submissions, err := service.repository.Submissions(report)
+	if err != nil {
+		return 0, err
+	}
+
+	last := 0
+	for _, submission := range submissions {
+		if int(submission.Part) != last+1 || submission.Status != SubmissionAcknowledged {
+			break
+		}
+		last++
+	}
+
+	return last, nil
+}
+
+// ReportIds returns the id the Reports API gave each acknowledged part of the
+// report by part number, parts acknowledged without an id are left out.
+func (service *SubmissionService) ReportIds(report ReportSubmission) (map[int]string, error) {
+	submissions, err := service.repository.Submissions(report)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[int]string)
+	for _, submission := range submissions {
+		if submission.Status == SubmissionAcknowledged && submission.ReportId != "" {
+			ids[int(submission.Part)] = submission.ReportId
+		}
+	}
+
+	return ids, nil
+}
+
+// CheckUncertain returns ErrUncertainSubmission when the part of the report
+// is uncertain
+func (service *SubmissionService) CheckUncertain(report ReportSubmission, part int) error {
+	submissions, err := service.repository.Submissions(report)
+	if err != nil {
+		return err
+	}
+
+	for _, submission := range submissions {
+		if int(submission.Part) == part && submission.Status == SubmissionUncertain {
+			return fmt.Errorf("part %d: %w, check the Reports API and resolve it", part, ErrUncertainSubmission)
+		}
+	}
+
+	return nil
+}
+
+// Acknowledge records that the Reports API accepted the part of the report
+// with the id it was given
+func (service *SubmissionService) Acknowledge(report ReportSubmission, part int, reportId string) error {
+	return service.record(report, part, reportId, SubmissionAcknowledged)
+}
+
+// MarkUncertain records that creating the part of the report failed after it
+// may have reached the Reports API
+func (service *SubmissionService) MarkUncertain(report ReportSubmission, part int) error {
+	return service.record(report, part, "", SubmissionUncertain)
+}
+
+// Resolve records what an operator found in the Reports API for a part of the
+// report. With the id of the report it was created as the part is
+// acknowledged, without one it was not created and is sent again.
+func (service *SubmissionService) Resolve(report ReportSubmission, part int, reportId string) error {
+	if reportId != "" {
+		return service.Acknowledge(report, part, reportId)
+	}
+
+	return service.record(report, part, "", SubmissionNotCreated)
+}
+
+func (service *SubmissionService) record(report ReportSubmission, part int, reportId string, status string) error {
+	report.Part = uint32(part)
+	report.ReportId = reportId
+	report.Status = status
+	report.Submitted = service.now()
+
+	return service.repository.CreateSubmission(&report)
+}
@@ -0,0 +1,7 @@
+package robots
+
+// Robot is an entry from the COUNTER robots list
+type Robot struct {
+	Pattern     string `json:"pattern"`
+	LastChanged string `json:"last_changed"`
+}
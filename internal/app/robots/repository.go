@@ -0,0 +1,51 @@
+package robots
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+type RobotsRepositoryReader interface {
+	// Return every robot in the list
+	GetAll() ([]Robot, error)
+	// Time the list was last changed, used to know when to reload
+	Modified() (time.Time, error)
+}
+
+//
+// File implementation of the robots repository, reads the COUNTER robots json
+//
+
+type RobotsFileRepository struct {
+	path string
+}
+
+func NewRobotsFileRepository(path string) *RobotsFileRepository {
+	return &RobotsFileRepository{
+		path: path,
+	}
+}
+
+func (repository *RobotsFileRepository) GetAll() ([]Robot, error) {
+	data, err := os.ReadFile(repository.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var robots []Robot
+	if err := json.Unmarshal(data, &robots); err != nil {
+		return nil, err
+	}
+
+	return robots, nil
+}
+
+func (repository *RobotsFileRepository) Modified() (time.Time, error) {
+	info, err := os.Stat(repository.path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return info.ModTime(), nil
+}
@@ -0,0 +1,227 @@
+package robots
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/datacite/keeshond/internal/app"
+)
+
+// Matcher holds every robot pattern compiled into a single case insensitive
+// regular expression, each pattern is wrapped in its own group so the robot
+// that matched can be found from the submatch positions.
+type Matcher struct {
+	regex  *regexp.Regexp
+	robots []Robot
+	// Index of the group belonging to each robot
+	groups []int
+}
+
+// NewMatcher compiles the robots into a single matcher, patterns that are not
+// valid regular expressions are skipped and reported in the returned error.
+func NewMatcher(robots []Robot) (*Matcher, error) {
+	matcher := &Matcher{}
+
+	var invalid []string
+	var alternatives []string
+
+	// Group 0 is the whole match so robot groups start at 1
+	group := 1
+	for _, robot := range robots {
+		compiled, err := regexp.Compile("(?i)" + robot.Pattern)
+		if err != nil {
+			invalid = append(invalid, robot.Pattern)
+			continue
+		}
+
+		alternatives = append(alternatives, "("+robot.Pattern+")")
+		matcher.robots = append(matcher.robots, robot)
+		matcher.groups = append(matcher.groups, group)
+
+		// Skip over any groups inside the pattern itself
+		group += 1 + compiled.NumSubexp()
+	}
+
+	if len(alternatives) > 0 {
+		regex, err := regexp.Compile("(?i)" + strings.Join(alternatives, "|"))
+		if err != nil {
+			return nil, err
+		}
+		matcher.regex = regex
+	}
+
+	if len(invalid) > 0 {
+		return matcher, fmt.Errorf("invalid robot patterns skipped: %s", strings.Join(invalid, ", "))
+	}
+
+	return matcher, nil
+}
+
+// Match returns the robot that matches the useragent
+func (matcher *Matcher) Match(userAgent string) (Robot, bool) {
+	if matcher == nil || matcher.regex == nil {
+		return Robot{}, false
+	}
+
+	submatches := matcher.regex.FindStringSubmatchIndex(userAgent)
+	if submatches == nil {
+		return Robot{}, false
+	}
+
+	for i, group := range matcher.groups {
+		if submatches[2*group] >= 0 {
+			return matcher.robots[i], true
+		}
+	}
+
+	return Robot{}, false
+}
+
+// Len returns the number of patterns in the matcher
+func (matcher *Matcher) Len() int {
+	if matcher == nil {
+		return 0
+	}
+	return len(matcher.robots)
+}
+
+type RobotsService struct {
+	repository     RobotsRepositoryReader
+	reloadInterval time.Duration
+	// Name of the list in log messages
+	list string
+
+	matcher atomic.Pointer[Matcher]
+
+	// Serialises reloads and guards modified
+	mu       sync.Mutex
+	modified time.Time
+}
+
+// NewRobotsService creates a new robots service, Load must be called before use
+func NewRobotsService(repository RobotsRepositoryReader, config *app.Config) *RobotsService {
+	return &RobotsService{
+		repository:     repository,
+		reloadInterval: config.Robots.ReloadInterval,
+		list:           "Robots list",
+	}
+}
+
+// NewMachineService creates a service matching the useragents of API clients
+// and scripts. They are machine access rather than robots, even when they are
+// on the robots list too. Load must be called before use.
+func NewMachineService(repository RobotsRepositoryReader, config *app.Config) *RobotsService {
+	service := NewRobotsService(repository, config)
+	service.list = "Machine agents list"
+	return service
+}
+
+// Load reads and compiles the robots list, on failure the previously loaded
+// list is kept in use.
+func (service *RobotsService) Load() error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	modified, err := service.repository.Modified()
+	if err != nil {
+		return err
+	}
+
+	robots, err := service.repository.GetAll()
+	if err != nil {
+		return err
+	}
+
+	if len(robots) == 0 {
+		return fmt.Errorf("%s is empty", strings.ToLower(service.list))
+	}
+
+	matcher, err := NewMatcher(robots)
+	if matcher == nil || matcher.Len() == 0 {
+		return err
+	}
+	if err != nil {
+		// Still use the valid patterns but let someone know
+		log.Println(err)
+	}
+
+	service.matcher.Store(matcher)
+	service.modified = modified
+
+	return nil
+}
+
+// Match returns the robot pattern that matches the useragent
+func (service *RobotsService) Match(userAgent string) (Robot, bool) {
+	return service.matcher.Load().Match(userAgent)
+}
+
+// IsBot checks if the useragent belongs to a known robot
+func (service *RobotsService) IsBot(userAgent string) bool {
+	_, ok := service.Match(userAgent)
+	return ok
+}
+
+// Loaded reports if a robots list is available for matching
+func (service *RobotsService) Loaded() bool {
+	return service.matcher.Load().Len() > 0
+}
+
+// Watch reloads the robots list when the process receives SIGHUP or the list
+// has changed since it was last loaded, it blocks until the context is done.
+func (service *RobotsService) Watch(ctx context.Context) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	// A nil channel never fires so polling is disabled without an interval
+	var poll <-chan time.Time
+	if service.reloadInterval > 0 {
+		ticker := time.NewTicker(service.reloadInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			service.reload("SIGHUP received")
+		case <-poll:
+			if service.changed() {
+				service.reload(strings.ToLower(service.list) + " changed")
+			}
+		}
+	}
+}
+
+func (service *RobotsService) changed() bool {
+	modified, err := service.repository.Modified()
+	if err != nil {
+		return false
+	}
+
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	return !modified.Equal(service.modified)
+}
+
+func (service *RobotsService) reload(reason string) {
+	if err := service.Load(); err != nil {
+		log.Printf("%s reload failed (%s): %v", service.list, reason, err)
+		return
+	}
+
+	log.Printf("%s reloaded (%s), %d patterns", service.list, reason, service.matcher.Load().Len())
+}
@@ -0,0 +1,158 @@
+package robots
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/datacite/keeshond/internal/app"
+)
+
+func writeRobotsFile(t *testing.T, path string, contents string, modified time.Time) {
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Set an explicit time so changes are seen regardless of filesystem precision
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMatcherReturnsMatchedPattern(t *testing.T) {
+	matcher, err := NewMatcher([]Robot{
+		{Pattern: "bot"},
+		// Patterns with their own groups must not shift the others
+		{Pattern: "Alexandria(\\s|\\+)prototype(\\s|\\+)project"},
+		{Pattern: "^ruby$"},
+		{Pattern: "spider"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		userAgent string
+		pattern   string
+		isBot     bool
+	}{
+		{"Googlebot/2.1 (+http://www.google.com/bot.html)", "bot", true},
+		{"alexandria prototype project", "Alexandria(\\s|\\+)prototype(\\s|\\+)project", true},
+		{"Ruby", "^ruby$", true},
+		{"Mozilla/5.0 (compatible; Baiduspider/2.0)", "spider", true},
+		{"ruby/2.7", "", false},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/115.0", "", false},
+	}
+
+	for _, test := range tests {
+		robot, ok := matcher.Match(test.userAgent)
+
+		if ok != test.isBot {
+			t.Errorf("Match(%q) should be %v", test.userAgent, test.isBot)
+		}
+
+		if robot.Pattern != test.pattern {
+			t.Errorf("Match(%q) matched pattern %q but expected %q", test.userAgent, robot.Pattern, test.pattern)
+		}
+	}
+}
+
+func TestMatcherSkipsInvalidPatterns(t *testing.T) {
+	matcher, err := NewMatcher([]Robot{
+		{Pattern: "bot"},
+		{Pattern: "broken("},
+		{Pattern: "crawl"},
+	})
+
+	if err == nil {
+		t.Errorf("NewMatcher should report the invalid pattern")
+	}
+
+	if matcher.Len() != 2 {
+		t.Errorf("Matcher should have 2 patterns but got %d", matcher.Len())
+	}
+
+	if robot, ok := matcher.Match("somecrawler"); !ok || robot.Pattern != "crawl" {
+		t.Errorf("Matcher should still match patterns after an invalid one")
+	}
+}
+
+func TestRobotsServiceLoadsCounterList(t *testing.T) {
+	repository := NewRobotsFileRepository("../../../data/COUNTER_Robots_list.json")
+	service := NewRobotsService(repository, &app.Config{})
+
+	if service.Loaded() {
+		t.Errorf("Service should not be loaded before Load is called")
+	}
+
+	if err := service.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !service.Loaded() {
+		t.Errorf("Service should be loaded")
+	}
+
+	if !service.IsBot("Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)") {
+		t.Errorf("Googlebot should be a bot")
+	}
+
+	if service.IsBot("Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.1 Safari/605.1.15") {
+		t.Errorf("Safari should not be a bot")
+	}
+}
+
+func TestMachineServiceLoadsMachineAgents(t *testing.T) {
+	repository := NewRobotsFileRepository("../../../data/machine_agents.json")
+	service := NewMachineService(repository, &app.Config{})
+
+	if err := service.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, useragent := range []string{"curl/8.4.0", "python-requests/2.31.0", "Wget/1.21.4", "Go-http-client/2.0"} {
+		if !service.IsBot(useragent) {
+			t.Errorf("%s should be a machine agent", useragent)
+		}
+	}
+
+	if service.IsBot("Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.1 Safari/605.1.15") {
+		t.Errorf("Safari should not be a machine agent")
+	}
+}
+
+func TestRobotsServiceReloadsChangedList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "robots.json")
+	modified := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	writeRobotsFile(t, path, `[{"pattern": "bot", "last_changed": "2017-08-08"}]`, modified)
+
+	service := NewRobotsService(NewRobotsFileRepository(path), &app.Config{})
+	if err := service.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	if service.changed() {
+		t.Errorf("List should not be changed straight after loading")
+	}
+
+	writeRobotsFile(t, path, `[{"pattern": "bot"}, {"pattern": "curl"}]`, modified.Add(time.Hour))
+
+	if !service.changed() {
+		t.Errorf("List should be changed after the file is updated")
+	}
+
+	service.reload("test")
+
+	if !service.IsBot("curl/7.64.1") {
+		t.Errorf("Reloaded list should match curl")
+	}
+
+	// A broken update keeps the previous list
+	writeRobotsFile(t, path, `not json`, modified.Add(2*time.Hour))
+	service.reload("test")
+
+	if !service.IsBot("curl/7.64.1") {
+		t.Errorf("Failed reload should keep the previous list")
+	}
+}
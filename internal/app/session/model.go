@@ -8,4 +8,5 @@ type Salt struct {
 	ID      uint `gorm:"primary key;autoIncrement"`
 	Salt    []byte
 	Created time.Time
+	Day     time.Time `gorm:"type:Date"` // UTC day the salt is used for
 }
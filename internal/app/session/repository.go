@@ -1,13 +1,16 @@
 package session
 
 import (
+	"time"
+
 	"github.com/datacite/keeshond/internal/app"
 	"gorm.io/gorm"
 )
 
 type SessionRepositoryReader interface {
 	Create(salt *Salt) error
-	Get() (Salt, error)
+	GetForDay(day time.Time) (Salt, error)
+	DeleteBefore(day time.Time) error
 }
 
 type SessionRepository struct {
@@ -26,10 +29,18 @@ func (repository *SessionRepository) Create(salt *Salt) error {
 	return repository.db.Create(salt).Error
 }
 
-func (repository *SessionRepository) Get() (Salt, error) {
+// GetForDay returns the salt for a day. When more than one replica created a
+// salt for the same day the lowest salt is chosen so they all agree.
+func (repository *SessionRepository) GetForDay(day time.Time) (Salt, error) {
 	var salt Salt
-	if err := repository.db.First(&salt).Error; err != nil {
-		return salt, err
-	}
-	return salt, nil
+	err := repository.db.
+		Where("day = ?", day.Format("2006-01-02")).
+		Order("salt ASC").
+		Take(&salt).Error
+	return salt, err
+}
+
+// DeleteBefore deletes the salts of all days before the given day
+func (repository *SessionRepository) DeleteBefore(day time.Time) error {
+	return repository.db.Where("day < ?", day.Format("2006-01-02")).Delete(&Salt{}).Error
 }
@@ -1,10 +1,15 @@
 package session
 
 import (
+	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"hash/fnv"
 	"io"
+	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/datacite/keeshond/internal/app"
@@ -12,9 +17,22 @@ import (
 	"gorm.io/gorm"
 )
 
+// Time for the salts other replicas created for the same day at once to be
+// seen, until then the salt is read again rather than kept
+const saltSettleTime = time.Minute
+
 type SessionService struct {
 	repository SessionRepositoryReader
 	config     *app.Config
+
+	// Current salt, read on every event so kept in memory
+	current atomic.Pointer[currentSalt]
+
+	// Serialises rotations
+	mu sync.Mutex
+
+	// Clock, replaced in tests
+	now func() time.Time
 }
 
 // NewSessionService creates a new session service
@@ -22,23 +40,29 @@ func NewSessionService(repository SessionRepositoryReader, config *app.Config) *
 	return &SessionService{
 		repository: repository,
 		config:     config,
+		now:        time.Now,
 	}
 }
 
-func (service *SessionService) CreateSalt() error {
-	// Generate random salt
-	salt, err := generateSalt()
-	if err != nil {
-		return err
-	}
+// The salt in use and when it was read from the repository
+type currentSalt struct {
+	salt Salt
+	read time.Time
+}
 
-	// Store the salt
-	err = service.repository.Create(&salt)
+// settled reports whether the salt was read long enough after it was created
+// that every replica has seen the same one
+func (current *currentSalt) settled() bool {
+	return current.read.Sub(current.salt.Created) >= saltSettleTime
+}
 
-	return err
+// Day returns the start of the UTC day of a time, salts are rotated at UTC
+// midnight.
+func Day(t time.Time) time.Time {
+	return time.Date(t.UTC().Year(), t.UTC().Month(), t.UTC().Day(), 0, 0, 0, 0, time.UTC)
 }
 
-func generateSalt() (Salt, error) {
+func generateSalt(day time.Time) (Salt, error) {
 	// Generate a new random salt byte array
 	saltBytes := make([]byte, 16)
 	_, err := io.ReadFull(rand.Reader, saltBytes)
@@ -50,46 +74,126 @@ func generateSalt() (Salt, error) {
 	salt := Salt{
 		Salt:    saltBytes,
 		Created: time.Now(),
+		Day:     day,
 	}
 
 	return salt, nil
 }
 
+// GetSalt returns the salt for the current UTC day. It comes from memory
+// unless the day has changed and the salt has not been rotated yet, or the
+// salt was created so recently that another replica may have created one at
+// the same time. Then it is read again, so all replicas end up with the
+// lowest salt of the day.
 func (service *SessionService) GetSalt() (Salt, error) {
+	today := Day(service.now())
 
-	// Get the current salt
-	currentSalt, err := service.repository.Get()
-
-	// TODO: The following setup probably should not happen on a get call, instead
-	// the salt should be created ahead of time and a rotation job seperatly.
-
-	// If not found, create a new salt
-	if err == gorm.ErrRecordNotFound {
-		err = service.CreateSalt()
+	current := service.current.Load()
+	if current != nil && current.salt.Day.Equal(today) {
+		if current.settled() {
+			return current.salt, nil
+		}
 
-		// If there was an error, return it
+		salt, err := service.repository.GetForDay(today)
 		if err != nil {
-			return currentSalt, err
+			return Salt{}, err
 		}
 
-		// Get the current salt again
-		currentSalt, err = service.repository.Get()
+		service.use(salt, today)
+		return salt, nil
 	}
 
-	// Generate a new salt if salt created is older than a day
-	if currentSalt.Created.Add(time.Hour * 24).Before(time.Now()) {
-		err = service.CreateSalt()
+	if err := service.Rotate(); err != nil {
+		return Salt{}, err
+	}
 
-		// If there was an error, return it
-		if err != nil {
-			return currentSalt, err
-		}
+	return service.current.Load().salt, nil
+}
 
-		// Get the current salt again
-		currentSalt, err = service.repository.Get()
+// use makes the salt read from the repository the one in use for the day
+func (service *SessionService) use(salt Salt, day time.Time) {
+	// Compared against in GetSalt so use the same location as the clock
+	salt.Day = day
+	service.current.Store(&currentSalt{salt: salt, read: service.now()})
+}
+
+// Rotate makes the salt for the current day the one in use. Tomorrow's salt is
+// created ahead of time so every replica has agreed on it by midnight, and
+// salts older than the retention window are deleted so user ids from those
+// days cannot be recomputed.
+func (service *SessionService) Rotate() error {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	today := Day(service.now())
+
+	salt, err := service.saltForDay(today)
+	if err != nil {
+		return err
+	}
+
+	service.use(salt, today)
+
+	if _, err := service.saltForDay(today.AddDate(0, 0, 1)); err != nil {
+		return fmt.Errorf("failed to create salt for tomorrow: %w", err)
+	}
+
+	if err := service.repository.DeleteBefore(today.AddDate(0, 0, -service.config.Salt.RetentionDays)); err != nil {
+		return fmt.Errorf("failed to delete expired salts: %w", err)
 	}
 
-	return currentSalt, nil
+	return nil
+}
+
+// saltForDay returns the salt for a day creating it if there is none yet, it
+// is read back after creating so the lowest salt of the day wins. Salts other
+// replicas create at the same time may only be seen later, see GetSalt.
+func (service *SessionService) saltForDay(day time.Time) (Salt, error) {
+	salt, err := service.repository.GetForDay(day)
+	if err == nil {
+		return salt, nil
+	}
+
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return salt, err
+	}
+
+	newSalt, err := generateSalt(day)
+	if err != nil {
+		return salt, err
+	}
+	newSalt.Created = service.now()
+
+	if err := service.repository.Create(&newSalt); err != nil {
+		return salt, err
+	}
+
+	return service.repository.GetForDay(day)
+}
+
+// Run rotates the salt at every UTC midnight until the context is done, a
+// failed rotation is retried every minute. Rotate should be called once before
+// so a salt is ready for the first events.
+func (service *SessionService) Run(ctx context.Context) {
+	for {
+		wait := time.Until(Day(service.now()).AddDate(0, 0, 1))
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+
+			err := service.Rotate()
+			if err == nil {
+				break
+			}
+
+			log.Printf("Salt rotation failed: %v", err)
+			wait = time.Minute
+		}
+	}
 }
 
 func GenerateSessionId(user_id uint64, time time.Time) uint64 {
@@ -1,10 +1,71 @@
 package session
 
 import (
+	"bytes"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/datacite/keeshond/internal/app"
+	"gorm.io/gorm"
 )
 
+// In memory salt repository shared by services acting as separate replicas
+type MockSessionRepository struct {
+	mu    sync.Mutex
+	salts []Salt
+	reads int
+}
+
+func (m *MockSessionRepository) Create(salt *Salt) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.salts = append(m.salts, *salt)
+	return nil
+}
+
+func (m *MockSessionRepository) GetForDay(day time.Time) (Salt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reads++
+
+	var found *Salt
+	for i, salt := range m.salts {
+		if salt.Day.Equal(day) && (found == nil || bytes.Compare(salt.Salt, found.Salt) < 0) {
+			found = &m.salts[i]
+		}
+	}
+
+	if found == nil {
+		return Salt{}, gorm.ErrRecordNotFound
+	}
+	return *found, nil
+}
+
+func (m *MockSessionRepository) DeleteBefore(day time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var kept []Salt
+	for _, salt := range m.salts {
+		if !salt.Day.Before(day) {
+			kept = append(kept, salt)
+		}
+	}
+	m.salts = kept
+	return nil
+}
+
+func buildSessionService(repository SessionRepositoryReader, retentionDays int, now *time.Time) *SessionService {
+	config := &app.Config{}
+	config.Salt.RetentionDays = retentionDays
+
+	service := NewSessionService(repository, config)
+	service.now = func() time.Time { return *now }
+
+	return service
+}
+
 func TestGenerateUserId(t *testing.T) {
 	// Create fake salt
 	salt := Salt{
@@ -43,3 +104,164 @@ func TestGenerateSessionId(t *testing.T) {
 		t.Fatalf(`Session id is not %d`, expected)
 	}
 }
+
+func TestGetSaltCachesSaltForTheDay(t *testing.T) {
+	repository := &MockSessionRepository{}
+	now := time.Date(2024, time.March, 10, 9, 0, 0, 0, time.UTC)
+	service := buildSessionService(repository, 0, &now)
+
+	first, err := service.GetSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The salt this replica created is read once more after it has settled
+	now = now.Add(time.Hour)
+	if _, err := service.GetSalt(); err != nil {
+		t.Fatal(err)
+	}
+
+	reads := repository.reads
+	now = now.Add(13 * time.Hour)
+
+	second, err := service.GetSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(first.Salt, second.Salt) {
+		t.Errorf("Salt should not change within a day")
+	}
+
+	if repository.reads != reads {
+		t.Errorf("Salt should come from memory within a day")
+	}
+
+	// Tomorrow's salt is created ahead of time
+	if len(repository.salts) != 2 {
+		t.Errorf("Expected salts for today and tomorrow but got %d", len(repository.salts))
+	}
+}
+
+func TestGetSaltRotatesAtUTCMidnight(t *testing.T) {
+	repository := &MockSessionRepository{}
+	now := time.Date(2024, time.March, 10, 23, 59, 0, 0, time.UTC)
+	service := buildSessionService(repository, 0, &now)
+
+	today, _ := service.GetSalt()
+	tomorrow, _ := repository.GetForDay(Day(now).AddDate(0, 0, 1))
+
+	// Local times must not matter, this is already the next UTC day
+	now = time.Date(2024, time.March, 10, 20, 0, 1, 0, time.FixedZone("EDT", -4*60*60))
+
+	rotated, err := service.GetSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(rotated.Salt, today.Salt) {
+		t.Errorf("Salt should change at UTC midnight")
+	}
+
+	if !bytes.Equal(rotated.Salt, tomorrow.Salt) {
+		t.Errorf("Rotated salt should be the one created ahead of time")
+	}
+
+	// Yesterday's salt is deleted so user ids can not be recomputed
+	for _, salt := range repository.salts {
+		if bytes.Equal(salt.Salt, today.Salt) {
+			t.Errorf("Previous day's salt should be deleted")
+		}
+	}
+}
+
+func TestRotateKeepsSaltsWithinRetention(t *testing.T) {
+	repository := &MockSessionRepository{}
+	now := time.Date(2024, time.March, 10, 12, 0, 0, 0, time.UTC)
+	service := buildSessionService(repository, 2, &now)
+
+	for i := 0; i < 5; i++ {
+		if err := service.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+		now = now.AddDate(0, 0, 1)
+	}
+
+	// Two days retained, today and tomorrow
+	if len(repository.salts) != 4 {
+		t.Errorf("Expected 4 salts but got %d", len(repository.salts))
+	}
+}
+
+func TestReplicasAgreeOnSalt(t *testing.T) {
+	repository := &MockSessionRepository{}
+	now := time.Date(2024, time.March, 10, 12, 0, 0, 0, time.UTC)
+
+	// Both replicas create a salt for the same day before seeing the other's
+	day := Day(now)
+	first, _ := generateSalt(day)
+	second, _ := generateSalt(day)
+	repository.Create(&first)
+	repository.Create(&second)
+
+	a, err := buildSessionService(repository, 0, &now).GetSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := buildSessionService(repository, 0, &now).GetSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(a.Salt, b.Salt) {
+		t.Errorf("Replicas should choose the same salt")
+	}
+}
+
+func TestReplicasAgreeOnSaltsCreatedAtOnce(t *testing.T) {
+	repository := &MockSessionRepository{}
+	now := time.Date(2024, time.March, 10, 12, 0, 0, 0, time.UTC)
+
+	// The first replica finds no salt, creates one and reads it back before
+	// the salt of the second is stored
+	a := buildSessionService(repository, 0, &now)
+	first, err := a.GetSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lowest := Salt{Salt: make([]byte, 16), Created: now, Day: Day(now)}
+	repository.Create(&lowest)
+
+	b := buildSessionService(repository, 0, &now)
+	second, err := b.GetSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(first.Salt, second.Salt) {
+		t.Fatal("The second salt should be lower than the first")
+	}
+
+	// Both read the salt again until it has settled
+	now = now.Add(30 * time.Second)
+	if salt, _ := a.GetSalt(); !bytes.Equal(salt.Salt, lowest.Salt) {
+		t.Errorf("The first replica should see the lowest salt")
+	}
+
+	now = now.Add(time.Minute)
+	for _, service := range []*SessionService{a, b} {
+		if salt, _ := service.GetSalt(); !bytes.Equal(salt.Salt, lowest.Salt) {
+			t.Errorf("Replicas should agree on the lowest salt")
+		}
+	}
+
+	// Then it comes from memory
+	reads := repository.reads
+	a.GetSalt()
+	b.GetSalt()
+	if repository.reads != reads {
+		t.Errorf("A settled salt should come from memory but was read %d times", repository.reads-reads)
+	}
+}
@@ -25,8 +25,92 @@ type BreakdownResult struct {
 	UniqueDownloads int64  `json:"unique_downloads"`
 }
 
+// Breakdown of a pid within one country and access method, Period is the
+// start of the period when the query has an interval and zero otherwise
+type PidCountryResult struct {
+	Period       time.Time `json:"period"`
+	Country      string    `json:"country"`
+	AccessMethod string    `json:"access_method"`
+	BreakdownResult
+}
+
+// Breakdown of a pid for one access method, Period is the start of the period
+// when the query has an interval and zero otherwise
+type PidAccessMethodResult struct {
+	Period       time.Time `json:"period"`
+	AccessMethod string    `json:"access_method"`
+	BreakdownResult
+}
+
+// Dimensions a breakdown can be grouped and filtered by
+const (
+	DimensionPid        = "pid"
+	DimensionUrlPath    = "url_path"    // Path of the url without the query string
+	DimensionHostDomain = "host_domain" // Host of the url without www.
+	DimensionName       = "name"        // Event name, view or download
+	DimensionCountry    = "country"
+	DimensionDayOfWeek  = "day_of_week" // Monday to Sunday
+	DimensionUrl        = "url"         // Full url, only for filters
+)
+
+// Breakdown of a repository by one or more dimensions, see ParseBreakdown
+type Breakdown struct {
+	Dimensions []string // Dimensions to group by, in order
+	Sort       string   // Metric to sort by, sorted by the dimensions when empty
+	Ascending  bool     // Sort the metric smallest first
+}
+
+// Operators a filter can compare a dimension with its value by
+const (
+	FilterEquals    = "=="
+	FilterNotEquals = "!="
+	FilterPrefix    = "=~" // Starts with the value, see Filter
+)
+
+// Filter limits a query to the usage where the dimension matches the value,
+// see ParseFilters. A url prefix starting with / is matched against the path
+// of the url, otherwise against the whole url.
+type Filter struct {
+	Dimension string
+	Operator  string
+	Value     string
+}
+
+// Breakdown by dimensions, dimensions that are not grouped by are nil and
+// left out of the json
+type DimensionBreakdownResult struct {
+	Pid             *string `json:"pid,omitempty"`
+	UrlPath         *string `json:"url_path,omitempty"`
+	HostDomain      *string `json:"host_domain,omitempty"`
+	Name            *string `json:"name,omitempty"`
+	Country         *string `json:"country,omitempty"`
+	DayOfWeek       *string `json:"day_of_week,omitempty"`
+	TotalViews      int64   `json:"total_views"`
+	UniqueViews     int64   `json:"unique_views"`
+	TotalDownloads  int64   `json:"total_downloads"`
+	UniqueDownloads int64   `json:"unique_downloads"`
+}
+
+// Human and robot traffic for a repository, these are counts of requests so
+// double clicks are not removed, this keeps them comparable with each other.
+type TrafficResult struct {
+	HumanViews     int64                `json:"human_views"`
+	HumanDownloads int64                `json:"human_downloads"`
+	RobotViews     int64                `json:"robot_views"`
+	RobotDownloads int64                `json:"robot_downloads"`
+	RobotPatterns  []RobotPatternResult `json:"robot_patterns" gorm:"-"`
+}
+
+// Requests filtered by a single pattern of the robots list
+type RobotPatternResult struct {
+	Pattern   string `json:"pattern"`
+	Views     int64  `json:"views"`
+	Downloads int64  `json:"downloads"`
+}
+
 type Query struct {
 	Start    time.Time // Beginning of the query period
 	End      time.Time // End of the query period
-	Interval string    // Interval to break the results into e.g. "day", "month", "hour"
+	Interval string    // Interval to break the results into e.g. "day", "month", "year", "hour"
+	Filters  []Filter  // Only usage matching every filter is counted
 }
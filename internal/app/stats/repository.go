@@ -1,10 +1,14 @@
 package stats
 
 import (
+	"log"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/WinterYukky/gorm-extra-clause-plugin/exclause"
 	"github.com/datacite/keeshond/internal/app/event"
+	"github.com/datacite/keeshond/internal/app/metrics"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
@@ -16,10 +20,18 @@ type StatsRepositoryReader interface {
 	Timeseries(repoId string, query Query) []TimeseriesResult
 	// For a specific repository return for the specified time query and grouped by PID.
 	BreakdownByPID(repoId string, query Query, limit int, page int) []BreakdownResult
+	// Same as BreakdownByPID but each PID is split by country and access method, and by period when the query has an interval.
+	BreakdownByPIDAndCountry(repoId string, query Query, page int, pageSize int) []PidCountryResult
+	// Same as BreakdownByPID but each PID is split by access method, and by period when the query has an interval.
+	BreakdownByPIDAndAccessMethod(repoId string, query Query, page int, pageSize int) []PidAccessMethodResult
+	// For a specific repository return for the specified time query and grouped by the dimensions of the breakdown.
+	Breakdown(repoId string, query Query, breakdown Breakdown, page int, pageSize int) []DimensionBreakdownResult
 	// Return count of unique PIDs for repository over time period.
 	CountUniquePID(repoId string, query Query) int64
 	// Get last recorded event for a repository
 	LastEvent(repoId string) (event.Event, bool)
+	// For a specific repository return human and robot traffic for the specified time query
+	Traffic(repoId string, query Query) TrafficResult
 }
 
 type StatsRepository struct {
@@ -32,7 +44,124 @@ func NewStatsRepository(db *gorm.DB) *StatsRepository {
 	}
 }
 
+// Clicks on the same item by the same session within this window of each other
+// are a double click and only counted once, as defined by the COUNTER Code of Practice.
+const DoubleClickWindow = 30 * time.Second
+
+// dedupedEvents selects the events of a repository within the timestamp scope
+// with double clicks removed. An event is dropped when the same user has the
+// same event on the same pid again within the double click window, so from a
+// run of clicks only the last is counted. Comparing each event to the next one
+// of the user rather than bucketing by time means clicks either side of a
+// bucket boundary are still caught, the session would change on the hour. Filters are applied once double clicks are
+// removed, except on the pid and event name which can't change which clicks
+// are doubles so also limit the events read.
+func (repository *StatsRepository) dedupedEvents(repoId string, timestampScope func(db *gorm.DB) *gorm.DB, filters []Filter) *gorm.DB {
+	var clickFilters []Filter
+	for _, filter := range filters {
+		if filter.Dimension == DimensionPid || filter.Dimension == DimensionName {
+			clickFilters = append(clickFilters, filter)
+		}
+	}
+
+	// Find the time of the next matching click, null when there is none
+	withNextClick := repository.db.Model(&event.Event{}).
+		Select("name, pid, url, country, access_method, session_id, timestamp, leadInFrame(toNullable(timestamp)) OVER (PARTITION BY name, pid, user_id ORDER BY timestamp ASC ROWS BETWEEN CURRENT ROW AND 1 FOLLOWING) as next_click").
+		Scopes(RepoId(repoId), Confirmed, timestampScope, Filters(clickFilters, eventDimensions))
+
+	return repository.db.Table("(?) as with_next_click", withNextClick).
+		Select("name, pid, url, country, access_method, session_id, timestamp").
+		Where("next_click IS NULL OR toUnixTimestamp64Milli(next_click) - toUnixTimestamp64Milli(timestamp) > ?", DoubleClickWindow.Milliseconds()).
+		Scopes(Filters(filters, eventDimensions))
+}
+
+// Table holding the deduplicated events rolled up per repository, pid, event
+// name and day. It is filled by a materialized view once each day is over,
+// which makes the last week again so rows are replaced and read with FINAL.
+const RollupTable = "events_daily"
+
+// Pivot totals and unique counts per event name into the result metrics
+const metricColumns = "sumIf(total, name = 'view') as total_views, sumIf(unique_total, name = 'view') as unique_views, sumIf(total, name = 'download') as total_downloads, sumIf(unique_total, name = 'download') as unique_downloads"
+
+// rollupPeriod returns the whole days of the query that can be read from the
+// daily rollup. Hourly queries, queries filtered by the url and days that are
+// not rolled up yet need to be read from the events. Each repository is
+// rolled up on its own so how far it goes is that of the repository.
+func (repository *StatsRepository) rollupPeriod(repoId string, query Query) (time.Time, time.Time, bool) {
+	if query.Interval == "hour" {
+		return time.Time{}, time.Time{}, false
+	}
+
+	for _, filter := range query.Filters {
+		if _, ok := dailyDimensions[filter.Dimension]; !ok {
+			return time.Time{}, time.Time{}, false
+		}
+	}
+
+	var rollup struct {
+		LastDay time.Time
+	}
+
+	repository.db.Table(RollupTable).Select("max(date) as last_day").Scopes(RepoId(repoId)).Scan(&rollup)
+
+	// Nothing has been rolled up yet
+	if rollup.LastDay.Year() <= 1970 {
+		return time.Time{}, time.Time{}, false
+	}
+
+	location := query.Start.Location()
+
+	// First whole day of the query
+	from := time.Date(query.Start.Year(), query.Start.Month(), query.Start.Day(), 0, 0, 0, 0, location)
+	if from.Before(query.Start) {
+		from = from.AddDate(0, 0, 1)
+	}
+
+	// End of the last whole day of the query, but no later than the rollup
+	to := time.Date(query.End.Year(), query.End.Month(), query.End.Day(), 0, 0, 0, 0, location)
+	rollupEnd := time.Date(rollup.LastDay.Year(), rollup.LastDay.Month(), rollup.LastDay.Day(), 0, 0, 0, 0, location).AddDate(0, 0, 1)
+	if rollupEnd.Before(to) {
+		to = rollupEnd
+	}
+
+	return from, to, from.Before(to)
+}
+
+// dailyStats selects for each day, pid, event name, country and access method the total count and the
+// state of unique sessions. Whole days are read from the rollup when possible
+// and the rest from the deduplicated events, unique session states are merged
+// later on so unique counts over many days stay exact.
+func (repository *StatsRepository) dailyStats(repoId string, query Query) *gorm.DB {
+	rollupFrom, rollupTo, useRollup := repository.rollupPeriod(repoId, query)
+
+	if !useRollup {
+		return repository.dailyEventStats(repoId, TimestampCustom(query.Start, query.End), query.Filters)
+	}
+
+	// The part day before and any days after the rollup
+	events := repository.dailyEventStats(repoId, func(db *gorm.DB) *gorm.DB {
+		return db.Where("(timestamp > ? AND timestamp < ?) OR (timestamp >= ? AND timestamp < ?)", query.Start, rollupFrom, rollupTo, query.End)
+	}, query.Filters)
+
+	rollup := repository.db.Table(RollupTable+" FINAL").
+		Select("date, pid, name, country, access_method, sum(total) as total, uniqMergeState(unique_sessions) as unique_sessions").
+		Scopes(RepoId(repoId)).
+		Where("date >= ? AND date < ?", rollupFrom.Format("2006-01-02"), rollupTo.Format("2006-01-02")).
+		Scopes(Filters(query.Filters, dailyDimensions)).
+		Group("date, pid, name, country, access_method")
+
+	return repository.db.Raw("? UNION ALL ?", events, rollup)
+}
+
+func (repository *StatsRepository) dailyEventStats(repoId string, timestampScope func(db *gorm.DB) *gorm.DB, filters []Filter) *gorm.DB {
+	return repository.db.Table("(?) as deduped", repository.dedupedEvents(repoId, timestampScope, filters)).
+		Select("toDate(timestamp) as date, pid, name, country, access_method, count() as total, uniqState(session_id) as unique_sessions").
+		Group("date, pid, name, country, access_method")
+}
+
 func (repository *StatsRepository) LastEvent(repoId string) (event.Event, bool) {
+	defer metrics.ObserveSince(metrics.StatsQueryDuration, time.Now(), "last_event")
+
 	var e event.Event
 
 	result := repository.db.
@@ -48,51 +177,48 @@ func (repository *StatsRepository) LastEvent(repoId string) (event.Event, bool)
 }
 
 func (repository *StatsRepository) Aggregate(repoId string, query Query) AggregateResult {
+	defer metrics.ObserveSince(metrics.StatsQueryDuration, time.Now(), "aggregate")
+
 	var result AggregateResult
 
-	// Get timestamp scope from query start and end
-	timestampScope := TimestampCustom(query.Start, query.End)
+	byName := repository.db.Table("(?) as daily_stats", repository.dailyStats(repoId, query)).
+		Select("name, sum(total) as total, uniqMerge(unique_sessions) as unique_total").
+		Group("name")
 
-	repository.db.
-		Clauses(
-			exclause.NewWith(
-				"time_period_deduped", repository.db.Model(&event.Event{}).
-					Select("name, pid, session_id, toStartOfInterval(timestamp, INTERVAL 30 second) as interval_alias").
-					Scopes(RepoId(repoId), timestampScope).
-					Group("name, pid, session_id, interval_alias order by interval_alias"),
-			),
-		).Table("time_period_deduped").
-		Select("countIf(name = 'view') as total_views, uniqIf(session_id, name = 'view') as unique_views, countIf(name = 'download') as total_downloads, uniqIf(session_id, name = 'download') as unique_downloads").
+	repository.db.Table("(?) as by_name", byName).
+		Select(metricColumns).
 		Scan(&result)
 
 	return result
 }
 
 func (repository *StatsRepository) Timeseries(repoId string, query Query) []TimeseriesResult {
+	defer metrics.ObserveSince(metrics.StatsQueryDuration, time.Now(), "timeseries")
+
 	var result []TimeseriesResult
 
-	// Get timestamp scope from query start and end
-	timestampScope := TimestampCustom(query.Start, query.End)
-
-	db := repository.db.Debug().
-		Clauses(
-			exclause.NewWith(
-				"time_period_deduped", repository.db.Model(&event.Event{}).
-					Select("name, pid, session_id, toStartOfInterval(timestamp, INTERVAL 30 second) as interval_alias").
-					Scopes(RepoId(repoId), timestampScope).
-					Group("name, pid, session_id, interval_alias order by interval_alias"),
-			),
-		).Table("time_period_deduped")
+	var db *gorm.DB
 
 	switch query.Interval {
 	case "month":
-		db = db.Select("toStartOfMonth(interval_alias) as date, countIf(name = 'view') as total_views, uniqIf(session_id, name = 'view') as unique_views, countIf(name = 'download') as total_downloads, uniqIf(session_id, name = 'download') as unique_downloads")
+		byName := repository.db.Table("(?) as daily_stats", repository.dailyStats(repoId, query)).
+			Select("toStartOfMonth(date) as period, name, sum(total) as total, uniqMerge(unique_sessions) as unique_total").
+			Group("period, name")
+		db = repository.db.Table("(?) as by_name", byName).Select("period as date, " + metricColumns)
 	case "hour":
-		db = db.Select("toStartOfHour(interval_alias) as date, countIf(name = 'view') as total_views, uniqIf(session_id, name = 'view') as unique_views, countIf(name = 'download') as total_downloads, uniqIf(session_id, name = 'download') as unique_downloads")
+		// Hours are finer than the rollup so always come from the events
+		db = repository.db.
+			Clauses(
+				exclause.NewWith("time_period_deduped", repository.dedupedEvents(repoId, TimestampCustom(query.Start, query.End), query.Filters)),
+			).Table("time_period_deduped").
+			Select("toStartOfHour(timestamp) as date, countIf(name = 'view') as total_views, uniqIf(session_id, name = 'view') as unique_views, countIf(name = 'download') as total_downloads, uniqIf(session_id, name = 'download') as unique_downloads")
 	case "day":
 		fallthrough
 	default:
-		db = db.Select("toStartOfDay(interval_alias) as date, countIf(name = 'view') as total_views, uniqIf(session_id, name = 'view') as unique_views, countIf(name = 'download') as total_downloads, uniqIf(session_id, name = 'download') as unique_downloads")
+		byName := repository.db.Table("(?) as daily_stats", repository.dailyStats(repoId, query)).
+			Select("toDateTime(date) as period, name, sum(total) as total, uniqMerge(unique_sessions) as unique_total").
+			Group("period, name")
+		db = repository.db.Table("(?) as by_name", byName).Select("period as date, " + metricColumns)
 	}
 
 	db = db.Group("date")
@@ -120,21 +246,16 @@ func (repository *StatsRepository) Timeseries(repoId string, query Query) []Time
 }
 
 func (repository *StatsRepository) BreakdownByPID(repoId string, query Query, page int, pageSize int) []BreakdownResult {
+	defer metrics.ObserveSince(metrics.StatsQueryDuration, time.Now(), "breakdown")
+
 	var result []BreakdownResult
 
-	// Get timestamp scope from query start and end
-	timestampScope := TimestampCustom(query.Start, query.End)
+	byName := repository.db.Table("(?) as daily_stats", repository.dailyStats(repoId, query)).
+		Select("pid, name, sum(total) as total, uniqMerge(unique_sessions) as unique_total").
+		Group("pid, name")
 
-	repository.db.
-		Clauses(
-			exclause.NewWith(
-				"time_period_deduped", repository.db.Model(&event.Event{}).
-					Select("name, pid, session_id, toStartOfInterval(timestamp, INTERVAL 30 second) as interval_alias").
-					Scopes(RepoId(repoId), timestampScope).
-					Group("name, pid, session_id, interval_alias order by interval_alias"),
-			),
-		).Table("time_period_deduped").
-		Select("pid, countIf(name = 'view') as total_views, uniqIf(session_id, name = 'view') as unique_views, countIf(name = 'download') as total_downloads, uniqIf(session_id, name = 'download') as unique_downloads").
+	repository.db.Table("(?) as by_name", byName).
+		Select("pid, " + metricColumns).
 		Group("pid").
 		Order("pid").
 		Scopes(Paginate(page, pageSize)).
@@ -143,17 +264,229 @@ func (repository *StatsRepository) BreakdownByPID(repoId string, query Query, pa
 	return result
 }
 
+// periodColumn returns the start of the day, month or year of the date of the
+// daily stats, months are the default.
+func periodColumn(interval string) string {
+	switch interval {
+	case "day":
+		return "date"
+	case "year":
+		return "toStartOfYear(date)"
+	case "month":
+		fallthrough
+	default:
+		return "toStartOfMonth(date)"
+	}
+}
+
+// BreakdownByPIDAndCountry pages through pids in the same order as
+// BreakdownByPID, splitting each by country and access method.
+func (repository *StatsRepository) BreakdownByPIDAndCountry(repoId string, query Query, page int, pageSize int) []PidCountryResult {
+	defer metrics.ObserveSince(metrics.StatsQueryDuration, time.Now(), "breakdown_by_country")
+
+	var result []PidCountryResult
+
+	repository.pidBreakdown(repoId, query, page, pageSize, "country, access_method").Scan(&result)
+
+	return result
+}
+
+// BreakdownByPIDAndAccessMethod pages through pids in the same order as
+// BreakdownByPID, splitting each by access method.
+func (repository *StatsRepository) BreakdownByPIDAndAccessMethod(repoId string, query Query, page int, pageSize int) []PidAccessMethodResult {
+	defer metrics.ObserveSince(metrics.StatsQueryDuration, time.Now(), "breakdown_by_access_method")
+
+	var result []PidAccessMethodResult
+
+	repository.pidBreakdown(repoId, query, page, pageSize, "access_method").Scan(&result)
+
+	return result
+}
+
+// pidBreakdown selects a page of pids in the same order as BreakdownByPID,
+// split by the columns of the daily stats and by days, months or years of the
+// query interval when it has one. Rows are ordered by pid then the columns.
+func (repository *StatsRepository) pidBreakdown(repoId string, query Query, page int, pageSize int, columns string) *gorm.DB {
+	groups := "pid, " + columns
+	if query.Interval != "" {
+		groups += ", period"
+	}
+
+	pids := repository.db.Table("daily_stats").
+		Distinct("pid").
+		Order("pid").
+		Scopes(Paginate(page, pageSize))
+
+	byName := repository.db.Table("daily_stats").
+		Select(periodColumn(query.Interval)+" as period, pid, "+columns+", name, sum(total) as total, uniqMerge(unique_sessions) as unique_total").
+		Where("pid IN (?)", pids).
+		Group("period, pid, " + columns + ", name")
+
+	return repository.db.
+		Clauses(
+			exclause.NewWith("daily_stats", repository.dailyStats(repoId, query)),
+		).
+		Table("(?) as by_name", byName).
+		Select(groups + ", " + metricColumns).
+		Group(groups).
+		Order(groups)
+}
+
+// Columns of each breakdown dimension in the daily stats, the url is not
+// rolled up so url dimensions are only in the events
+var dailyDimensions = map[string]string{
+	DimensionPid:       "pid",
+	DimensionName:      "name",
+	DimensionCountry:   "country",
+	DimensionDayOfWeek: "dateName('weekday', date)",
+}
+
+// Columns of each breakdown dimension in the deduplicated events, the whole
+// url can only be filtered on
+var eventDimensions = map[string]string{
+	DimensionPid:        "pid",
+	DimensionUrl:        "url",
+	DimensionUrlPath:    "path(url)",
+	DimensionHostDomain: "domainWithoutWWW(url)",
+	DimensionName:       "name",
+	DimensionCountry:    "country",
+	DimensionDayOfWeek:  "dateName('weekday', timestamp)",
+}
+
+// Metrics a breakdown can be sorted by
+var breakdownMetrics = map[string]bool{
+	"total_views":      true,
+	"unique_views":     true,
+	"total_downloads":  true,
+	"unique_downloads": true,
+}
+
+// Breakdown groups the usage by the dimensions of the breakdown. Usage is read
+// from the daily stats unless a dimension is on the url, then the whole query
+// period is read from the events. Only columns from the dimension whitelists
+// are put into the query.
+func (repository *StatsRepository) Breakdown(repoId string, query Query, breakdown Breakdown, page int, pageSize int) []DimensionBreakdownResult {
+	defer metrics.ObserveSince(metrics.StatsQueryDuration, time.Now(), "breakdown_by_dimension")
+
+	var result []DimensionBreakdownResult
+
+	fromEvents := false
+	for _, dimension := range breakdown.Dimensions {
+		if _, ok := dailyDimensions[dimension]; !ok {
+			fromEvents = true
+		}
+	}
+
+	dimensions := dailyDimensions
+	if fromEvents {
+		dimensions = eventDimensions
+	}
+
+	var groups []string
+	for _, dimension := range breakdown.Dimensions {
+		if _, ok := dimensions[dimension]; ok && !slices.Contains(groups, dimension) {
+			groups = append(groups, dimension)
+		}
+	}
+	if len(groups) == 0 {
+		return result
+	}
+
+	// Select each dimension under its own name, the event name is always
+	// needed to pivot the metrics
+	byNameGroups := groups
+	if !slices.Contains(groups, DimensionName) {
+		byNameGroups = append(slices.Clone(groups), DimensionName)
+	}
+
+	var columns []string
+	for _, dimension := range byNameGroups {
+		column := dimensions[dimension]
+		if column != dimension {
+			column += " as " + dimension
+		}
+		columns = append(columns, column)
+	}
+
+	var byName *gorm.DB
+	if fromEvents {
+		byName = repository.db.Table("(?) as deduped", repository.dedupedEvents(repoId, TimestampCustom(query.Start, query.End), query.Filters)).
+			Select(strings.Join(columns, ", ") + ", count() as total, uniq(session_id) as unique_total")
+	} else {
+		byName = repository.db.Table("(?) as daily_stats", repository.dailyStats(repoId, query)).
+			Select(strings.Join(columns, ", ") + ", sum(total) as total, uniqMerge(unique_sessions) as unique_total")
+	}
+
+	byName = byName.Group(strings.Join(byNameGroups, ", "))
+
+	// Ties are sorted by the dimensions so pages are stable
+	order := strings.Join(groups, ", ")
+	if breakdownMetrics[breakdown.Sort] {
+		direction := " desc"
+		if breakdown.Ascending {
+			direction = " asc"
+		}
+		order = breakdown.Sort + direction + ", " + order
+	}
+
+	repository.db.Table("(?) as by_name", byName).
+		Select(strings.Join(groups, ", ") + ", " + metricColumns).
+		Group(strings.Join(groups, ", ")).
+		Order(order).
+		Scopes(Paginate(page, pageSize)).
+		Scan(&result)
+
+	return result
+}
+
 func (repository *StatsRepository) CountUniquePID(repoId string, query Query) int64 {
+	defer metrics.ObserveSince(metrics.StatsQueryDuration, time.Now(), "count_unique_pid")
+
 	var count int64
 
 	// Get timestamp scope from query start and end
 	timestampScope := TimestampCustom(query.Start, query.End)
 
-	repository.db.Model(&event.Event{}).Distinct("pid").Count(&count).Scopes(RepoId(repoId), timestampScope)
+	err := repository.db.Model(&event.Event{}).
+		Scopes(RepoId(repoId), Confirmed, timestampScope).
+		Distinct("pid").
+		Count(&count).Error
+
+	if err != nil {
+		log.Printf("Failed to count unique pids of %s: %v", repoId, err)
+	}
 
 	return count
 }
 
+func (repository *StatsRepository) Traffic(repoId string, query Query) TrafficResult {
+	defer metrics.ObserveSince(metrics.StatsQueryDuration, time.Now(), "traffic")
+
+	var result TrafficResult
+
+	// Get timestamp scope from query start and end
+	timestampScope := TimestampCustom(query.Start, query.End)
+
+	repository.db.Model(&event.Event{}).
+		Select("countIf(name = 'view') as human_views, countIf(name = 'download') as human_downloads").
+		Scopes(RepoId(repoId), Confirmed, timestampScope).
+		Scan(&result)
+
+	repository.db.Model(&event.RobotEvent{}).
+		Select("countIf(name = 'view') as robot_views, countIf(name = 'download') as robot_downloads").
+		Scopes(RepoId(repoId), timestampScope).
+		Scan(&result)
+
+	repository.db.Model(&event.RobotEvent{}).
+		Select("pattern, countIf(name = 'view') as views, countIf(name = 'download') as downloads").
+		Scopes(RepoId(repoId), timestampScope).
+		Group("pattern").
+		Order("count() desc").
+		Scan(&result.RobotPatterns)
+
+	return result
+}
+
 // Following are scopes for the event model that can be used
 // to build up queries dynamically.
 
@@ -169,6 +502,44 @@ func RepoId(repo_id string) func(db *gorm.DB) *gorm.DB {
 	}
 }
 
+// Confirmed limits to events that passed validation or did not need it,
+// pending events pass once their validation is recorded as confirmed
+func Confirmed(db *gorm.DB) *gorm.DB {
+	confirmed := db.Session(&gorm.Session{NewDB: true}).Table("event_validations FINAL").
+		Select("repo_id, pid, url, date").
+		Where("status = ?", event.ValidationConfirmed)
+
+	return db.Where("validation_status = ? OR (validation_status = ? AND (repo_id, pid, url, toDate(timestamp)) IN (?))", event.ValidationConfirmed, event.ValidationPending, confirmed)
+}
+
+// Filters limits to the usage matching every filter. Columns are taken from
+// the dimension whitelist for the table being filtered and values are always
+// bound, filters on dimensions without a column are left out.
+func Filters(filters []Filter, columns map[string]string) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		for _, filter := range filters {
+			column, ok := columns[filter.Dimension]
+			if !ok {
+				continue
+			}
+
+			switch filter.Operator {
+			case FilterEquals:
+				db = db.Where(column+" = ?", filter.Value)
+			case FilterNotEquals:
+				db = db.Where(column+" != ?", filter.Value)
+			case FilterPrefix:
+				// Paths are matched from the start of the path of the url
+				if filter.Dimension == DimensionUrl && strings.HasPrefix(filter.Value, "/") {
+					column = columns[DimensionUrlPath]
+				}
+				db = db.Where("startsWith("+column+", ?)", filter.Value)
+			}
+		}
+		return db
+	}
+}
+
 func PID(pid string) func(db *gorm.DB) *gorm.DB {
 	return func(db *gorm.DB) *gorm.DB {
 		return db.Where("pid = ?", pid)
@@ -176,7 +547,7 @@ func PID(pid string) func(db *gorm.DB) *gorm.DB {
 }
 
 func SelectDateByDay(db *gorm.DB) *gorm.DB {
-	return db.Select("toStartOfDay(interval_alias) as date")
+	return db.Select("toStartOfDay(timestamp) as date")
 }
 
 func TimestampCustom(start_date time.Time, end_date time.Time) func(db *gorm.DB) *gorm.DB {
@@ -2,18 +2,25 @@ package stats
 
 import (
 	"errors"
+	"fmt"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/datacite/keeshond/internal/app/event"
+	"github.com/datacite/keeshond/internal/app/pid"
 )
 
 type StatsServiceInterface interface {
 	Aggregate(repoId string, query Query) AggregateResult
 	Timeseries(repoId string, query Query) []TimeseriesResult
 	BreakdownByPID(repoId string, query Query, page int, pageSize int) []BreakdownResult
+	BreakdownByPIDAndCountry(repoId string, query Query, page int, pageSize int) []PidCountryResult
+	BreakdownByPIDAndAccessMethod(repoId string, query Query, page int, pageSize int) []PidAccessMethodResult
+	Breakdown(repoId string, query Query, breakdown Breakdown, page int, pageSize int) []DimensionBreakdownResult
 	CountUniquePID(repoId string, query Query) int64
 	LastEvent(repoId string) (event.Event, bool)
+	Traffic(repoId string, query Query) TrafficResult
 }
 
 type StatsService struct {
@@ -39,6 +46,18 @@ func (service *StatsService) BreakdownByPID(repoId string, query Query, page int
 	return service.repository.BreakdownByPID(repoId, query, page, pageSize)
 }
 
+func (service *StatsService) BreakdownByPIDAndCountry(repoId string, query Query, page int, pageSize int) []PidCountryResult {
+	return service.repository.BreakdownByPIDAndCountry(repoId, query, page, pageSize)
+}
+
+func (service *StatsService) BreakdownByPIDAndAccessMethod(repoId string, query Query, page int, pageSize int) []PidAccessMethodResult {
+	return service.repository.BreakdownByPIDAndAccessMethod(repoId, query, page, pageSize)
+}
+
+func (service *StatsService) Breakdown(repoId string, query Query, breakdown Breakdown, page int, pageSize int) []DimensionBreakdownResult {
+	return service.repository.Breakdown(repoId, query, breakdown, page, pageSize)
+}
+
 func (service *StatsService) CountUniquePID(repoId string, query Query) int64 {
 	return service.repository.CountUniquePID(repoId, query)
 }
@@ -47,6 +66,10 @@ func (service *StatsService) LastEvent(repoId string) (event.Event, bool) {
 	return service.repository.LastEvent(repoId)
 }
 
+func (service *StatsService) Traffic(repoId string, query Query) TrafficResult {
+	return service.repository.Traffic(repoId, query)
+}
+
 // Function to parse a period string into start and end time ranges relative to date
 func ParsePeriodString(period string, date string) (time.Time, time.Time, error) {
 	// Set default start and end times
@@ -106,3 +129,82 @@ func ParsePeriodString(period string, date string) (time.Time, time.Time, error)
 
 	return startTime, endTime, nil
 }
+
+// ParseBreakdown parses the comma separated dimensions to group by and the
+// metric to sort by followed by an optional ":asc" or ":desc", descending by
+// default. Only the dimensions and metrics that can be broken down by are
+// accepted.
+func ParseBreakdown(property string, sort string) (Breakdown, error) {
+	var breakdown Breakdown
+
+	for _, dimension := range strings.Split(property, ",") {
+		dimension = strings.TrimSpace(dimension)
+		if _, ok := eventDimensions[dimension]; !ok || dimension == DimensionUrl {
+			return breakdown, fmt.Errorf("unknown breakdown property %q", dimension)
+		}
+		if slices.Contains(breakdown.Dimensions, dimension) {
+			continue
+		}
+		breakdown.Dimensions = append(breakdown.Dimensions, dimension)
+	}
+
+	if sort != "" {
+		metric, direction, _ := strings.Cut(sort, ":")
+		if !breakdownMetrics[metric] {
+			return breakdown, fmt.Errorf("unknown breakdown sort metric %q", metric)
+		}
+		switch direction {
+		case "", "desc":
+		case "asc":
+			breakdown.Ascending = true
+		default:
+			return breakdown, fmt.Errorf("unknown breakdown sort direction %q, expected asc or desc", direction)
+		}
+		breakdown.Sort = metric
+	}
+
+	return breakdown, nil
+}
+
+// ParseFilters parses filters separated by semicolons, each a dimension, an
+// operator and a value e.g. "pid==10.1234/abc;url=~/datasets/". The operator
+// is the first of ==, != or =~ so values can contain them. Pids are normalised
+// the same as when events are stored, so any form of a pid matches its usage.
+func ParseFilters(filters string) ([]Filter, error) {
+	var result []Filter
+
+	if filters == "" {
+		return result, nil
+	}
+
+	for _, expression := range strings.Split(filters, ";") {
+		filter, ok := parseFilter(expression)
+		if !ok {
+			return nil, fmt.Errorf("invalid filter %q, expected a dimension, ==, != or =~ and a value", expression)
+		}
+		if _, ok := eventDimensions[filter.Dimension]; !ok {
+			return nil, fmt.Errorf("unknown filter dimension %q", filter.Dimension)
+		}
+		if filter.Dimension == DimensionPid {
+			filter.Value = pid.Normalize(filter.Value)
+		}
+		result = append(result, filter)
+	}
+
+	return result, nil
+}
+
+func parseFilter(expression string) (Filter, bool) {
+	for i := 0; i+2 <= len(expression); i++ {
+		switch operator := expression[i : i+2]; operator {
+		case FilterEquals, FilterNotEquals, FilterPrefix:
+			return Filter{
+				Dimension: strings.TrimSpace(expression[:i]),
+				Operator:  operator,
+				Value:     expression[i+2:],
+			}, true
+		}
+	}
+
+	return Filter{}, false
+}
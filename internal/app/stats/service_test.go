@@ -1,6 +1,7 @@
 package stats
 
 import (
+	"fmt"
 	"os"
 	"testing"
 	"time"
@@ -47,6 +48,14 @@ func createMockEvents() []event.Event {
 	return events
 }
 
+func createMockRobotEvents() []event.RobotEvent {
+	return []event.RobotEvent{
+		{Timestamp: time.Date(2022, 01, 01, 00, 05, 00, 000, time.Local), Name: "view", RepoId: "example.com", Pid: "10.1234/1", Pattern: "bot"},
+		{Timestamp: time.Date(2022, 01, 01, 00, 06, 00, 000, time.Local), Name: "view", RepoId: "example.com", Pid: "10.1234/2", Pattern: "bot"},
+		{Timestamp: time.Date(2022, 01, 01, 00, 07, 00, 000, time.Local), Name: "download", RepoId: "example.com", Pid: "10.1234/1", Pattern: "crawl"},
+	}
+}
+
 func setupTestDB(config *app.Config) (*gorm.DB, error) {
 	// Get clickhouse dsn
 	dsn := db.CreateClickhouseDSN(
@@ -85,10 +94,17 @@ func setup() TestState {
 	}
 
 	// Migrations.
-	if err := db.AutoMigrate(conn); err != nil {
+	migrator, err := db.NewMigrator(conn)
+	if err != nil {
+		println(err)
+	} else if _, err := migrator.Up(); err != nil {
 		println(err)
 	}
 
+	// Tests fill the rollup themselves so stop the view from refreshing
+	conn.Exec("SYSTEM STOP VIEW events_daily_mv")
+	conn.Exec("TRUNCATE TABLE " + RollupTable)
+
 	state := TestState{
 		conn:   conn,
 		config: config,
@@ -107,6 +123,11 @@ func setup() TestState {
 		eventService.CreateRaw(event)
 	}
 
+	// Insert mock robot events
+	for _, robotEvent := range createMockRobotEvents() {
+		eventRepository.CreateRobot(&robotEvent)
+	}
+
 	return state
 }
 
@@ -114,8 +135,17 @@ func teardown(state *TestState) {
 	// Delete from events
 	state.conn.Exec("TRUNCATE TABLE events")
 
+	// Delete robot events
+	state.conn.Exec("TRUNCATE TABLE robot_events")
+
 	// Delete salts
 	state.conn.Exec("TRUNCATE TABLE salts")
+
+	// Delete daily rollups
+	state.conn.Exec("TRUNCATE TABLE " + RollupTable)
+
+	// Delete validation outcomes
+	state.conn.Exec("TRUNCATE TABLE event_validations")
 }
 
 func TestMain(m *testing.M) {
@@ -156,12 +186,13 @@ func TestStatsService_Aggregate(t *testing.T) {
 	// Get stats
 	result := statsService.Aggregate("example.com", query)
 
-	if result.TotalDownloads != 7 {
-		t.Errorf("TotalDownloads is not 7 but got %d", result.TotalDownloads)
+	// Double clicks within 30 seconds of each other are only counted once
+	if result.TotalDownloads != 6 {
+		t.Errorf("TotalDownloads is not 6 but got %d", result.TotalDownloads)
 	}
 
-	if result.TotalViews != 12 {
-		t.Errorf("TotalViews is not 12 but got %d", result.TotalViews)
+	if result.TotalViews != 11 {
+		t.Errorf("TotalViews is not 11 but got %d", result.TotalViews)
 	}
 
 	if result.UniqueViews != 6 {
@@ -173,6 +204,131 @@ func TestStatsService_Aggregate(t *testing.T) {
 	}
 }
 
+func TestStatsService_DoubleClicks(t *testing.T) {
+	// Test config
+	config := app.GetConfigFromEnv()
+	config.Validate.DoiExistence = false
+	config.Validate.DoiUrl = false
+	config.AnalyticsDatabase.Dbname = "keeshond_test"
+
+	conn, err := setupTestDB(config)
+	if err != nil {
+		// Fail
+		t.Fatalf("Error connecting to test database: %s", err)
+	}
+
+	eventRepository := event.NewEventRepository(conn, config)
+	statsService := NewStatsService(NewStatsRepository(conn))
+
+	// Clicks are just after the hour, the session changes on the hour
+	base := time.Date(2022, 02, 01, 12, 00, 00, 000, time.Local)
+
+	type click struct {
+		name   string
+		pid    string
+		userId uint64
+		offset time.Duration
+	}
+
+	tests := []struct {
+		name           string
+		clicks         []click
+		totalViews     int64
+		totalDownloads int64
+	}{
+		{
+			name:       "single click",
+			clicks:     []click{{"view", "10.1234/1", 1, 0}},
+			totalViews: 1,
+		},
+		{
+			name:       "two clicks within window",
+			clicks:     []click{{"view", "10.1234/1", 1, 0}, {"view", "10.1234/1", 1, 10 * time.Second}},
+			totalViews: 1,
+		},
+		{
+			name:       "two clicks exactly on window",
+			clicks:     []click{{"view", "10.1234/1", 1, 0}, {"view", "10.1234/1", 1, 30 * time.Second}},
+			totalViews: 1,
+		},
+		{
+			name:       "two clicks just outside window",
+			clicks:     []click{{"view", "10.1234/1", 1, 0}, {"view", "10.1234/1", 1, 30*time.Second + time.Millisecond}},
+			totalViews: 2,
+		},
+		{
+			name:       "two clicks either side of a 30 second boundary",
+			clicks:     []click{{"view", "10.1234/1", 1, 29 * time.Second}, {"view", "10.1234/1", 1, 31 * time.Second}},
+			totalViews: 1,
+		},
+		{
+			name: "run of clicks each within window of the next",
+			clicks: []click{
+				{"view", "10.1234/1", 1, 0},
+				{"view", "10.1234/1", 1, 20 * time.Second},
+				{"view", "10.1234/1", 1, 40 * time.Second},
+				{"view", "10.1234/1", 1, 60 * time.Second},
+			},
+			totalViews: 1,
+		},
+		{
+			name:       "different pids are not double clicks",
+			clicks:     []click{{"view", "10.1234/1", 1, 0}, {"view", "10.1234/2", 1, 5 * time.Second}},
+			totalViews: 2,
+		},
+		{
+			name:           "view and download are not double clicks",
+			clicks:         []click{{"view", "10.1234/1", 1, 0}, {"download", "10.1234/1", 1, 5 * time.Second}},
+			totalViews:     1,
+			totalDownloads: 1,
+		},
+		{
+			name:       "different users are not double clicks",
+			clicks:     []click{{"view", "10.1234/1", 1, 0}, {"view", "10.1234/1", 2, 5 * time.Second}},
+			totalViews: 2,
+		},
+		{
+			name:       "two clicks within window across the hour",
+			clicks:     []click{{"view", "10.1234/1", 1, -10 * time.Second}, {"view", "10.1234/1", 1, 5 * time.Second}},
+			totalViews: 1,
+		},
+		{
+			name:       "clicks inserted out of order",
+			clicks:     []click{{"view", "10.1234/1", 1, 50 * time.Second}, {"view", "10.1234/1", 1, 0}, {"view", "10.1234/1", 1, 25 * time.Second}},
+			totalViews: 1,
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Each case is kept apart with its own repository
+			repoId := fmt.Sprintf("doubleclick-%d.example.com", i)
+
+			for _, c := range test.clicks {
+				e := event.CreateMockEvent(c.name, repoId, c.pid, c.userId, base.Add(c.offset))
+				if err := eventRepository.Create(&e); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			query := Query{
+				Start: base.Add(-time.Hour),
+				End:   base.Add(time.Hour),
+			}
+
+			result := statsService.Aggregate(repoId, query)
+
+			if result.TotalViews != test.totalViews {
+				t.Errorf("TotalViews is not %d but got %d", test.totalViews, result.TotalViews)
+			}
+
+			if result.TotalDownloads != test.totalDownloads {
+				t.Errorf("TotalDownloads is not %d but got %d", test.totalDownloads, result.TotalDownloads)
+			}
+		})
+	}
+}
+
 func TestStatsService_Timeseries(t *testing.T) {
 	// Test config
 	config := app.GetConfigFromEnv()
@@ -214,11 +370,11 @@ func TestStatsService_Timeseries(t *testing.T) {
 	// Look through results and match current hour to date
 	for _, row := range result {
 		if row.Date.Hour() == testHour {
-			if row.TotalDownloads != 5 {
-				t.Errorf("Downloads for current hour should be 5 but got %d", row.TotalDownloads)
+			if row.TotalDownloads != 4 {
+				t.Errorf("Downloads for current hour should be 4 but got %d", row.TotalDownloads)
 			}
-			if row.TotalViews != 8 {
-				t.Errorf("Views for current hour should be 8 but got %d", row.TotalViews)
+			if row.TotalViews != 7 {
+				t.Errorf("Views for current hour should be 7 but got %d", row.TotalViews)
 			}
 			if row.UniqueDownloads != 2 {
 				t.Errorf("Unique downloads for current hour should be 2 but got %d", row.UniqueDownloads)
@@ -266,6 +422,317 @@ func TestStatsService_BreakdownByPID(t *testing.T) {
 	}
 }
 
+func TestStatsService_BreakdownByPIDAndAccessMethodByPeriod(t *testing.T) {
+	// Test config
+	config := app.GetConfigFromEnv()
+	config.Validate.DoiExistence = false
+	config.Validate.DoiUrl = false
+	config.AnalyticsDatabase.Dbname = "keeshond_test"
+
+	conn, err := setupTestDB(config)
+	if err != nil {
+		// Fail
+		t.Errorf("Error connecting to test database: %s", err)
+	}
+
+	statsRepository := NewStatsRepository(conn)
+	statsService := NewStatsService(statsRepository)
+
+	// Whole of 2022, all the events are in January
+	query := Query{
+		Start:    time.Date(2022, 01, 01, 00, 00, 00, 000, time.Local),
+		End:      time.Date(2023, 01, 01, 00, 00, 00, 000, time.Local),
+		Interval: "month",
+	}
+
+	breakdown := statsService.BreakdownByPID("example.com", query, 1, 100)
+	result := statsService.BreakdownByPIDAndAccessMethod("example.com", query, 1, 100)
+
+	// Months without events are left out and the mock events are all regular,
+	// so each pid has a single row with the same counts as the breakdown of
+	// the whole query
+	if len(result) != len(breakdown) {
+		t.Fatalf("BreakdownByPIDAndAccessMethod should have %d rows but got %d", len(breakdown), len(result))
+	}
+
+	for i, row := range result {
+		if row.Period.Format("2006-01-02") != "2022-01-01" {
+			t.Errorf("%s period should start on 2022-01-01 but got %s", row.Pid, row.Period.Format("2006-01-02"))
+		}
+		if row.BreakdownResult != breakdown[i] {
+			t.Errorf("%s period should be %+v but got %+v", row.Pid, breakdown[i], row.BreakdownResult)
+		}
+	}
+}
+
+func TestStatsService_BreakdownByPIDAndCountry(t *testing.T) {
+	// Test config
+	config := app.GetConfigFromEnv()
+	config.Validate.DoiExistence = false
+	config.Validate.DoiUrl = false
+	config.AnalyticsDatabase.Dbname = "keeshond_test"
+
+	conn, err := setupTestDB(config)
+	if err != nil {
+		// Fail
+		t.Errorf("Error connecting to test database: %s", err)
+	}
+
+	statsRepository := NewStatsRepository(conn)
+	statsService := NewStatsService(statsRepository)
+
+	query := Query{
+		Start: time.Date(2022, 01, 01, 00, 00, 00, 000, time.Local),
+		End:   time.Date(2022, 01, 02, 00, 00, 00, 000, time.Local),
+	}
+
+	// The mock events have no country so each pid has its own row without one
+	result := statsService.BreakdownByPIDAndCountry("example.com", query, 1, 100)
+	breakdown := statsService.BreakdownByPID("example.com", query, 1, 100)
+
+	if len(result) != len(breakdown) {
+		t.Fatalf("BreakdownByPIDAndCountry should have %d rows but got %d", len(breakdown), len(result))
+	}
+
+	for i, row := range result {
+		if row.Country != "" {
+			t.Errorf("%s should have no country but got %s", row.Pid, row.Country)
+		}
+		if row.BreakdownResult != breakdown[i] {
+			t.Errorf("BreakdownByPIDAndCountry should match the breakdown %+v but got %+v", breakdown[i], row.BreakdownResult)
+		}
+	}
+}
+
+func TestStatsService_BreakdownByPIDAndAccessMethod(t *testing.T) {
+	// Test config
+	config := app.GetConfigFromEnv()
+	config.Validate.DoiExistence = false
+	config.Validate.DoiUrl = false
+	config.AnalyticsDatabase.Dbname = "keeshond_test"
+
+	conn, err := setupTestDB(config)
+	if err != nil {
+		// Fail
+		t.Errorf("Error connecting to test database: %s", err)
+	}
+
+	statsRepository := NewStatsRepository(conn)
+	statsService := NewStatsService(statsRepository)
+
+	query := Query{
+		Start: time.Date(2022, 01, 01, 00, 00, 00, 000, time.Local),
+		End:   time.Date(2022, 01, 02, 00, 00, 00, 000, time.Local),
+	}
+
+	// The mock events are all regular so each pid has a single row
+	result := statsService.BreakdownByPIDAndAccessMethod("example.com", query, 1, 100)
+	breakdown := statsService.BreakdownByPID("example.com", query, 1, 100)
+
+	if len(result) != len(breakdown) {
+		t.Fatalf("BreakdownByPIDAndAccessMethod should have %d rows but got %d", len(breakdown), len(result))
+	}
+
+	for i, row := range result {
+		if row.AccessMethod != event.AccessRegular {
+			t.Errorf("Access method should be %s but got %s", event.AccessRegular, row.AccessMethod)
+		}
+		if row.BreakdownResult != breakdown[i] {
+			t.Errorf("BreakdownByPIDAndAccessMethod should match the breakdown %+v but got %+v", breakdown[i], row.BreakdownResult)
+		}
+	}
+}
+
+func TestStatsService_Breakdown(t *testing.T) {
+	// Test config
+	config := app.GetConfigFromEnv()
+	config.Validate.DoiExistence = false
+	config.Validate.DoiUrl = false
+	config.AnalyticsDatabase.Dbname = "keeshond_test"
+
+	conn, err := setupTestDB(config)
+	if err != nil {
+		// Fail
+		t.Errorf("Error connecting to test database: %s", err)
+	}
+
+	statsRepository := NewStatsRepository(conn)
+	statsService := NewStatsService(statsRepository)
+
+	query := Query{
+		Start: time.Date(2022, 01, 01, 00, 00, 00, 000, time.Local),
+		End:   time.Date(2022, 01, 02, 00, 00, 00, 000, time.Local),
+	}
+
+	// Sorted by a metric the second pid comes first
+	breakdown, _ := ParseBreakdown("pid", "total_downloads")
+	result := statsService.Breakdown("example.com", query, breakdown, 1, 100)
+	byPid := statsService.BreakdownByPID("example.com", query, 1, 100)
+
+	if len(result) != 2 || len(byPid) != 2 {
+		t.Fatalf("Breakdown should have 2 rows but got %d", len(result))
+	}
+
+	if *result[0].Pid != "10.1234/2" || result[0].TotalDownloads != byPid[1].TotalDownloads || result[1].UniqueViews != byPid[0].UniqueViews {
+		t.Errorf("Breakdown should match the breakdown by pid %+v but got %+v", byPid, result)
+	}
+
+	// Url dimensions are read from the events
+	query.Filters = []Filter{{Dimension: DimensionPid, Operator: FilterEquals, Value: "10.1234/1"}}
+	breakdown, _ = ParseBreakdown("url_path,host_domain,day_of_week", "")
+	result = statsService.Breakdown("example.com", query, breakdown, 1, 100)
+
+	if len(result) != 1 {
+		t.Fatalf("Breakdown should have 1 row but got %d", len(result))
+	}
+
+	if *result[0].UrlPath != "/page/10.1234/1" || *result[0].HostDomain != "example.com" || *result[0].DayOfWeek != "Saturday" {
+		t.Errorf("Breakdown dimensions are not correct got %s %s %s", *result[0].UrlPath, *result[0].HostDomain, *result[0].DayOfWeek)
+	}
+
+	if result[0].Pid != nil {
+		t.Errorf("Breakdown should not have a pid when not grouped by it")
+	}
+
+	if result[0].TotalViews != byPid[0].TotalViews || result[0].UniqueDownloads != byPid[0].UniqueDownloads {
+		t.Errorf("Breakdown should match the breakdown by pid %+v but got %+v", byPid[0], result[0])
+	}
+}
+
+func TestParseBreakdown(t *testing.T) {
+	breakdown, err := ParseBreakdown("country, name,country", "unique_views:asc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(breakdown.Dimensions) != 2 || breakdown.Dimensions[0] != DimensionCountry || breakdown.Dimensions[1] != DimensionName {
+		t.Errorf("Dimensions should be country and name but got %v", breakdown.Dimensions)
+	}
+
+	if breakdown.Sort != "unique_views" || !breakdown.Ascending {
+		t.Errorf("Sort should be unique_views ascending but got %s %t", breakdown.Sort, breakdown.Ascending)
+	}
+
+	invalid := []struct {
+		property string
+		sort     string
+	}{
+		{"session_id", ""},
+		{"url", ""},
+		{"pid", "pid"},
+		{"pid", "total_views:up"},
+	}
+
+	for _, test := range invalid {
+		if _, err := ParseBreakdown(test.property, test.sort); err == nil {
+			t.Errorf("ParseBreakdown(%q, %q) should return an error", test.property, test.sort)
+		}
+	}
+}
+
+func TestParseFilters(t *testing.T) {
+	filters, err := ParseFilters("pid==10.1234/abc;url=~/datasets/;country!=GB;url_path==/a==b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Filter{
+		{Dimension: DimensionPid, Operator: FilterEquals, Value: "10.1234/abc"},
+		{Dimension: DimensionUrl, Operator: FilterPrefix, Value: "/datasets/"},
+		{Dimension: DimensionCountry, Operator: FilterNotEquals, Value: "GB"},
+		{Dimension: DimensionUrlPath, Operator: FilterEquals, Value: "/a==b"},
+	}
+
+	if len(filters) != len(want) {
+		t.Fatalf("Filters should be %+v but got %+v", want, filters)
+	}
+	for i := range want {
+		if filters[i] != want[i] {
+			t.Errorf("Filter should be %+v but got %+v", want[i], filters[i])
+		}
+	}
+
+	for _, invalid := range []string{"pid", "country=GB", "user_id==1", "==view", "pid==1;"} {
+		if _, err := ParseFilters(invalid); err == nil {
+			t.Errorf("ParseFilters(%q) should return an error", invalid)
+		}
+	}
+
+	// Pids are filtered on in the form they are stored in
+	for expression, value := range map[string]string{
+		"pid==https://doi.org/10.1234/ABC": "10.1234/abc",
+		"pid!=doi:10.1234/ABC":             "10.1234/abc",
+		"pid=~10.1234/AB":                  "10.1234/ab",
+		"pid==hdl:20.500.12345/ABC":        "20.500.12345/abc",
+	} {
+		filters, err := ParseFilters(expression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filters[0].Value != value {
+			t.Errorf("ParseFilters(%q) should filter on %s but got %s", expression, value, filters[0].Value)
+		}
+	}
+}
+
+func TestStatsService_Filters(t *testing.T) {
+	// Test config
+	config := app.GetConfigFromEnv()
+	config.Validate.DoiExistence = false
+	config.Validate.DoiUrl = false
+	config.AnalyticsDatabase.Dbname = "keeshond_test"
+
+	conn, err := setupTestDB(config)
+	if err != nil {
+		// Fail
+		t.Errorf("Error connecting to test database: %s", err)
+	}
+
+	statsRepository := NewStatsRepository(conn)
+	statsService := NewStatsService(statsRepository)
+
+	query := Query{
+		Start: time.Date(2022, 01, 01, 00, 00, 00, 000, time.Local),
+		End:   time.Date(2022, 01, 02, 00, 00, 00, 000, time.Local),
+	}
+
+	byPid := statsService.BreakdownByPID("example.com", query, 1, 100)
+	if len(byPid) != 2 {
+		t.Fatalf("BreakdownByPID should have 2 rows but got %d", len(byPid))
+	}
+
+	tests := []struct {
+		filters string
+		want    BreakdownResult
+	}{
+		{"pid==10.1234/1", byPid[0]},
+		{"pid!=10.1234/1", byPid[1]},
+		{"url=~/page/10.1234/2", byPid[1]},
+		{"url=~http://example.com/page/10.1234/1", byPid[0]},
+		{"pid=~10.1234/;name==view", BreakdownResult{TotalViews: byPid[0].TotalViews + byPid[1].TotalViews}},
+	}
+
+	for _, test := range tests {
+		query.Filters, err = ParseFilters(test.filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		aggregate := statsService.Aggregate("example.com", query)
+		if aggregate.TotalViews != test.want.TotalViews || aggregate.TotalDownloads != test.want.TotalDownloads {
+			t.Errorf("Aggregate filtered by %s should have %d views and %d downloads but got %+v", test.filters, test.want.TotalViews, test.want.TotalDownloads, aggregate)
+		}
+
+		var views int64
+		for _, result := range statsService.Timeseries("example.com", query) {
+			views += result.TotalViews
+		}
+		if views != test.want.TotalViews {
+			t.Errorf("Timeseries filtered by %s should have %d views but got %d", test.filters, test.want.TotalViews, views)
+		}
+	}
+}
+
 func TestStatsService_CountUniquePID(t *testing.T) {
 	// Test config
 	config := app.GetConfigFromEnv()
@@ -325,3 +792,313 @@ func TestStatsService_LastEvent(t *testing.T) {
 		t.Errorf("LastEvent should have returned 2022-01-01 02:00:30 but got %s", result.Timestamp)
 	}
 }
+
+func TestStatsService_Traffic(t *testing.T) {
+	// Test config
+	config := app.GetConfigFromEnv()
+	config.Validate.DoiExistence = false
+	config.Validate.DoiUrl = false
+	config.AnalyticsDatabase.Dbname = "keeshond_test"
+
+	conn, err := setupTestDB(config)
+	if err != nil {
+		// Fail
+		t.Errorf("Error connecting to test database: %s", err)
+	}
+
+	statsRepository := NewStatsRepository(conn)
+	statsService := NewStatsService(statsRepository)
+
+	// Start of today
+	start := time.Date(2022, 01, 01, 00, 00, 00, 000, time.Local)
+
+	// End of the day
+	end := start.Add(24 * time.Hour)
+
+	query := Query{
+		Start: start,
+		End:   end,
+	}
+
+	// Get stats
+	result := statsService.Traffic("example.com", query)
+
+	if result.HumanViews != 12 {
+		t.Errorf("HumanViews is not 12 but got %d", result.HumanViews)
+	}
+
+	if result.HumanDownloads != 7 {
+		t.Errorf("HumanDownloads is not 7 but got %d", result.HumanDownloads)
+	}
+
+	if result.RobotViews != 2 {
+		t.Errorf("RobotViews is not 2 but got %d", result.RobotViews)
+	}
+
+	if result.RobotDownloads != 1 {
+		t.Errorf("RobotDownloads is not 1 but got %d", result.RobotDownloads)
+	}
+
+	if len(result.RobotPatterns) != 2 || result.RobotPatterns[0].Pattern != "bot" {
+		t.Errorf("RobotPatterns should have bot first of 2 patterns but got %v", result.RobotPatterns)
+	}
+}
+
+func TestStatsService_Rollup(t *testing.T) {
+	// Test config
+	config := app.GetConfigFromEnv()
+	config.Validate.DoiExistence = false
+	config.Validate.DoiUrl = false
+	config.AnalyticsDatabase.Dbname = "keeshond_test"
+
+	conn, err := setupTestDB(config)
+	if err != nil {
+		t.Fatalf("Error connecting to test database: %s", err)
+	}
+
+	// Other tests expect an empty rollup
+	defer conn.Exec("TRUNCATE TABLE " + RollupTable)
+
+	repoId := "rollup.example.com"
+
+	// Two rolled up days, sessions 0 and 1 are on both days
+	conn.Exec("INSERT INTO "+RollupTable+" (date, repo_id, pid, name, total, unique_sessions) SELECT toDate('2022-03-01'), ?, '10.1234/1', 'view', 5, uniqState(toUInt64(number)) FROM numbers(3)", repoId)
+	conn.Exec("INSERT INTO "+RollupTable+" (date, repo_id, pid, name, total, unique_sessions) SELECT toDate('2022-03-02'), ?, '10.1234/1', 'view', 4, uniqState(toUInt64(number)) FROM numbers(2)", repoId)
+
+	// Another repository rolled up further does not move where this one ends
+	conn.Exec("INSERT INTO " + RollupTable + " (date, repo_id, pid, name, total, unique_sessions) SELECT toDate('2022-03-05'), 'other.example.com', '10.1234/1', 'view', 1, uniqState(toUInt64(number)) FROM numbers(1)")
+
+	sessionRepository := session.NewSessionRepository(conn, config)
+	sessionService := session.NewSessionService(sessionRepository, config)
+	eventService := event.NewEventService(event.NewEventRepository(conn, config), sessionService, config)
+
+	// Already in the rollup so must not be counted again
+	eventService.CreateRaw(event.CreateMockEvent("view", repoId, "10.1234/1", 500, time.Date(2022, 03, 01, 12, 00, 00, 000, time.Local)))
+
+	// After the rollup so read from the events
+	eventService.CreateRaw(event.CreateMockEvent("view", repoId, "10.1234/1", 501, time.Date(2022, 03, 03, 12, 00, 00, 000, time.Local)))
+	eventService.CreateRaw(event.CreateMockEvent("download", repoId, "10.1234/1", 501, time.Date(2022, 03, 03, 12, 05, 00, 000, time.Local)))
+
+	query := Query{
+		Start: time.Date(2022, 03, 01, 00, 00, 00, 000, time.Local),
+		End:   time.Date(2022, 03, 04, 00, 00, 00, 000, time.Local),
+	}
+
+	statsService := NewStatsService(NewStatsRepository(conn))
+
+	result := statsService.Aggregate(repoId, query)
+
+	if result.TotalViews != 10 {
+		t.Errorf("TotalViews is not 10 but got %d", result.TotalViews)
+	}
+
+	// Unique sessions are merged across the rollup days and the events
+	if result.UniqueViews != 4 {
+		t.Errorf("UniqueViews is not 4 but got %d", result.UniqueViews)
+	}
+
+	if result.TotalDownloads != 1 {
+		t.Errorf("TotalDownloads is not 1 but got %d", result.TotalDownloads)
+	}
+
+	timeseries := statsService.Timeseries(repoId, query)
+
+	if len(timeseries) != 3 {
+		t.Fatalf("Timeseries should have 3 days but got %d", len(timeseries))
+	}
+
+	expectedViews := []int64{5, 4, 1}
+	for i, views := range expectedViews {
+		if timeseries[i].TotalViews != views {
+			t.Errorf("Day %d TotalViews is not %d but got %d", i, views, timeseries[i].TotalViews)
+		}
+	}
+
+	breakdown := statsService.BreakdownByPID(repoId, query, 1, 10)
+
+	if len(breakdown) != 1 || breakdown[0].TotalViews != 10 {
+		t.Errorf("Breakdown should have 10 views for one pid but got %v", breakdown)
+	}
+}
+
+func TestStatsService_RollupMadeAgain(t *testing.T) {
+	// Test config
+	config := app.GetConfigFromEnv()
+	config.AnalyticsDatabase.Dbname = "keeshond_test"
+
+	conn, err := setupTestDB(config)
+	if err != nil {
+		t.Fatalf("Error connecting to test database: %s", err)
+	}
+
+	// Other tests expect an empty rollup
+	defer conn.Exec("TRUNCATE TABLE " + RollupTable)
+
+	repoId := "late.example.com"
+
+	// The day is rolled up again once a late event arrived, only the later row is read
+	conn.Exec("INSERT INTO "+RollupTable+" (date, repo_id, pid, name, total, unique_sessions, refreshed) SELECT toDate('2022-06-01'), ?, '10.1234/1', 'view', 2, uniqState(toUInt64(number)), toDateTime('2022-06-02 00:10:00') FROM numbers(2)", repoId)
+	conn.Exec("INSERT INTO "+RollupTable+" (date, repo_id, pid, name, total, unique_sessions, refreshed) SELECT toDate('2022-06-01'), ?, '10.1234/1', 'view', 3, uniqState(toUInt64(number)), toDateTime('2022-06-03 00:10:00') FROM numbers(3)", repoId)
+
+	query := Query{
+		Start: time.Date(2022, 06, 01, 00, 00, 00, 000, time.Local),
+		End:   time.Date(2022, 06, 02, 00, 00, 00, 000, time.Local),
+	}
+
+	result := NewStatsService(NewStatsRepository(conn)).Aggregate(repoId, query)
+
+	if result.TotalViews != 3 || result.UniqueViews != 3 {
+		t.Errorf("Expected 3 views of 3 sessions but got %d of %d", result.TotalViews, result.UniqueViews)
+	}
+}
+
+func TestStatsService_RenamePidsAfterPartialFailure(t *testing.T) {
+	// Test config
+	config := app.GetConfigFromEnv()
+	config.AnalyticsDatabase.Dbname = "keeshond_test"
+
+	conn, err := setupTestDB(config)
+	if err != nil {
+		t.Fatalf("Error connecting to test database: %s", err)
+	}
+
+	// Other tests expect an empty rollup
+	defer conn.Exec("TRUNCATE TABLE " + RollupTable)
+
+	repoId := "rename.example.com"
+	day := time.Date(2022, 07, 01, 12, 00, 00, 000, time.Local)
+
+	eventRepository := event.NewEventRepository(conn, config)
+
+	// Stored before pids were normalised, under two forms of the same DOI
+	views := []event.Event{
+		event.CreateMockEvent("view", repoId, "https://doi.org/10.1234/RENAME", 800, day),
+		event.CreateMockEvent("view", repoId, "https://doi.org/10.1234/RENAME", 800, day.Add(time.Hour)),
+		event.CreateMockEvent("view", repoId, "10.1234/rename", 801, day),
+	}
+	for i := range views {
+		eventRepository.Create(&views[i])
+	}
+
+	// The day was rolled up under both forms
+	conn.Exec("INSERT INTO "+RollupTable+" (date, repo_id, pid, name, total, unique_sessions) SELECT toDate(timestamp), repo_id, pid, name, count(), uniqState(session_id) FROM events WHERE repo_id = ? GROUP BY toDate(timestamp), repo_id, pid, name", repoId)
+
+	// A rename failed once the events were moved, the rollup was not
+	conn.Exec("ALTER TABLE events UPDATE pid = '10.1234/rename' WHERE repo_id = ? AND pid = 'https://doi.org/10.1234/RENAME' SETTINGS mutations_sync = 1", repoId)
+
+	// Running again finishes it, and a further run changes nothing
+	for run := 0; run < 2; run++ {
+		if _, err := event.NormaliseStoredPids(eventRepository, 100, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query := Query{
+		Start: time.Date(2022, 07, 01, 00, 00, 00, 000, time.Local),
+		End:   time.Date(2022, 07, 02, 00, 00, 00, 000, time.Local),
+	}
+
+	statsService := NewStatsService(NewStatsRepository(conn))
+
+	if result := statsService.Aggregate(repoId, query); result.TotalViews != 3 || result.UniqueViews != 3 {
+		t.Errorf("Expected 3 views of 3 sessions but got %d of %d", result.TotalViews, result.UniqueViews)
+	}
+
+	breakdown := statsService.BreakdownByPID(repoId, query, 1, 10)
+	if len(breakdown) != 1 || breakdown[0].Pid != "10.1234/rename" || breakdown[0].TotalViews != 3 {
+		t.Errorf("Expected 3 views of 10.1234/rename but got %v", breakdown)
+	}
+}
+
+func TestStatsService_OnlyConfirmedEvents(t *testing.T) {
+	// Test config
+	config := app.GetConfigFromEnv()
+	config.Validate.DoiExistence = false
+	config.Validate.DoiUrl = false
+	config.AnalyticsDatabase.Dbname = "keeshond_test"
+
+	conn, err := setupTestDB(config)
+	if err != nil {
+		t.Fatalf("Error connecting to test database: %s", err)
+	}
+
+	repoId := "validation.example.com"
+	timestamp := time.Date(2022, 04, 01, 12, 00, 00, 000, time.Local)
+
+	eventRepository := event.NewEventRepository(conn, config)
+
+	statuses := []uint8{event.ValidationConfirmed, event.ValidationPending, event.ValidationQuarantined}
+	for i, status := range statuses {
+		view := event.CreateMockEvent("view", repoId, "10.1234/1", uint64(600+i), timestamp)
+		view.ValidationStatus = status
+		eventRepository.Create(&view)
+	}
+
+	query := Query{
+		Start: time.Date(2022, 04, 01, 00, 00, 00, 000, time.Local),
+		End:   time.Date(2022, 04, 02, 00, 00, 00, 000, time.Local),
+	}
+
+	statsService := NewStatsService(NewStatsRepository(conn))
+
+	// Pending and quarantined events are not counted
+	if result := statsService.Aggregate(repoId, query); result.TotalViews != 1 {
+		t.Errorf("TotalViews is not 1 but got %d", result.TotalViews)
+	}
+
+	if result := statsService.Traffic(repoId, query); result.HumanViews != 1 {
+		t.Errorf("HumanViews is not 1 but got %d", result.HumanViews)
+	}
+
+	// Pending events are counted once their validation is confirmed
+	pending := event.PendingValidation{RepoId: repoId, Pid: "10.1234/1", Url: "http://" + repoId + "/page/10.1234/1", Date: query.Start}
+	if err := eventRepository.SetValidationStatus([]event.PendingValidation{pending}, event.ValidationConfirmed); err != nil {
+		t.Fatal(err)
+	}
+
+	if result := statsService.Aggregate(repoId, query); result.TotalViews != 2 {
+		t.Errorf("TotalViews is not 2 but got %d", result.TotalViews)
+	}
+}
+
+func TestStatsService_CountUniquePIDOnlyConfirmedEvents(t *testing.T) {
+	// Test config
+	config := app.GetConfigFromEnv()
+	config.Validate.DoiExistence = false
+	config.Validate.DoiUrl = false
+	config.AnalyticsDatabase.Dbname = "keeshond_test"
+
+	conn, err := setupTestDB(config)
+	if err != nil {
+		t.Fatalf("Error connecting to test database: %s", err)
+	}
+
+	repoId := "count.example.com"
+	timestamp := time.Date(2022, 05, 01, 12, 00, 00, 000, time.Local)
+
+	eventRepository := event.NewEventRepository(conn, config)
+
+	// Each pid is only seen with one status
+	statuses := []uint8{event.ValidationConfirmed, event.ValidationPending, event.ValidationQuarantined}
+	for i, status := range statuses {
+		view := event.CreateMockEvent("view", repoId, fmt.Sprintf("10.1234/count.%d", i), uint64(700+i), timestamp)
+		view.ValidationStatus = status
+		eventRepository.Create(&view)
+	}
+
+	// Outside of the query
+	outside := event.CreateMockEvent("view", repoId, "10.1234/count.later", 710, timestamp.AddDate(0, 0, 5))
+	eventRepository.Create(&outside)
+
+	query := Query{
+		Start: time.Date(2022, 05, 01, 00, 00, 00, 000, time.Local),
+		End:   time.Date(2022, 05, 02, 00, 00, 00, 000, time.Local),
+	}
+
+	statsService := NewStatsService(NewStatsRepository(conn))
+
+	// Only the confirmed pid of the repository in the query is counted
+	if result := statsService.CountUniquePID(repoId, query); result != 1 {
+		t.Errorf("CountUniquePID should have returned 1 but got %d", result)
+	}
+}